@@ -40,8 +40,8 @@ func main() {
 						"X-API-Key": "${AIPRISE_API_KEY}",
 					},
 				},
-				Timeout: 30 * time.Second,
-				TLSMode: "terminate",
+				RequestTimeout: 30 * time.Second,
+				TLSMode:        "terminate",
 			},
 		},
 		Transport: mimicproxy.TransportConfig{
@@ -51,8 +51,8 @@ func main() {
 						"X-API-Key": os.Getenv("AIPRISE_API_KEY"),
 					},
 				},
-				Timeout: 30 * time.Second,
-				TLSMode: "terminate",
+				RequestTimeout: 30 * time.Second,
+				TLSMode:        "terminate",
 			},
 			{
 				// Route 2: Aiprise callback verification (for HMAC signature verification)
@@ -68,8 +68,8 @@ func main() {
 						"X-API-Key": os.Getenv("AIPRISE_API_KEY"),
 					},
 				},
-				Timeout: 10 * time.Second,
-				TLSMode: "terminate",
+				RequestTimeout: 10 * time.Second,
+				TLSMode:        "terminate",
 			},
 		},
 		Transport: mimicproxy.TransportConfig{
@@ -0,0 +1,146 @@
+package mimicproxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// adminStatus is the admin API's view of the proxy's runtime state.
+type adminStatus struct {
+	Draining    bool     `json:"draining"`
+	Maintenance []string `json:"maintenance"`
+}
+
+// SetRouteMaintenance puts the named route into maintenance, where it answers
+// every request with 503 Service Unavailable without contacting the upstream,
+// or takes it out again. Other routes are unaffected.
+func (p *Proxy) SetRouteMaintenance(name string, enabled bool) (err error) {
+	route := p.routeByName(name)
+	if route == nil {
+		err = fmt.Errorf("unknown route: %s", name)
+		return err
+	}
+
+	if route.maintenance.Swap(enabled) != enabled {
+		if enabled {
+			p.logger.Info("Route entered maintenance", "route", name)
+		} else {
+			p.logger.Info("Route left maintenance", "route", name)
+		}
+	}
+	return err
+}
+
+// MaintenanceRoutes returns the names of the routes in maintenance, in
+// matching order.
+func (p *Proxy) MaintenanceRoutes() (names []string) {
+	names = []string{}
+	for _, route := range p.routes {
+		if route.maintenance.Load() {
+			names = append(names, route.config.Name)
+		}
+	}
+	return names
+}
+
+// routeByName returns the route with the given name, or nil.
+func (p *Proxy) routeByName(name string) (route *Route) {
+	for _, candidate := range p.routes {
+		if candidate.config.Name == name {
+			route = candidate
+			return route
+		}
+	}
+	return route
+}
+
+// AdminHandler returns a handler for changing the proxy's runtime state
+// without a redeploy. Requests must carry "Authorization: Bearer <token>"
+// with Admin.Token; without a configured token every request is refused.
+// Every endpoint responds with the resulting state as JSON:
+//
+//	GET    /admin/status                    current state
+//	POST   /admin/drain                     Drain
+//	POST   /admin/undrain                   Undrain
+//	POST   /admin/routes/{name}/maintenance put a route into maintenance
+//	DELETE /admin/routes/{name}/maintenance take a route out of maintenance
+//
+// Mount it on a listener that is not exposed to proxied clients.
+func (p *Proxy) AdminHandler() (handler http.Handler) {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /admin/status", func(w http.ResponseWriter, _ *http.Request) {
+		p.writeAdminStatus(w)
+	})
+	mux.HandleFunc("POST /admin/drain", func(w http.ResponseWriter, _ *http.Request) {
+		p.Drain()
+		p.writeAdminStatus(w)
+	})
+	mux.HandleFunc("POST /admin/undrain", func(w http.ResponseWriter, _ *http.Request) {
+		p.Undrain()
+		p.writeAdminStatus(w)
+	})
+	mux.HandleFunc("POST /admin/routes/{name}/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		p.handleAdminMaintenance(w, r, true)
+	})
+	mux.HandleFunc("DELETE /admin/routes/{name}/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		p.handleAdminMaintenance(w, r, false)
+	})
+
+	handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+
+		if !p.adminAuthorized(r) {
+			p.logger.Warn("Unauthorized admin request",
+				"path", r.URL.Path,
+				"method", r.Method,
+				"remote_addr", r.RemoteAddr)
+
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mimic-proxy admin"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+	return handler
+}
+
+// handleAdminMaintenance sets the maintenance state of the route named in the
+// request path.
+func (p *Proxy) handleAdminMaintenance(w http.ResponseWriter, r *http.Request, enabled bool) {
+	var err error
+	err = p.SetRouteMaintenance(r.PathValue("name"), enabled)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	p.writeAdminStatus(w)
+}
+
+// adminAuthorized reports whether r carries the configured admin token. An
+// empty token authorizes nothing.
+func (p *Proxy) adminAuthorized(r *http.Request) (authorized bool) {
+	token := expandEnvVars(p.config.Admin.Token)
+	if token == "" {
+		return authorized
+	}
+
+	presented, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	authorized = found && subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1
+	return authorized
+}
+
+// writeAdminStatus writes the proxy's current runtime state as JSON.
+func (p *Proxy) writeAdminStatus(w http.ResponseWriter) {
+	status := adminStatus{
+		Draining:    p.Draining(),
+		Maintenance: p.MaintenanceRoutes(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(status)
+}
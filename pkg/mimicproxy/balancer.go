@@ -0,0 +1,141 @@
+package mimicproxy
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrNoUpstream is the error the transport reports when a route's Balancer
+// returns no upstream for a request. Such requests get a 503.
+var ErrNoUpstream = errors.New("no upstream available")
+
+// Balancer selects which of a route's upstreams serves a request.
+// Implementations must be safe for concurrent use. Returning nil rejects the
+// request with 503 Service Unavailable.
+type Balancer interface {
+	Pick(req *http.Request, upstreams []*url.URL) (upstream *url.URL)
+}
+
+// TrackingBalancer is a Balancer that is told when a request to the upstream
+// it picked has completed, for balancers that track requests in flight.
+type TrackingBalancer interface {
+	Balancer
+	Done(upstream *url.URL)
+}
+
+// NewBalancer returns the built-in Balancer with the given name: "round_robin",
+// "random", "least_conn", or "consistent_hash".
+func NewBalancer(name string) (balancer Balancer, err error) {
+	switch name {
+	case BalancerRoundRobin:
+		balancer = &roundRobinBalancer{}
+	case BalancerRandom:
+		balancer = &randomBalancer{}
+	case BalancerLeastConn:
+		balancer = &leastConnBalancer{active: make(map[string]int)}
+	case BalancerConsistentHash:
+		balancer = &consistentHashBalancer{}
+	default:
+		err = fmt.Errorf("unknown balancer: %s", name)
+	}
+	return balancer, err
+}
+
+// roundRobinBalancer cycles through the upstreams in order.
+type roundRobinBalancer struct {
+	next atomic.Uint64
+}
+
+// Pick implements Balancer.
+func (b *roundRobinBalancer) Pick(_ *http.Request, upstreams []*url.URL) (upstream *url.URL) {
+	if len(upstreams) == 0 {
+		return upstream
+	}
+
+	upstream = upstreams[(b.next.Add(1)-1)%uint64(len(upstreams))]
+	return upstream
+}
+
+// randomBalancer picks an upstream uniformly at random.
+type randomBalancer struct{}
+
+// Pick implements Balancer.
+func (b *randomBalancer) Pick(_ *http.Request, upstreams []*url.URL) (upstream *url.URL) {
+	if len(upstreams) == 0 {
+		return upstream
+	}
+
+	upstream = upstreams[rand.IntN(len(upstreams))]
+	return upstream
+}
+
+// leastConnBalancer picks the upstream with the fewest requests in flight,
+// preferring earlier upstreams on ties.
+type leastConnBalancer struct {
+	mu     sync.Mutex
+	active map[string]int
+}
+
+// Pick implements Balancer.
+func (b *leastConnBalancer) Pick(_ *http.Request, upstreams []*url.URL) (upstream *url.URL) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, candidate := range upstreams {
+		if upstream == nil || b.active[candidate.String()] < b.active[upstream.String()] {
+			upstream = candidate
+		}
+	}
+
+	if upstream != nil {
+		b.active[upstream.String()]++
+	}
+	return upstream
+}
+
+// Done implements TrackingBalancer.
+func (b *leastConnBalancer) Done(upstream *url.URL) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := upstream.String()
+	b.active[key]--
+	if b.active[key] <= 0 {
+		delete(b.active, key)
+	}
+}
+
+// consistentHashBalancer maps each client IP to the same upstream using
+// rendezvous hashing, so only clients of an added or removed upstream move.
+// On a route the client IP is resolved through the trusted proxies; elsewhere
+// it is the request's peer.
+type consistentHashBalancer struct{}
+
+// Pick implements Balancer.
+func (b *consistentHashBalancer) Pick(req *http.Request, upstreams []*url.URL) (upstream *url.URL) {
+	clientIP := remoteIP(req)
+	selection, ok := req.Context().Value(upstreamSelectionKey{}).(*upstreamSelection)
+	if ok && selection.clientIP != "" {
+		clientIP = selection.clientIP
+	}
+
+	var best uint64
+	for _, candidate := range upstreams {
+		hash := fnv.New64a()
+		_, _ = hash.Write([]byte(clientIP))
+		_, _ = hash.Write([]byte(candidate.String()))
+
+		score := hash.Sum64()
+		if upstream == nil || score > best {
+			upstream = candidate
+			best = score
+		}
+	}
+	return upstream
+}
@@ -0,0 +1,462 @@
+package mimicproxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// BodyTransform rewrites a complete message body.
+type BodyTransform func(body []byte) (transformed []byte, err error)
+
+// maxRequestTransformBytes is the largest request body buffered for a
+// RequestBodyTransform, RequestSchema validation, or VerifyHMAC.
+const maxRequestTransformBytes = 10 << 20
+
+// errRequestBodyTooLarge reports a request body over maxRequestTransformBytes.
+var errRequestBodyTooLarge = errors.New("request body too large to buffer")
+
+// maxResponseTransformBytes is the largest decoded response body buffered for
+// a ResponseBodyTransform.
+const maxResponseTransformBytes = 10 << 20
+
+// errResponseBodyTooLarge reports a decoded response body over
+// maxResponseTransformBytes.
+var errResponseBodyTooLarge = errors.New("response body too large to transform")
+
+// errBodyReadTimeout reports an upstream response body read that blocked for
+// longer than the route's BodyReadTimeout.
+var errBodyReadTimeout = fmt.Errorf("upstream response body read timed out: %w", os.ErrDeadlineExceeded)
+
+// isJSONContentType reports whether contentType is application/json or a
+// structured +json media type.
+func isJSONContentType(contentType string) (isJSON bool) {
+	var mediaType string
+	var err error
+	mediaType, _, err = mime.ParseMediaType(contentType)
+	if err != nil {
+		return isJSON
+	}
+
+	isJSON = mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+	return isJSON
+}
+
+// bufferRequestBody reads req's raw body into one of buffers and returns a
+// copy of req that replays it unchanged, as often as needed. The returned body
+// is valid until buffers is released. Bodiless requests return req and a nil
+// body.
+func bufferRequestBody(req *http.Request, buffers *requestBuffers) (out *http.Request, body []byte, err error) {
+	out = req
+	if req.Body == nil || req.Body == http.NoBody {
+		return out, body, err
+	}
+
+	var buffered *bufferedBody
+	buffered, err = buffers.read(req.Body, maxRequestTransformBytes+1)
+	if err != nil {
+		err = fmt.Errorf("failed to read request body: %w", err)
+		return out, body, err
+	}
+
+	body = buffered.bytes()
+	if len(body) > maxRequestTransformBytes {
+		err = errRequestBodyTooLarge
+		return out, body, err
+	}
+
+	// The original body is spent; closing it lets an earlier buffer go back
+	// to the pool
+	_ = req.Body.Close()
+
+	out = req.Clone(req.Context())
+	out.Body = buffered.reader()
+	out.GetBody = func() (replay io.ReadCloser, err error) {
+		replay = buffered.reader()
+		return replay, err
+	}
+	out.ContentLength = int64(len(body))
+	out.TransferEncoding = nil
+	out.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	return out, body, err
+}
+
+// transformRequestBody buffers a JSON request body, applies transform, and
+// returns a copy of req carrying the result with Content-Length adjusted.
+// Encoded bodies are decoded first and forwarded as plaintext. Non-JSON bodies,
+// bodiless requests, and unsupported encodings return req unchanged.
+func transformRequestBody(req *http.Request, transform BodyTransform) (out *http.Request, err error) {
+	out = req
+	if req.Body == nil || req.Body == http.NoBody || !isJSONContentType(req.Header.Get("Content-Type")) {
+		return out, err
+	}
+
+	var reader io.Reader
+	var supported bool
+	reader, supported, err = decodingReader(req.Body, req.Header.Get("Content-Encoding"))
+	if err != nil {
+		err = fmt.Errorf("failed to decode %s request body: %w", req.Header.Get("Content-Encoding"), err)
+		return out, err
+	}
+
+	if !supported {
+		return out, err
+	}
+
+	var body []byte
+	body, err = io.ReadAll(io.LimitReader(reader, maxRequestTransformBytes+1))
+	if err != nil {
+		err = fmt.Errorf("failed to read request body: %w", err)
+		return out, err
+	}
+
+	if len(body) > maxRequestTransformBytes {
+		err = errRequestBodyTooLarge
+		return out, err
+	}
+
+	body, err = transform(body)
+	if err != nil {
+		err = fmt.Errorf("request body transform failed: %w", err)
+		return out, err
+	}
+
+	out = req.Clone(req.Context())
+	out.Body = io.NopCloser(bytes.NewReader(body))
+	out.GetBody = func() (replay io.ReadCloser, err error) {
+		replay = io.NopCloser(bytes.NewReader(body))
+		return replay, err
+	}
+	out.ContentLength = int64(len(body))
+	out.TransferEncoding = nil
+	out.Header.Del("Content-Encoding")
+	out.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	return out, err
+}
+
+// decodingReader returns a reader that decompresses body according to the
+// Content-Encoding value. Supported encodings are gzip, deflate, and br;
+// supported is false for any other encoding (including stacked encodings),
+// in which case the body must be left untouched.
+func decodingReader(body io.Reader, contentEncoding string) (reader io.Reader, supported bool, err error) {
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "", "identity":
+		reader = body
+	case "gzip", "x-gzip":
+		reader, err = gzip.NewReader(body)
+	case "deflate":
+		reader = newDeflateReader(body)
+	case "br":
+		reader = brotli.NewReader(body)
+	default:
+		return reader, supported, err
+	}
+
+	supported = true
+	return reader, supported, err
+}
+
+// newDeflateReader decodes the "deflate" content coding. RFC 9110 defines it
+// as zlib-wrapped, but some servers send raw DEFLATE, so the zlib header is
+// checked before choosing a decoder.
+func newDeflateReader(body io.Reader) (reader io.Reader) {
+	buffered := bufio.NewReader(body)
+
+	header, _ := buffered.Peek(2)
+	if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		var err error
+		reader, err = zlib.NewReader(buffered)
+		if err == nil {
+			return reader
+		}
+	}
+
+	reader = flate.NewReader(buffered)
+	return reader
+}
+
+// responseHasBody reports whether a response can carry a body at all.
+func responseHasBody(resp *http.Response) (hasBody bool) {
+	hasBody = resp.Request.Method != http.MethodHead &&
+		resp.StatusCode >= http.StatusOK &&
+		resp.StatusCode != http.StatusNoContent &&
+		resp.StatusCode != http.StatusNotModified
+	return hasBody
+}
+
+// shouldCompressResponse reports whether resp is eligible for compression: the
+// client accepts gzip, the body is unencoded and complete, transformation is
+// allowed, and the media type is in contentTypes.
+func shouldCompressResponse(resp *http.Response, contentTypes []string) (compress bool) {
+	if !responseHasBody(resp) || resp.StatusCode == http.StatusPartialContent {
+		return compress
+	}
+
+	if !acceptsGzip(resp.Request.Header.Values("Accept-Encoding")) {
+		return compress
+	}
+
+	encoding := strings.TrimSpace(resp.Header.Get("Content-Encoding"))
+	if encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return compress
+	}
+
+	for _, directive := range strings.Split(resp.Header.Get("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-transform") {
+			return compress
+		}
+	}
+
+	var mediaType string
+	var err error
+	mediaType, _, err = mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return compress
+	}
+
+	for _, allowed := range contentTypes {
+		allowed = strings.ToLower(allowed)
+		if mediaType == allowed || (strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(allowed, "*"))) {
+			compress = true
+			return compress
+		}
+	}
+
+	return compress
+}
+
+// acceptsGzip reports whether Accept-Encoding values allow a gzip response.
+func acceptsGzip(acceptEncoding []string) (accepts bool) {
+	for _, value := range acceptEncoding {
+		for _, part := range strings.Split(value, ",") {
+			coding, params, _ := strings.Cut(part, ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "gzip" && coding != "*" {
+				continue
+			}
+
+			// A q-value of zero means "not acceptable"
+			name, qvalue, found := strings.Cut(strings.TrimSpace(params), "=")
+			if found && strings.EqualFold(strings.TrimSpace(name), "q") {
+				var q float64
+				var err error
+				q, err = strconv.ParseFloat(strings.TrimSpace(qvalue), 64)
+				if err == nil && q == 0 {
+					continue
+				}
+			}
+
+			accepts = true
+			return accepts
+		}
+	}
+	return accepts
+}
+
+// compressResponseBody gzips the response body if it is at least minSize
+// bytes, streaming the compressed output. A body of unknown length is read up
+// to minSize to decide. compressed reports whether the body was replaced.
+func compressResponseBody(resp *http.Response, minSize int) (compressed bool, err error) {
+	if resp.ContentLength >= 0 && resp.ContentLength < int64(minSize) {
+		return compressed, err
+	}
+
+	body := resp.Body
+	if resp.ContentLength < 0 {
+		prefix := make([]byte, minSize)
+		var n int
+		n, err = io.ReadFull(resp.Body, prefix)
+		restored := &multiReadCloser{Reader: io.MultiReader(bytes.NewReader(prefix[:n]), resp.Body), Closer: resp.Body}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// The whole body is smaller than minSize
+			resp.Body = restored
+			err = nil
+			return compressed, err
+		}
+		if err != nil {
+			_ = resp.Body.Close()
+			err = fmt.Errorf("failed to read response body: %w", err)
+			return compressed, err
+		}
+		body = restored
+	}
+
+	resp.Body = gzipReadCloser(body)
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.Header.Add("Vary", "Accept-Encoding")
+
+	// The compressed body is a different representation, so a strong
+	// validator no longer identifies it
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+
+	compressed = true
+	return compressed, err
+}
+
+// multiReadCloser reads from Reader and closes Closer.
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// closeAll closes each of its closers in turn, returning the first error.
+type closeAll []io.Closer
+
+// Close closes every closer.
+func (c closeAll) Close() (err error) {
+	for _, closer := range c {
+		var closeErr error
+		closeErr = closer.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// gzipReadCloser returns a reader of the gzip-compressed contents of body.
+// Closing it stops compression and closes body.
+func gzipReadCloser(body io.ReadCloser) (compressed io.ReadCloser) {
+	reader, writer := io.Pipe()
+
+	go func() {
+		gz := gzip.NewWriter(writer)
+
+		var err error
+		_, err = io.Copy(gz, body)
+		if err == nil {
+			err = gz.Close()
+		}
+		_ = body.Close()
+		_ = writer.CloseWithError(err)
+	}()
+
+	compressed = reader
+	return compressed
+}
+
+// transformResponseBody decodes the response body, applies transform, and
+// re-emits the result as plaintext with Content-Encoding removed and
+// Content-Length adjusted. Trailers declared by the upstream are kept, having
+// been read along with the body. Responses with an unsupported encoding are left
+// untouched; transformed reports whether the body was rewritten. A decoded body
+// over maxResponseTransformBytes fails with errResponseBodyTooLarge.
+func transformResponseBody(resp *http.Response, transform BodyTransform) (transformed bool, err error) {
+	var reader io.Reader
+	var supported bool
+	reader, supported, err = decodingReader(resp.Body, resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		err = fmt.Errorf("failed to decode %s response body: %w", resp.Header.Get("Content-Encoding"), err)
+		return transformed, err
+	}
+
+	if !supported {
+		return transformed, err
+	}
+
+	var body []byte
+	body, err = io.ReadAll(io.LimitReader(reader, maxResponseTransformBytes+1))
+	_ = resp.Body.Close()
+	if err != nil {
+		err = fmt.Errorf("failed to read response body: %w", err)
+		return transformed, err
+	}
+
+	if len(body) > maxResponseTransformBytes {
+		err = errResponseBodyTooLarge
+		return transformed, err
+	}
+
+	body, err = transform(body)
+	if err != nil {
+		err = fmt.Errorf("response body transform failed: %w", err)
+		return transformed, err
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.Header.Del("Content-Encoding")
+
+	// Trailers can only follow a chunked body, so a response declaring them
+	// is left without a Content-Length
+	if len(resp.Trailer) > 0 {
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+	} else {
+		resp.ContentLength = int64(len(body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	transformed = true
+	return transformed, err
+}
+
+// stallTimeoutBody wraps an upstream response body and closes it when a single
+// Read blocks for longer than timeout. The timer only runs during a Read, so
+// time spent writing to a slow client does not count against the upstream.
+type stallTimeoutBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	stalled atomic.Bool
+}
+
+// newStallTimeoutBody wraps body, calling onStall before closing it when a
+// read stalls.
+func newStallTimeoutBody(body io.ReadCloser, timeout time.Duration, onStall func()) (wrapped *stallTimeoutBody) {
+	wrapped = &stallTimeoutBody{
+		ReadCloser: body,
+		timeout:    timeout,
+	}
+	wrapped.timer = time.AfterFunc(timeout, func() {
+		wrapped.stalled.Store(true)
+		onStall()
+		_ = body.Close()
+	})
+	wrapped.timer.Stop()
+	return wrapped
+}
+
+// Read reads from the wrapped body, failing with errBodyReadTimeout once a
+// read has stalled for longer than the timeout.
+func (b *stallTimeoutBody) Read(data []byte) (n int, err error) {
+	if b.stalled.Load() {
+		err = errBodyReadTimeout
+		return n, err
+	}
+
+	b.timer.Reset(b.timeout)
+	n, err = b.ReadCloser.Read(data)
+	if !b.timer.Stop() {
+		// The timer fired and closed the body during this read
+		b.stalled.Store(true)
+		err = errBodyReadTimeout
+	}
+	return n, err
+}
+
+// Close stops the stall timer and closes the wrapped body.
+func (b *stallTimeoutBody) Close() (err error) {
+	b.timer.Stop()
+	err = b.ReadCloser.Close()
+	return err
+}
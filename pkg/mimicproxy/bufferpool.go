@@ -0,0 +1,161 @@
+package mimicproxy
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBodyBufferMaxBytes is the BodyBufferMaxBytes used when none is set.
+const DefaultBodyBufferMaxBytes = 1 << 20
+
+// bodyBufferPool recycles the buffers request bodies are read into for
+// replays, HMAC, schema validation, and mirroring. Buffers that grew past
+// maxBytes are left to the garbage collector rather than pooled, so one large
+// body does not pin its allocation for the life of the proxy. A nil pool
+// allocates a fresh buffer every time.
+type bodyBufferPool struct {
+	pool     sync.Pool
+	maxBytes int
+}
+
+// newBodyBufferPool creates a pool keeping buffers of up to maxBytes.
+func newBodyBufferPool(maxBytes int) (pool *bodyBufferPool) {
+	if maxBytes == 0 {
+		maxBytes = DefaultBodyBufferMaxBytes
+	}
+
+	pool = &bodyBufferPool{maxBytes: maxBytes}
+	pool.pool.New = func() (buf any) {
+		buf = new(bytes.Buffer)
+		return buf
+	}
+	return pool
+}
+
+// get returns an empty buffer.
+func (p *bodyBufferPool) get() (buf *bytes.Buffer) {
+	if p == nil {
+		buf = new(bytes.Buffer)
+		return buf
+	}
+
+	buf, _ = p.pool.Get().(*bytes.Buffer)
+	return buf
+}
+
+// put returns buf to the pool unless it is larger than the pool keeps.
+func (p *bodyBufferPool) put(buf *bytes.Buffer) {
+	if p == nil || buf.Cap() > p.maxBytes {
+		return
+	}
+
+	buf.Reset()
+	p.pool.Put(buf)
+}
+
+// read reads up to limit bytes of reader into a buffer from the pool. The
+// body is returned even on error, and must be released by the caller.
+func (p *bodyBufferPool) read(reader io.Reader, limit int64) (body *bufferedBody, err error) {
+	body = &bufferedBody{pool: p, buf: p.get()}
+	body.refs.Store(1)
+
+	_, err = body.buf.ReadFrom(io.LimitReader(reader, limit))
+	return body, err
+}
+
+// bufferedBody is a body read into a pooled buffer. Every reader handed out
+// holds a reference, as does the owner until it calls release; the buffer
+// goes back to the pool once all of them are dropped. A reader that is never
+// closed leaves the buffer to the garbage collector instead.
+type bufferedBody struct {
+	pool *bodyBufferPool
+	buf  *bytes.Buffer
+	refs atomic.Int32
+}
+
+// bytes returns the buffered data, valid until the body is released.
+func (b *bufferedBody) bytes() (data []byte) {
+	data = b.buf.Bytes()
+	return data
+}
+
+// reader returns a reader of the buffered data holding its own reference,
+// dropped when the reader is closed.
+func (b *bufferedBody) reader() (reader io.ReadCloser) {
+	b.refs.Add(1)
+	reader = &bufferedBodyReader{reader: bytes.NewReader(b.buf.Bytes()), body: b}
+	return reader
+}
+
+// retain adds a reference for an owner that outlives the request, such as a
+// mirror request sent in the background.
+func (b *bufferedBody) retain() {
+	b.refs.Add(1)
+}
+
+// release drops a reference, returning the buffer to the pool with the last.
+func (b *bufferedBody) release() {
+	if b.refs.Add(-1) == 0 {
+		b.pool.put(b.buf)
+	}
+}
+
+// bufferedBodyReader reads a bufferedBody. Once closed it reads nothing, so a
+// transport closing the body while another goroutine reads it never sees a
+// recycled buffer.
+type bufferedBodyReader struct {
+	mu     sync.Mutex
+	reader *bytes.Reader
+	body   *bufferedBody
+}
+
+// Read reads from the buffered data.
+func (r *bufferedBodyReader) Read(p []byte) (n int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.body == nil {
+		err = io.EOF
+		return n, err
+	}
+
+	n, err = r.reader.Read(p)
+	return n, err
+}
+
+// Close drops the reader's reference to the body.
+func (r *bufferedBodyReader) Close() (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.body != nil {
+		r.body.release()
+		r.body = nil
+		r.reader = nil
+	}
+	return err
+}
+
+// requestBuffers holds the owner's reference to every body buffered while
+// handling one request, released when the proxy is done with the request.
+type requestBuffers struct {
+	pool   *bodyBufferPool
+	bodies []*bufferedBody
+}
+
+// read buffers up to limit bytes of reader for the rest of the request.
+func (b *requestBuffers) read(reader io.Reader, limit int64) (body *bufferedBody, err error) {
+	body, err = b.pool.read(reader, limit)
+	b.bodies = append(b.bodies, body)
+	return body, err
+}
+
+// release drops the request's references to its buffered bodies.
+func (b *requestBuffers) release() {
+	for _, body := range b.bodies {
+		body.release()
+	}
+	b.bodies = nil
+}
@@ -0,0 +1,74 @@
+package mimicproxy
+
+import (
+	"hash/fnv"
+	"net/http"
+	"net/url"
+)
+
+// Values of the variant label of canary_requests_total.
+const (
+	// CanaryVariantCanary counts requests sent to the canary upstream.
+	CanaryVariantCanary = "canary"
+	// CanaryVariantStable counts requests sent to the route's own upstreams.
+	CanaryVariantStable = "stable"
+)
+
+// canaryBuckets is how many buckets requests are hashed into, giving
+// Percentage a resolution of 0.01.
+const canaryBuckets = 10000
+
+// canary sends a share of a route's requests to its canary upstream.
+type canary struct {
+	config   *CanaryConfig
+	upstream *url.URL
+}
+
+// newCanary creates the canary selection for a route's Canary settings.
+func newCanary(config *CanaryConfig) (c *canary, err error) {
+	var upstreamURL *url.URL
+	upstreamURL, err = url.Parse(config.Upstream)
+	if err != nil {
+		return c, err
+	}
+
+	c = &canary{config: config, upstream: upstreamURL}
+	return c, err
+}
+
+// selects reports whether req goes to the canary: always when it carries
+// MatchHeader, otherwise when its sticky key hashes into the first Percentage
+// of buckets, so a client keeps landing on the same side. clientIP is the
+// request's client as resolved through the trusted proxies.
+func (c *canary) selects(req *http.Request, clientIP string) (selected bool) {
+	if c.config.MatchHeader != "" && len(req.Header.Values(c.config.MatchHeader)) > 0 {
+		selected = true
+		return selected
+	}
+
+	if c.config.Percentage <= 0 {
+		return selected
+	}
+
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(canaryKey(req, c.config.StickyCookie, clientIP)))
+	selected = hash.Sum64()%canaryBuckets < uint64(c.config.Percentage*canaryBuckets/100)
+	return selected
+}
+
+// canaryKey returns what a request's canary selection is hashed from: the
+// value of the sticky cookie if the request has one, or else clientIP.
+func canaryKey(req *http.Request, stickyCookie string, clientIP string) (key string) {
+	if stickyCookie != "" {
+		var cookie *http.Cookie
+		var err error
+		cookie, err = req.Cookie(stickyCookie)
+		if err == nil && cookie.Value != "" {
+			key = "cookie:" + cookie.Value
+			return key
+		}
+	}
+
+	key = clientIP
+	return key
+}
@@ -0,0 +1,110 @@
+package mimicproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// certificateHolder holds the downstream TLS certificate. Handshakes read it
+// through GetCertificate, so a reloaded certificate is swapped in without
+// restarting the listener.
+type certificateHolder struct {
+	certificate atomic.Pointer[tls.Certificate]
+
+	// mu is held while the certificate files are checked or loaded
+	mu sync.Mutex
+
+	// modTime is the latest modification time of the loaded files
+	modTime time.Time
+
+	// checkedAt is when the files were last checked for changes
+	checkedAt time.Time
+}
+
+// ReloadTLSCertificate re-reads TLS.CertFile and TLS.KeyFile and serves the
+// new keypair on subsequent handshakes of servers built with ServerTLS. On
+// failure the current certificate stays in use.
+func (p *Proxy) ReloadTLSCertificate() (err error) {
+	if p.config.TLS.CertFile == "" || p.config.TLS.KeyFile == "" {
+		err = errors.New("TLS cert_file and key_file are required")
+		return err
+	}
+
+	p.certificate.mu.Lock()
+	defer p.certificate.mu.Unlock()
+
+	err = p.loadCertificate()
+	return err
+}
+
+// loadCertificate loads the keypair from the configured files. The caller
+// must hold p.certificate.mu.
+func (p *Proxy) loadCertificate() (err error) {
+	holder := &p.certificate
+	modTime := certificateModTime(&p.config.TLS)
+
+	var certificate tls.Certificate
+	certificate, err = tls.LoadX509KeyPair(p.config.TLS.CertFile, p.config.TLS.KeyFile)
+	if err != nil {
+		err = fmt.Errorf("failed to load TLS certificate: %w", err)
+		return err
+	}
+
+	holder.certificate.Store(&certificate)
+	holder.modTime = modTime
+	holder.checkedAt = time.Now()
+
+	p.logger.Info("Loaded TLS certificate",
+		"cert_file", p.config.TLS.CertFile)
+	return err
+}
+
+// getCertificate serves the current certificate to a TLS handshake. With a
+// CertReloadInterval, it first reloads the certificate if its files changed
+// since they were last checked; a handshake that finds another one checking
+// uses the current certificate rather than waiting.
+func (p *Proxy) getCertificate(_ *tls.ClientHelloInfo) (certificate *tls.Certificate, err error) {
+	holder := &p.certificate
+	interval := p.config.TLS.CertReloadInterval
+
+	if interval > 0 && holder.mu.TryLock() {
+		if time.Since(holder.checkedAt) >= interval {
+			holder.checkedAt = time.Now()
+			if certificateModTime(&p.config.TLS).After(holder.modTime) {
+				err = p.loadCertificate()
+				if err != nil {
+					p.logger.Warn("Keeping current TLS certificate",
+						"cert_file", p.config.TLS.CertFile,
+						"error", err)
+					err = nil
+				}
+			}
+		}
+		holder.mu.Unlock()
+	}
+
+	certificate = holder.certificate.Load()
+	if certificate == nil {
+		err = errors.New("no TLS certificate loaded")
+	}
+	return certificate, err
+}
+
+// certificateModTime returns the latest modification time of the certificate
+// and key files, or the zero time if neither can be read.
+func certificateModTime(config *TLSConfig) (modTime time.Time) {
+	for _, path := range []string{config.CertFile, config.KeyFile} {
+		var info os.FileInfo
+		var err error
+		info, err = os.Stat(path)
+		if err == nil && info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return modTime
+}
@@ -3,8 +3,12 @@ package mimicproxy
 import (
 	"errors"
 	"fmt"
+	"maps"
+	"net/http"
 	"net/url"
 	"os"
+	"regexp"
+	"slices"
 	"strings"
 	"time"
 )
@@ -14,6 +18,94 @@ const (
 	SchemeHTTP = "http"
 	// SchemeHTTPS is the HTTPS URL scheme.
 	SchemeHTTPS = "https"
+	// SchemeUnix is the URL scheme for upstreams listening on a Unix domain socket.
+	SchemeUnix = "unix"
+)
+
+// DefaultViaPseudonym is the pseudonym announced in Via headers when none is configured.
+const DefaultViaPseudonym = "mimic-proxy"
+
+// DefaultCompressMinSize is the smallest response body, in bytes, that
+// CompressResponses compresses when no CompressMinSize is configured.
+const DefaultCompressMinSize = 1024
+
+const (
+	// ProtocolHTTP is the default route protocol for plain request/response traffic.
+	ProtocolHTTP = "http"
+	// ProtocolWebSocket marks a route carrying WebSocket (HTTP Upgrade) traffic.
+	ProtocolWebSocket = "websocket"
+	// ProtocolGRPC marks a route carrying gRPC traffic.
+	ProtocolGRPC = "grpc"
+)
+
+const (
+	// TrailingSlashPreserve forwards the path's trailing slash as received.
+	TrailingSlashPreserve = "preserve"
+	// TrailingSlashStrip removes a trailing slash from the upstream path.
+	TrailingSlashStrip = "strip"
+	// TrailingSlashAdd ensures the upstream path ends with a slash.
+	TrailingSlashAdd = "add"
+)
+
+const (
+	// BalancerRoundRobin cycles through a route's upstreams in order.
+	BalancerRoundRobin = "round_robin"
+	// BalancerRandom picks an upstream at random.
+	BalancerRandom = "random"
+	// BalancerLeastConn picks the upstream with the fewest requests in flight.
+	BalancerLeastConn = "least_conn"
+	// BalancerConsistentHash pins each client IP to one upstream.
+	BalancerConsistentHash = "consistent_hash"
+)
+
+const (
+	// ClientAuthNone does not request client certificates.
+	ClientAuthNone = "none"
+	// ClientAuthVerifyIfGiven verifies client certificates that are presented.
+	ClientAuthVerifyIfGiven = "verify_if_given"
+	// ClientAuthRequireAndVerify rejects clients without a verified certificate.
+	ClientAuthRequireAndVerify = "require_and_verify"
+)
+
+const (
+	// AuthStrategyReplace sets the route's upstream credentials on every
+	// request, replacing any Authorization sent by the client.
+	AuthStrategyReplace = "replace"
+	// AuthStrategyPassthrough forwards the client's Authorization (or its
+	// absence) untouched and never adds upstream credentials.
+	AuthStrategyPassthrough = "passthrough"
+	// AuthStrategyInjectIfAbsent forwards the client's Authorization when
+	// present and adds the route's upstream credentials otherwise.
+	AuthStrategyInjectIfAbsent = "inject_if_absent"
+)
+
+const (
+	// ForwardedHeadersStrip removes Forwarded and X-Forwarded-* headers so the
+	// upstream cannot tell the request was proxied.
+	ForwardedHeadersStrip = "strip"
+	// ForwardedHeadersStandard appends the proxy's hop to the Forwarded and
+	// X-Forwarded-* headers.
+	ForwardedHeadersStandard = "standard"
+)
+
+// UserAgentPreserve is the UpstreamUserAgent value that forwards the client's
+// User-Agent exactly, including its absence.
+const UserAgentPreserve = "preserve"
+
+const (
+	// HeaderLimitReject rejects requests whose forwarded headers exceed
+	// MaxUpstreamHeaderBytes with 431.
+	HeaderLimitReject = "reject"
+	// HeaderLimitTrim drops the headers in UpstreamHeaderTrimOrder until the
+	// forwarded headers fit in MaxUpstreamHeaderBytes.
+	HeaderLimitTrim = "trim"
+)
+
+const (
+	// HMACAlgorithmSHA256 signs with HMAC-SHA256.
+	HMACAlgorithmSHA256 = "sha256"
+	// HMACAlgorithmSHA512 signs with HMAC-SHA512.
+	HMACAlgorithmSHA512 = "sha512"
 )
 
 // Config represents the complete proxy configuration.
@@ -30,8 +122,108 @@ type Config struct {
 	// Metrics configuration
 	Metrics MetricsConfig
 
+	// BuildInfo describes the program embedding the proxy, reported by the
+	// build_info metric
+	BuildInfo BuildInfo
+
 	// Logger configuration
 	Logger LoggerConfig
+
+	// Admin configures the runtime admin API served by Proxy.AdminHandler
+	Admin AdminConfig
+
+	// MaxHeaderBytes limits the total size of request header fields. Larger
+	// requests are rejected with 431 before reaching the upstream. It also sets
+	// http.Server.MaxHeaderBytes for servers built with Proxy.Server. Zero
+	// means the Go server default (1 MB) and no check in ServeHTTP.
+	MaxHeaderBytes int
+
+	// RetryBudget caps upstream retries (such as retries after an HTTP/2
+	// GOAWAY) as a ratio of original upstream requests across all routes,
+	// e.g. 0.1 allows one retry per ten requests. Unused allowance is banked
+	// up to 10 retries. When the budget is exhausted the original failure is
+	// returned. Zero means retries are not limited.
+	RetryBudget float64
+
+	// BodyBufferMaxBytes caps the size of the buffers kept for reuse when
+	// request bodies are buffered (for VerifyHMAC, SignRequests,
+	// RequestSchema, mirroring, and replays on retry). Larger buffers are
+	// discarded after use rather than pooled, so an occasional huge body is
+	// not retained. Default: 1 MB
+	BodyBufferMaxBytes int
+
+	// MaxRedirectRewrites caps how many redirects in a row a client is sent
+	// through the proxy by RewriteRedirects, guarding against routes whose
+	// upstreams redirect to each other. A redirect reached by following that
+	// many rewritten redirects within 30 seconds is passed through with its
+	// Location unrewritten and a warning is logged. Default: 10
+	MaxRedirectRewrites int
+
+	// GlobalRateLimit caps the rate of requests forwarded upstream across all
+	// routes, e.g. to stay within an upstream plan's quota. Requests over the
+	// limit get 429 Too Many Requests with Retry-After and never reach the
+	// upstream. Nil means no limit.
+	GlobalRateLimit *RateLimitConfig
+
+	// AllowConnect enables forward-proxy mode: CONNECT requests open a TCP
+	// tunnel to the requested host:port instead of being matched against
+	// routes. Only hosts in ConnectAllowedHosts may be reached; others get
+	// 403. Tunnels are HTTP/1.x only and carry bytes unmodified.
+	AllowConnect bool
+
+	// ConnectAllowedHosts lists the CONNECT targets allowed in forward-proxy
+	// mode: "host:port", "host" for any port, or "*.example.com" for any
+	// subdomain. Required when AllowConnect is set
+	ConnectAllowedHosts []string
+
+	// StrictRouteValidation turns warnings about risky route configuration,
+	// such as strip patterns matching essential headers, into validation
+	// errors.
+	StrictRouteValidation bool
+
+	// TrustedProxies lists the IP addresses or CIDR prefixes of proxies in
+	// front of this one. Routes in "standard" ForwardedHeaders mode keep the
+	// forwarded headers of requests from these peers and discard those of
+	// any other client. Canary selection and the consistent_hash balancer
+	// take the client IP from the X-Forwarded-For entries these peers
+	// appended, rather than from the peer itself.
+	TrustedProxies []string
+
+	// ForbiddenHeaderValues lists placeholder values, such as "changeme",
+	// that added and appended header values may not resolve to once
+	// environment variables and @file: references are expanded. Any
+	// whitespace-separated word of the value matching one, ignoring case,
+	// fails validation, as does a value still containing a ${...} reference.
+	// Default: DefaultForbiddenHeaderValues. An empty, non-nil list disables
+	// the placeholder check.
+	ForbiddenHeaderValues []string
+
+	// ErrorResponseTemplate is a text/template rendering the JSON body of the
+	// error responses the proxy generates itself: no matching route, rate
+	// limiting, rejected requests, and failed upstream requests. It is
+	// executed with an ErrorResponse, and a json function quotes values,
+	// e.g. {"error":{"code":{{.Status}},"message":{{json .Message}}}}.
+	// Responses carry Content-Type: application/json. Empty keeps the
+	// plain-text bodies.
+	ErrorResponseTemplate string
+}
+
+// DefaultForbiddenHeaderValues are the placeholder values rejected when
+// Config.ForbiddenHeaderValues is nil.
+//
+//nolint:gochecknoglobals // Exported so callers can extend the defaults.
+var DefaultForbiddenHeaderValues = []string{
+	"changeme",
+	"change-me",
+	"change_me",
+	"replaceme",
+	"replace-me",
+	"placeholder",
+	"todo",
+	"fixme",
+	"xxx",
+	"your-api-key",
+	"your_api_key",
 }
 
 // RouteConfig defines a single route from client path to upstream.
@@ -42,37 +234,498 @@ type RouteConfig struct {
 	// PathPrefix is the incoming request path prefix to match (e.g., "/v1/verify")
 	PathPrefix string
 
+	// Priority orders route matching: routes with a higher Priority are tried
+	// first, then longer PathPrefixes, then routes in the order they are
+	// defined. The first route whose PathPrefix matches handles the request.
+	// Default: 0
+	Priority int
+
 	// Upstream is the target server (e.g., "https://api.aiprise.com")
+	// A path in an http or https upstream is a base path prefixed to every
+	// forwarded path after PathPrefix rewriting: with Upstream
+	// "https://api.aiprise.com/base", "/v1/x" is forwarded as "/base/v1/x".
+	// A Unix domain socket upstream is given as "unix:///var/run/app.sock";
+	// requests are sent over it as plain HTTP with Host "localhost" (or the
+	// incoming Host with PreserveHost).
 	Upstream string
 
+	// Upstreams spreads requests across several equivalent upstreams using
+	// Balancer. Upstream defaults to the first entry and remains the one
+	// redirects and Referer headers are rewritten against. Each entry's path,
+	// if any, is its base path, as with Upstream.
+	Upstreams []string
+
+	// Balancer selects among Upstreams: "round_robin" (default), "random",
+	// "least_conn", or "consistent_hash". Overridden by the WithBalancer option.
+	Balancer string
+
+	// CaseInsensitivePath matches PathPrefix regardless of case, so "/API/test"
+	// matches "/api". The path is forwarded upstream with its original casing.
+	CaseInsensitivePath bool
+
+	// CollapseSlashes collapses runs of slashes in the incoming path, so
+	// "/v1//verify" matches and is forwarded as "/v1/verify". Encoded slashes
+	// (%2F) are data and are left alone, as is the query string.
+	CollapseSlashes bool
+
 	// UpstreamPathPrefix is the path prefix to use on the upstream server
 	// If empty, uses PathPrefix. If set, rewrites the path.
 	// Example: PathPrefix="/v1/verify", UpstreamPathPrefix="/api/v1/verify"
 	UpstreamPathPrefix string
 
+	// StripPathPrefix removes PathPrefix from the path before forwarding, so
+	// "/v1/verify/foo" reaches the upstream as "/foo" and "/v1/verify" as "/".
+	// UpstreamPathPrefix, if set, is prepended to the stripped path.
+	StripPathPrefix bool
+
+	// TrailingSlash normalizes the trailing slash of the upstream path after any
+	// prefix rewriting: "preserve" (default), "strip", or "add". Matching against
+	// PathPrefix uses the incoming path, so PathPrefix "/v1/verify" matches both
+	// "/v1/verify" and "/v1/verify/", and the upstream sees whichever form this
+	// mode produces. The root path "/" is never stripped.
+	TrailingSlash string
+
+	// RequestRewrite copies or moves values between headers, query
+	// parameters, and path segments, applied in order after path rewriting
+	// Example: []RequestRewriteRule{{Target: "header.Authorization",
+	// Value: "Bearer ${query.token}", Move: true}}
+	RequestRewrite []RequestRewriteRule
+
 	// PreserveHost controls whether to preserve the incoming Host header
 	// or replace it with the upstream host. Default: false (replace)
+	// The TLS server name (SNI) sent to an https upstream is still the
+	// upstream's host unless SNIFromHost is set.
 	PreserveHost bool
 
+	// SNIFromHost sends the preserved Host (without its port) as the TLS
+	// server name to https upstreams and verifies the upstream's certificate
+	// against it, for upstreams that pick a certificate or backend by SNI.
+	// Requires PreserveHost. Default: false (SNI is the upstream's host)
+	SNIFromHost bool
+
+	// UpstreamBasicAuth sets HTTP Basic credentials on forwarded requests,
+	// replacing any Authorization header sent by the client. Environment
+	// variables are expanded when the route is created, which fails if the
+	// username or password resolves to empty
+	UpstreamBasicAuth *BasicAuthConfig
+
+	// OAuth2 obtains a bearer token with the client-credentials grant and sets
+	// it as the Authorization header on forwarded requests
+	OAuth2 *OAuth2Config
+
+	// AuthStrategy decides between the client's Authorization header and the
+	// route's upstream credentials (UpstreamBasicAuth, OAuth2, or an
+	// Authorization set by Headers): "replace" (default), "passthrough", or
+	// "inject_if_absent". The client's header is kept as received whatever
+	// the header rules say when the strategy forwards it.
+	AuthStrategy string
+
+	// ForwardedHeaders controls the Forwarded and X-Forwarded-* headers sent
+	// upstream: "strip" (default) removes them for transparency; "standard"
+	// appends an RFC 7239 Forwarded element and the client IP, scheme, and
+	// host to the X-Forwarded-* chain. "standard" cannot be combined with
+	// StripIncoming patterns matching those headers.
+	ForwardedHeaders string
+
+	// UpstreamUserAgent sets the User-Agent forwarded to the upstream,
+	// overriding the client's and any header rules. Supports ${ENV_VAR}
+	// expansion. UserAgentPreserve ("preserve") forwards the client's exactly,
+	// sending none when the client sent none.
+	UpstreamUserAgent string
+
+	// PreserveClientAuth keeps the client's Authorization header when present
+	// instead of replacing it with UpstreamBasicAuth or OAuth2 credentials.
+	//
+	// Deprecated: use AuthStrategy "inject_if_absent", which it implies.
+	PreserveClientAuth bool
+
+	// PreserveHeaderCasingAndOrder writes response headers to HTTP/1.x clients
+	// in the order and casing the upstream sent them, instead of Go's
+	// canonicalized form. HTTP/2 clients are unaffected. It has costs:
+	//   - Upstream requests never reuse a connection (no keep-alive) and use
+	//     HTTP/1.1 even if the upstream speaks HTTP/2.
+	//   - Client connections get "Connection: close" and are closed after each
+	//     response, so clients pay a new connection per request.
+	//   - Upstream trailers are dropped.
+	//   - Forward proxies are bypassed, so it cannot be combined with
+	//     EgressProxyURL or Transport.UpstreamProxyURL, and HTTP_PROXY and
+	//     HTTPS_PROXY are ignored.
+	PreserveHeaderCasingAndOrder bool
+
 	// Headers defines header manipulation rules
 	Headers HeaderConfig
 
-	// Timeout for requests to this upstream
+	// MaxUpstreamHeaderBytes limits the size of the header fields forwarded
+	// to the upstream, measured after header manipulation and X-Forwarded-For
+	// handling. What happens to larger requests is set by
+	// UpstreamHeaderLimitPolicy. Zero means no limit.
+	MaxUpstreamHeaderBytes int
+
+	// UpstreamHeaderLimitPolicy is "reject" (default), which answers 431
+	// Request Header Fields Too Large, or "trim", which drops headers in
+	// UpstreamHeaderTrimOrder until the rest fit and answers 431 only if
+	// they still don't.
+	UpstreamHeaderLimitPolicy string
+
+	// UpstreamHeaderTrimOrder lists the header patterns (wildcards allowed)
+	// "trim" drops, least important first (default: Forwarded, X-Forwarded-*,
+	// Via)
+	UpstreamHeaderTrimOrder []string
+
+	// RequestTimeout bounds the whole upstream exchange, from sending the
+	// request to reading the last byte of the response body. Defaults to
+	// Timeout, and otherwise to zero: no total deadline. It is
+	// never applied to Streaming, WebSocket, or gRPC routes or to upgraded
+	// connections. The wait for response headers alone is bounded separately
+	// by Transport.ResponseHeaderTimeout.
+	RequestTimeout time.Duration
+
+	// Streaming marks a route carrying long-lived responses such as Server-Sent
+	// Events: RequestTimeout is not applied and response data is flushed to the
+	// client as soon as it arrives
+	Streaming bool
+
+	// BodyReadTimeout aborts the response when a single read of the upstream
+	// response body blocks for longer than this, so a stalled or trickling
+	// upstream cannot hold the connection open. ResponseHeaderTimeout only
+	// covers the headers. Streaming routes are exempt. Zero disables the limit.
+	BodyReadTimeout time.Duration
+
+	// Timeout for requests to this upstream.
+	//
+	// Deprecated: use RequestTimeout. Timeout is used as the RequestTimeout of
+	// routes that do not set one.
 	Timeout time.Duration
 
+	// MaxRetryAfter retries a replayable request once when the upstream
+	// answers 429 Too Many Requests or 503 Service Unavailable with a
+	// Retry-After (in seconds or as an HTTP date) of at most this long,
+	// waiting the delay the upstream asked for. Longer delays, and responses
+	// without Retry-After, are passed through. Retries draw on RetryBudget.
+	// Zero disables these retries.
+	MaxRetryAfter time.Duration
+
+	// SlowRequestThreshold logs a warning and counts the request in
+	// slow_requests_total when a request takes longer than this, whatever
+	// its status. Zero disables the warning.
+	SlowRequestThreshold time.Duration
+
+	// DisableMetrics stops recording this route's metrics, e.g. for health
+	// checks or noisy internal endpoints. Requests are still logged.
+	DisableMetrics bool
+
+	// MetricLabelName adds a label to this route's metric series, set to
+	// MetricLabelValue; other routes' series carry it with an empty value.
+	// Example: "tenant"
+	MetricLabelName string
+
+	// MetricLabelValue is the value of the MetricLabelName label
+	MetricLabelValue string
+
 	// TLSMode controls TLS handling: "terminate" (default) or "passthrough"
 	TLSMode string
 
+	// EgressProxyURL overrides Transport.UpstreamProxyURL for this route, sending
+	// its upstream requests through the given forward proxy
+	EgressProxyURL string
+
+	// IdleConnTimeout overrides Transport.IdleConnTimeout for this route's
+	// upstream connections. Zero uses the proxy-wide setting.
+	IdleConnTimeout time.Duration
+
+	// MaxConnLifetime closes HTTP/1.1 upstream connections once they are this
+	// old, forcing periodic re-dials. A connection in use when it expires is
+	// closed when its request finishes rather than being reused. Zero disables
+	// the limit.
+	MaxConnLifetime time.Duration
+
+	// Protocol describes the traffic carried by this route: "http" (default),
+	// "websocket", or "grpc". Upgrade and gRPC routes keep the Connection and
+	// Upgrade headers that are otherwise removed as hop-by-hop.
+	Protocol string
+
+	// PreserveHopByHop lists hop-by-hop headers (wildcards supported) that should
+	// be forwarded to the upstream instead of being removed.
+	// Example: []string{"Keep-Alive", "X-Custom-Hop"}
+	PreserveHopByHop []string
+
+	// MirrorConnectionClose closes the client's HTTP/1.x connection after any
+	// response on which the upstream ended keep-alive (Connection: close, or
+	// an HTTP/1.0 response without keep-alive), sending the client
+	// Connection: close. By default client keep-alive is managed by the server
+	// regardless of the upstream.
+	MirrorConnectionClose bool
+
+	// ForwardEarlyHints forwards interim 1xx responses from the upstream, such
+	// as 103 Early Hints with Link preload headers, to HTTP/1.1 and later
+	// clients ahead of the final response. By default only 100 Continue is
+	// forwarded.
+	ForwardEarlyHints bool
+
 	// RewriteRedirects enables automatic rewriting of Location headers
 	// to route redirects through the proxy instead of directly to external services
 	RewriteRedirects bool
 
+	// RewriteAuthChallenge rewrites URLs in WWW-Authenticate challenges (such
+	// as a Bearer realm or resource) that point at this or another route's
+	// upstream to route through the proxy, like RewriteRedirects does for
+	// Location. URLs pointing elsewhere are left as-is.
+	RewriteAuthChallenge bool
+
+	// RewriteLinkHeader rewrites the target URLs of Link headers (such as a
+	// paginated API's rel="next" and rel="prev" links) that point at this or
+	// another route's upstream to route through the proxy, like
+	// RewriteRedirects does for Location. Link parameters are preserved and
+	// URLs pointing elsewhere are left as-is.
+	RewriteLinkHeader bool
+
+	// AllowedMethods restricts the HTTP methods accepted on this route.
+	// Other methods get a 405 with an Allow header without reaching the upstream.
+	// Empty allows all methods. Example: []string{"GET", "HEAD"}
+	AllowedMethods []string
+
+	// MaxConcurrent caps the number of requests proxied to the upstream at once.
+	// Zero means unlimited.
+	MaxConcurrent int
+
+	// QueueTimeout is how long a request over MaxConcurrent waits in the route's
+	// FIFO queue for a slot before getting a 503. Zero rejects immediately.
+	QueueTimeout time.Duration
+
+	// QueueDepth caps the number of requests waiting for a slot when
+	// QueueTimeout is set; requests arriving with the queue full get a 503
+	// without waiting. Zero means the queue is unbounded.
+	QueueDepth int
+
+	// AddViaHeader appends an RFC 7230 Via entry to upstream requests and
+	// downstream responses, announcing the proxy. Default: false (transparent).
+	// If Via is also listed in a strip rule, adding wins.
+	AddViaHeader bool
+
+	// ViaPseudonym is the name announced in the Via entry (default: "mimic-proxy")
+	ViaPseudonym string
+
+	// RewriteReferer rewrites incoming Referer and Origin headers that point at the
+	// proxy (incoming Host or RedirectBaseURL host) and this route's PathPrefix into
+	// the upstream's host and path space before forwarding
+	RewriteReferer bool
+
+	// ResponseBodyTransform rewrites upstream response bodies before they are
+	// returned to the client. gzip, deflate, and br bodies are decoded first and
+	// the result is sent as plaintext. Bodies with any other Content-Encoding
+	// are passed through untransformed. Bodies decoding to more than 10 MB
+	// fail with 502 Bad Gateway.
+	ResponseBodyTransform BodyTransform
+
+	// StatusCodeMap remaps upstream response status codes before they reach
+	// the client, e.g. {418: 400}. Headers and body are passed through
+	// unchanged. Codes must be between 200 and 599, and a code may not be
+	// mapped to 204 or 304, which cannot carry the upstream's body.
+	StatusCodeMap map[int]int
+
+	// RequestBodyTransform rewrites JSON request bodies (application/json or
+	// +json) before they are forwarded, e.g. to add or remove fields. The body
+	// is buffered in full (up to 10 MB; larger bodies are rejected with 413);
+	// gzip, deflate, and br bodies are decoded and forwarded as plaintext.
+	// Other bodies are streamed through untouched. A transform error rejects
+	// the request with 400.
+	RequestBodyTransform BodyTransform
+
+	// RequestSchema is the path to a JSON Schema that JSON request bodies
+	// (application/json or +json) must match. Bodies that don't, or that are
+	// not valid JSON, are rejected with 400 listing the violations and never
+	// reach the upstream. The body is buffered in full (up to 10 MB; larger
+	// bodies are rejected with 413). Other bodies are not validated.
+	RequestSchema string
+
+	// VerifyHMAC rejects requests whose body signature header does not match
+	// the HMAC of the raw body with 401, before anything is forwarded, e.g.
+	// for webhook callbacks. The body is buffered in full (up to 10 MB;
+	// larger bodies are rejected with 413).
+	VerifyHMAC *HMACVerificationConfig
+
+	// SignRequests signs forwarded requests with an HMAC over the method,
+	// upstream path, and body hash, for upstreams that authenticate callers
+	// that way. The body is buffered in full (up to 10 MB; larger bodies are
+	// rejected with 413). Mirrored requests are not signed.
+	SignRequests *RequestSigningConfig
+
+	// ForceStreamBody guarantees request bodies are streamed to the upstream
+	// without being held in memory, for huge uploads. Bodies are otherwise
+	// only buffered by features that need them (RequestBodyTransform,
+	// RequestSchema, VerifyHMAC, SignRequests, Idempotency, which cannot be
+	// combined with this, and the first 1 MB for mirroring). With it, requests with bodies
+	// are not mirrored, and a request whose body was partly sent is never
+	// retried.
+	ForceStreamBody bool
+
+	// CompressResponses gzips uncompressed upstream responses for clients that
+	// send "Accept-Encoding: gzip", setting Content-Encoding and Vary. Responses
+	// that are already encoded, partial (206), or marked no-transform are sent
+	// as-is.
+	CompressResponses bool
+
+	// TransparentEncoding forwards the client's Accept-Encoding to the upstream
+	// exactly as received (even when absent or stripped by header rules) and
+	// returns the upstream's encoded body and Content-Encoding verbatim. The
+	// route's transport does not request or decode compression itself.
+	TransparentEncoding bool
+
+	// CompressContentTypes lists the media types CompressResponses applies to;
+	// "text/*" matches any subtype (default: DefaultCompressContentTypes)
+	CompressContentTypes []string
+
+	// CompressMinSize is the smallest body, in bytes, that is compressed
+	// (default: DefaultCompressMinSize)
+	CompressMinSize int
+
+	// MirrorUpstream receives an asynchronous copy of sampled requests (e.g.,
+	// "https://candidate.internal"). Mirror responses are discarded and mirror
+	// failures are only logged; the client always gets the primary response.
+	MirrorUpstream string
+
+	// MirrorSampleRate is the fraction of requests mirrored, from 0.0 to 1.0
+	// (default: 1.0 when MirrorUpstream is set)
+	MirrorSampleRate float64
+
+	// Canary sends a share of this route's requests to a canary upstream for
+	// a gradual rollout. Nil sends every request to Upstream or Upstreams.
+	Canary *CanaryConfig
+
+	// Idempotency serves the response of the first request carrying an
+	// idempotency key to later requests with the same key, instead of
+	// forwarding them again. Bodies of requests carrying a key are buffered
+	// (up to 10 MB; larger bodies are rejected with 413) to detect a key
+	// reused for a different request. Nil forwards every request.
+	Idempotency *IdempotencyConfig
+
+	// StaticResponse, when set, answers every request on this route with a canned
+	// response instead of proxying, e.g. for maintenance mode. The upstream is
+	// never contacted.
+	StaticResponse *StaticResponseConfig
+
 	// RedirectBaseURL is the base URL clients use to access the proxy
 	// Example: "https://api.example.com"
 	// If empty, uses the incoming request's Host header
 	RedirectBaseURL string
 }
 
+// BasicAuthConfig holds HTTP Basic credentials for an upstream.
+type BasicAuthConfig struct {
+	// Username supports ${ENV_VAR} expansion
+	Username string
+
+	// Password supports ${ENV_VAR} expansion
+	Password string
+}
+
+// CanaryConfig sends a share of a route's requests to a canary upstream.
+// Requests are hashed to a side by client IP, or by StickyCookie when the
+// request has it, so a client stays on the same side while Percentage holds.
+type CanaryConfig struct {
+	// Upstream is the canary server (e.g., "https://api-canary.internal").
+	// Requests sent there skip the route's Balancer
+	Upstream string
+
+	// Percentage of requests sent to the canary, from 0 to 100
+	Percentage float64
+
+	// MatchHeader sends every request carrying this header to the canary,
+	// whatever its value and Percentage (optional)
+	MatchHeader string
+
+	// StickyCookie names a cookie whose value, when present, is hashed
+	// instead of the client IP (optional)
+	StickyCookie string
+}
+
+// IdempotencyConfig configures idempotency-key deduplication for a route.
+// While the first request with a key is in flight, duplicates wait for it;
+// once it completes, its response is replayed to duplicates, marked with
+// Idempotent-Replayed: true, until TTL has passed. Server errors (5xx) are
+// handed to duplicates already waiting but not kept, so later retries are
+// forwarded. Responses over 1 MB are not kept.
+type IdempotencyConfig struct {
+	// HeaderName is the request header carrying the key (default:
+	// Idempotency-Key). Requests without it are forwarded as usual
+	HeaderName string
+
+	// TTL is how long a completed response is replayed (default: 24h)
+	TTL time.Duration
+}
+
+// RateLimitConfig configures a token bucket rate limit.
+type RateLimitConfig struct {
+	// RequestsPerSecond is the sustained rate of requests allowed
+	RequestsPerSecond float64
+
+	// Burst is how many requests may go through at once after a quiet
+	// period. Default: RequestsPerSecond rounded up, at least 1
+	Burst int
+}
+
+// OAuth2Config configures the OAuth2 client-credentials grant for an upstream.
+type OAuth2Config struct {
+	// TokenURL is the token endpoint (e.g., "https://auth.example.com/oauth/token")
+	TokenURL string
+
+	// ClientID supports ${ENV_VAR} expansion
+	ClientID string
+
+	// ClientSecret supports ${ENV_VAR} expansion
+	ClientSecret string
+
+	// Scopes are requested with the token (optional)
+	Scopes []string
+}
+
+// HMACVerificationConfig configures verification of request body signatures.
+type HMACVerificationConfig struct {
+	// SignatureHeader carries the hex-encoded HMAC of the raw request body,
+	// optionally prefixed with the algorithm (e.g., "sha256=<hex>")
+	SignatureHeader string
+
+	// Secret is the shared HMAC key; supports ${ENV_VAR} expansion
+	Secret string
+
+	// Algorithm is the hash function: "sha256" (default) or "sha512"
+	Algorithm string
+}
+
+// RequestSigningConfig configures HMAC signing of forwarded requests. The
+// signed string is the method, the upstream path (escaped, without the query),
+// and the hex-encoded hash of the body using Algorithm, joined by newlines:
+//
+//	POST\n/v1/orders\n<hex(sha256(body))>
+//
+// The hex-encoded HMAC of that string keyed with Secret is sent in
+// SignatureHeader.
+type RequestSigningConfig struct {
+	// SignatureHeader receives the hex-encoded signature (e.g., "X-Signature")
+	SignatureHeader string
+
+	// Secret is the shared HMAC key; supports ${ENV_VAR} expansion
+	Secret string
+
+	// Algorithm is the hash function: "sha256" (default) or "sha512"
+	Algorithm string
+}
+
+// StaticResponseConfig defines a canned response served instead of proxying.
+type StaticResponseConfig struct {
+	// StatusCode is the response status (default: 503)
+	StatusCode int
+
+	// Headers are set on the response (e.g., "Content-Type": "text/html")
+	Headers map[string]string
+
+	// Body is the response body
+	Body string
+
+	// BodyFile is a path to read the response body from at startup, instead of Body
+	BodyFile string
+}
+
 // HeaderConfig defines header manipulation rules.
 type HeaderConfig struct {
 	// StripIncoming removes headers from client request before forwarding
@@ -84,16 +737,66 @@ type HeaderConfig struct {
 
 	// AddUpstream adds headers to request before forwarding to upstream
 	// Values support environment variable expansion: ${AIPRISE_API_KEY}
+	// or reading from a file (e.g. a mounted Kubernetes secret): @file:/path/to/secret
 	AddUpstream map[string]string
 
 	// AddDownstream adds headers to response before returning to client
 	AddDownstream map[string]string
 
+	// AppendUpstream adds a value to request headers, keeping any the client
+	// sent. Applied after AddUpstream, so a header in both gets both values.
+	// Values support the same expansion as AddUpstream.
+	AppendUpstream map[string]string
+
+	// AppendDownstream adds a value to response headers, keeping any the
+	// upstream sent. Applied after AddDownstream.
+	AppendDownstream map[string]string
+
 	// ReplaceIncoming replaces headers in client request
 	ReplaceIncoming map[string]string
 
 	// ReplaceOutgoing replaces headers in upstream response
 	ReplaceOutgoing map[string]string
+
+	// RewriteIncoming rewrites parts of client request header values, keyed
+	// by header name. Applied to each value after ReplaceIncoming.
+	RewriteIncoming map[string]HeaderRewrite
+
+	// RewriteOutgoing rewrites parts of upstream response header values,
+	// keyed by header name. Applied to each value after ReplaceOutgoing.
+	RewriteOutgoing map[string]HeaderRewrite
+
+	// FileRefreshInterval controls how often @file: values are re-read.
+	// Zero reads them once at startup. A failed re-read keeps the last
+	// value; a header whose file has never been read is left out.
+	FileRefreshInterval time.Duration
+}
+
+// HeaderRewrite replaces every match of a regular expression in a header value.
+type HeaderRewrite struct {
+	// Pattern is the regular expression (RE2 syntax) to match
+	Pattern string
+
+	// Replacement replaces each match; $1 or ${name} insert submatches
+	Replacement string
+}
+
+// RequestRewriteRule sets a header, query parameter, or path segment of the
+// upstream request from a template over the request's own values.
+type RequestRewriteRule struct {
+	// Target is what the rule sets: "header.<name>", "query.<name>", or
+	// "path.<index>", a zero-based segment of the upstream path
+	Target string
+
+	// Value is a template that may reference ${header.<name>},
+	// ${query.<name>}, and ${path.<index>}. A rule referencing a value the
+	// request doesn't have is skipped.
+	// Example: "Bearer ${query.token}"
+	Value string
+
+	// Move removes the referenced values from the request once the target
+	// is set, turning the copy into a move
+	Move bool
 }
 
 // TransportConfig configures the HTTP transport layer.
@@ -116,178 +819,1086 @@ type TransportConfig struct {
 	// ResponseHeaderTimeout is the maximum time to wait for response headers
 	ResponseHeaderTimeout time.Duration
 
-	// ExpectContinueTimeout for 100-continue responses
-	ExpectContinueTimeout time.Duration
+	// ExpectContinueTimeout is how long to wait for the upstream's 100 Continue
+	// before sending a request body with Expect: 100-continue. The interim
+	// response is relayed to the client. Zero sends the body without waiting.
+	ExpectContinueTimeout time.Duration
+
+	// DisableKeepAlives disables HTTP keep-alives
+	DisableKeepAlives bool
+
+	// DisableCompression disables transparent compression
+	DisableCompression bool
+
+	// UpstreamProxyURL is a forward proxy all upstream requests egress through
+	// (e.g., "http://proxy.corp:3128"). If empty, the HTTP_PROXY, HTTPS_PROXY,
+	// and NO_PROXY environment variables are used.
+	UpstreamProxyURL string
+
+	// TLSSessionCacheSize is the number of upstream TLS sessions cached for
+	// resuming handshakes on new connections. Zero uses
+	// DefaultTLSSessionCacheSize; a negative value disables resumption.
+	TLSSessionCacheSize int
+}
+
+// AdminConfig configures the admin API.
+type AdminConfig struct {
+	// Token is the shared secret admin requests present as a bearer token;
+	// supports ${ENV_VAR} expansion. Empty refuses every admin request.
+	Token string
+}
+
+// TLSConfig configures TLS settings.
+type TLSConfig struct {
+	// CertFile is the path to the TLS certificate for downstream (client) connections
+	CertFile string
+
+	// KeyFile is the path to the TLS private key for downstream connections
+	KeyFile string
+
+	// CertReloadInterval is how often servers built with ServerTLS check
+	// CertFile and KeyFile for changes, loading a renewed keypair without a
+	// restart. Zero disables the check; Proxy.ReloadTLSCertificate reloads
+	// on demand.
+	CertReloadInterval time.Duration
+
+	// CAFile is the path to CA certificates for verifying upstream servers
+	CAFile string
+
+	// InsecureSkipVerify disables upstream TLS verification (NOT RECOMMENDED)
+	InsecureSkipVerify bool
+
+	// MinVersion is the minimum TLS version (e.g., "1.2", "1.3")
+	MinVersion string
+
+	// CipherSuites is the list of enabled cipher suites
+	CipherSuites []string
+
+	// ClientCAFile is the path to CA certificates for verifying downstream
+	// client certificates (mTLS)
+	ClientCAFile string
+
+	// ClientAuth controls downstream client certificate verification:
+	// "none", "verify_if_given", or "require_and_verify" (default:
+	// "require_and_verify" when ClientCAFile is set, otherwise "none")
+	ClientAuth string
+}
+
+// MetricsConfig configures Prometheus metrics.
+type MetricsConfig struct {
+	// Enabled controls whether metrics are collected
+	Enabled bool
+
+	// Path is the HTTP path for the metrics endpoint (default: "/metrics")
+	Path string
+
+	// Port is the port for the metrics server (if different from main server)
+	Port int
+
+	// Namespace is the Prometheus namespace (default: "mimic_proxy")
+	Namespace string
+
+	// DurationBuckets are the histogram buckets in seconds for request durations
+	// (default: DefaultDurationBuckets, 1ms..10s)
+	DurationBuckets []float64
+
+	// UpstreamDurationBuckets are the histogram buckets in seconds for upstream
+	// durations and time to first byte (default: DefaultDurationBuckets)
+	UpstreamDurationBuckets []float64
+}
+
+// BuildInfo identifies the build of the program embedding the proxy. The
+// embedder fills it in, typically from values set with -ldflags.
+type BuildInfo struct {
+	// Version is the release version, e.g. "1.4.2"
+	Version string
+
+	// Commit is the source revision the program was built from
+	Commit string
+
+	// BuiltAt is when the program was built, e.g. "2026-10-16T12:00:00Z"
+	BuiltAt string
+}
+
+// LoggerConfig configures structured logging.
+type LoggerConfig struct {
+	// Level is the log level: "debug", "info", "warn", "error"
+	Level string
+
+	// Format is the log format: "json" or "text"
+	Format string
+
+	// Output is where to write logs: "stdout", "stderr", or a file path
+	Output string
+
+	// SampleRate is the fraction of successful requests, from 0.0 to 1.0,
+	// whose per-request debug logs ("Handling request" and "Request
+	// completed") are emitted. Warnings and errors are always logged, and
+	// metrics count every request. (default: 1.0)
+	SampleRate float64
+}
+
+// ValidateOption adjusts how ValidateConfig checks a configuration.
+type ValidateOption int
+
+const (
+	// SkipFileChecks skips checks that read the filesystem, such as whether TLS
+	// certificates and @file: header values exist.
+	SkipFileChecks ValidateOption = iota + 1
+)
+
+// ValidateConfig applies defaults to the configuration and validates it without
+// constructing a proxy: no transport, logger, or network access is involved.
+// This is intended for linting configurations, e.g. in CI or unit tests.
+func ValidateConfig(config *Config, options ...ValidateOption) (err error) {
+	checkFiles := true
+	for _, option := range options {
+		if option == SkipFileChecks {
+			checkFiles = false
+		}
+	}
+
+	config.ApplyDefaults()
+
+	err = config.collectErrors(checkFiles).err()
+	return err
+}
+
+// Validate validates the configuration and returns an error if invalid. Every
+// problem found is reported: a single ValidationError, or several joined with
+// errors.Join. ValidateAll returns them individually.
+func (c *Config) Validate() (err error) {
+	err = c.collectErrors(true).err()
+	return err
+}
+
+// ValidateAll validates the configuration and returns every problem found,
+// each with the path of the offending field. A valid configuration has none.
+func (c *Config) ValidateAll() (problems []ValidationError) {
+	problems = c.collectErrors(true)
+	return problems
+}
+
+// collectErrors validates the configuration, optionally checking referenced
+// files.
+func (c *Config) collectErrors(checkFiles bool) (problems validationErrors) {
+	if len(c.Routes) == 0 {
+		problems.add("routes", errors.New("at least one route is required"))
+	}
+
+	// Validate each route
+	for i, route := range c.Routes {
+		routeProblems := route.collectErrors(checkFiles)
+		if c.StrictRouteValidation {
+			routeProblems.addNested("headers", "", route.Headers.collectEssentialHeaderErrors())
+		}
+		routeProblems.addNested("headers", "headers", route.Headers.collectForbiddenValueErrors(c.ForbiddenHeaderValues, checkFiles))
+		if route.PreserveHeaderCasingAndOrder && route.EgressProxyURL == "" && c.Transport.UpstreamProxyURL != "" {
+			routeProblems.add("preserve_header_casing_and_order", errors.New("preserve_header_casing_and_order cannot be used with transport.upstream_proxy_url"))
+		}
+		problems.addNested(fmt.Sprintf("routes[%d]", i), fmt.Sprintf("route %d (%s)", i, route.Name), routeProblems)
+	}
+
+	// Check for conflicting route paths
+	problems = append(problems, c.collectConflictingRouteErrors()...)
+
+	if c.MaxHeaderBytes < 0 {
+		problems.add("max_header_bytes", fmt.Errorf("max_header_bytes must not be negative: %d", c.MaxHeaderBytes))
+	}
+
+	if c.RetryBudget < 0 || c.RetryBudget > 1 {
+		problems.add("retry_budget", fmt.Errorf("retry_budget must be between 0 and 1: %g", c.RetryBudget))
+	}
+
+	if c.MaxRedirectRewrites < 0 {
+		problems.add("max_redirect_rewrites", fmt.Errorf("max_redirect_rewrites must not be negative: %d", c.MaxRedirectRewrites))
+	}
+
+	if c.BodyBufferMaxBytes < 0 {
+		problems.add("body_buffer_max_bytes", fmt.Errorf("body_buffer_max_bytes must not be negative: %d", c.BodyBufferMaxBytes))
+	}
+
+	if c.AllowConnect && len(c.ConnectAllowedHosts) == 0 {
+		problems.add("connect_allowed_hosts", errors.New("allow_connect requires connect_allowed_hosts"))
+	}
+
+	if c.GlobalRateLimit != nil {
+		problems.addNested("global_rate_limit", "global_rate_limit", c.GlobalRateLimit.collectErrors())
+	}
+
+	var err error
+	_, err = parseTrustedProxies(c.TrustedProxies)
+	if err != nil {
+		problems.add("trusted_proxies", fmt.Errorf("trusted_proxies: %w", err))
+	}
+
+	if c.ErrorResponseTemplate != "" {
+		_, err = parseErrorTemplate(c.ErrorResponseTemplate)
+		if err != nil {
+			problems.add("error_response_template", fmt.Errorf("error_response_template: %w", err))
+		}
+	}
+
+	// Validate upstream proxy URL if provided
+	if c.Transport.UpstreamProxyURL != "" {
+		err = validateProxyURL(c.Transport.UpstreamProxyURL, "upstream_proxy_url")
+		if err != nil {
+			problems.add("transport.upstream_proxy_url", fmt.Errorf("transport configuration: %w", err))
+		}
+	}
+
+	// Validate metrics configuration
+	problems.addNested("metrics", "metrics configuration", c.Metrics.collectErrors())
+
+	// Validate logger configuration
+	problems.addNested("logger", "logger configuration", c.Logger.collectErrors())
+
+	// Validate TLS configuration if provided
+	if c.TLS.CertFile != "" || c.TLS.KeyFile != "" || c.TLS.ClientCAFile != "" || c.TLS.ClientAuth != "" || c.TLS.CertReloadInterval != 0 {
+		problems.addNested("tls", "TLS configuration", c.TLS.collectErrors(checkFiles))
+	}
+
+	return problems
+}
+
+// Validate validates a route configuration, reporting every problem found as
+// Config.Validate does.
+func (r *RouteConfig) Validate() (err error) {
+	err = r.collectErrors(true).err()
+	return err
+}
+
+// collectErrors validates a route configuration, optionally checking
+// referenced files.
+func (r *RouteConfig) collectErrors(checkFiles bool) (problems validationErrors) {
+	if r.Name == "" {
+		problems.add("name", errors.New("route name is required"))
+	}
+
+	if r.PathPrefix == "" {
+		problems.add("path_prefix", errors.New("path_prefix is required"))
+	} else if !strings.HasPrefix(r.PathPrefix, "/") {
+		problems.add("path_prefix", fmt.Errorf("path_prefix must start with /: %s", r.PathPrefix))
+	}
+
+	problems = append(problems, r.collectUpstreamErrors()...)
+	problems = append(problems, r.collectAuthErrors()...)
+	problems = append(problems, r.collectConflictErrors()...)
+	problems = append(problems, r.collectForwardingErrors()...)
+	problems = append(problems, r.collectTimeoutErrors()...)
+	problems = append(problems, r.collectConcurrencyErrors()...)
+	problems = append(problems, r.collectResponseErrors()...)
+	problems = append(problems, r.collectMetricLabelErrors()...)
+
+	if r.Idempotency != nil {
+		problems.addNested("idempotency", "idempotency", r.Idempotency.collectErrors())
+		if r.Streaming {
+			problems.add("idempotency", errors.New("idempotency cannot be combined with streaming"))
+		}
+		if r.PreserveHeaderCasingAndOrder {
+			problems.add("idempotency", errors.New("idempotency cannot be combined with preserve_header_casing_and_order"))
+		}
+	}
+
+	// Validate static response if provided
+	if r.StaticResponse != nil {
+		problems.addNested("static_response", "static_response", r.StaticResponse.collectErrors(checkFiles))
+	}
+
+	// Validate header configuration
+	problems.addNested("headers", "headers", r.Headers.collectErrors(checkFiles))
+
+	// Validate the request schema file if provided
+	if checkFiles {
+		var err error
+		err = validateFile(r.RequestSchema, "request_schema")
+		if err != nil {
+			problems.add("request_schema", err)
+		}
+	}
+
+	return problems
+}
+
+// collectUpstreamErrors validates where the route sends requests: its
+// upstream, load-balanced upstreams, egress proxy, mirror, and canary.
+func (r *RouteConfig) collectUpstreamErrors() (problems validationErrors) {
+	var err error
+	var unixUpstream bool
+	problems, unixUpstream = r.collectUpstreamURLErrors()
+
+	// Validate load-balanced upstreams if provided
+	if len(r.Upstreams) > 0 && unixUpstream {
+		problems.add("upstreams", errors.New("upstreams cannot be combined with a unix upstream"))
+	}
+
+	for i, upstream := range r.Upstreams {
+		field := fmt.Sprintf("upstreams[%d]", i)
+
+		var poolURL *url.URL
+		poolURL, err = url.Parse(upstream)
+		if err != nil {
+			problems.add(field, fmt.Errorf("invalid upstreams URL: %w", err))
+			continue
+		}
+
+		if (poolURL.Scheme != SchemeHTTP && poolURL.Scheme != SchemeHTTPS) || poolURL.Host == "" {
+			problems.add(field, fmt.Errorf("upstreams must be http or https URLs: %s", upstream))
+		}
+	}
+
+	switch r.Balancer {
+	case "", BalancerRoundRobin, BalancerRandom, BalancerLeastConn, BalancerConsistentHash:
+	default:
+		problems.add("balancer", fmt.Errorf("balancer must be 'round_robin', 'random', 'least_conn', or 'consistent_hash': %s", r.Balancer))
+	}
+
+	// Validate egress proxy URL if provided
+	if r.EgressProxyURL != "" {
+		err = validateProxyURL(r.EgressProxyURL, "egress_proxy_url")
+		if err != nil {
+			problems.add("egress_proxy_url", err)
+		}
+
+		if unixUpstream {
+			problems.add("egress_proxy_url", errors.New("egress_proxy_url cannot be used with a unix upstream"))
+		}
+	}
+
+	// Validate mirror settings
+	if r.MirrorUpstream != "" {
+		var mirrorURL *url.URL
+		mirrorURL, err = url.Parse(r.MirrorUpstream)
+		if err != nil {
+			problems.add("mirror_upstream", fmt.Errorf("invalid mirror_upstream: %w", err))
+		} else if (mirrorURL.Scheme != SchemeHTTP && mirrorURL.Scheme != SchemeHTTPS) || mirrorURL.Host == "" {
+			problems.add("mirror_upstream", fmt.Errorf("mirror_upstream must be an http or https URL: %s", r.MirrorUpstream))
+		}
+	}
+
+	if r.MirrorSampleRate < 0 || r.MirrorSampleRate > 1 {
+		problems.add("mirror_sample_rate", fmt.Errorf("mirror_sample_rate must be between 0.0 and 1.0: %g", r.MirrorSampleRate))
+	}
+
+	if r.Canary != nil {
+		problems.addNested("canary", "canary", r.Canary.collectErrors())
+		if unixUpstream {
+			problems.add("canary", errors.New("canary cannot be combined with a unix upstream"))
+		}
+	}
+
+	return problems
+}
+
+// collectUpstreamURLErrors validates the upstream URL, reporting whether it
+// is a Unix socket. The checks that depend on its scheme are skipped while it
+// is missing or unparseable.
+func (r *RouteConfig) collectUpstreamURLErrors() (problems validationErrors, unixUpstream bool) {
+	if r.Upstream == "" {
+		problems.add("upstream", errors.New("upstream is required"))
+		return problems, unixUpstream
+	}
+
+	var upstreamURL *url.URL
+	var err error
+	upstreamURL, err = url.Parse(r.Upstream)
+	if err != nil {
+		problems.add("upstream", fmt.Errorf("invalid upstream URL: %w", err))
+		return problems, unixUpstream
+	}
+
+	switch upstreamURL.Scheme {
+	case SchemeHTTP, SchemeHTTPS:
+		// Any path is a base path the director prefixes to forwarded paths.
+		// Without a host the director would address requests to nowhere
+		if upstreamURL.Hostname() == "" {
+			problems.add("upstream", fmt.Errorf("upstream URL must include a host: %s", r.Upstream))
+		}
+	case SchemeUnix:
+		unixUpstream = true
+		if upstreamURL.Path == "" {
+			problems.add("upstream", fmt.Errorf("unix upstream URL must include a socket path: %s", r.Upstream))
+		}
+	default:
+		problems.add("upstream", fmt.Errorf("upstream URL must use http, https, or unix scheme: %s", r.Upstream))
+	}
+
+	return problems, unixUpstream
+}
+
+// collectAuthErrors validates how the route authenticates requests, both
+// those it receives and those it sends upstream.
+func (r *RouteConfig) collectAuthErrors() (problems validationErrors) {
+	// Validate the Authorization strategy
+	switch r.AuthStrategy {
+	case "", AuthStrategyReplace, AuthStrategyPassthrough, AuthStrategyInjectIfAbsent:
+	default:
+		problems.add("auth_strategy", fmt.Errorf("auth_strategy must be 'replace', 'passthrough', or 'inject_if_absent': %s", r.AuthStrategy))
+	}
+
+	if r.PreserveClientAuth && r.AuthStrategy != "" && r.AuthStrategy != AuthStrategyInjectIfAbsent {
+		problems.add("preserve_client_auth", fmt.Errorf("preserve_client_auth requires auth_strategy 'inject_if_absent': %s", r.AuthStrategy))
+	}
+
+	// Validate upstream basic auth if provided
+	if r.UpstreamBasicAuth != nil {
+		problems.addNested("upstream_basic_auth", "upstream_basic_auth", r.UpstreamBasicAuth.collectErrors())
+	}
+
+	// Validate OAuth2 if provided
+	if r.OAuth2 != nil {
+		if r.UpstreamBasicAuth != nil {
+			problems.add("oauth2", errors.New("upstream_basic_auth and oauth2 are mutually exclusive"))
+		}
+
+		problems.addNested("oauth2", "oauth2", r.OAuth2.collectErrors())
+	}
+
+	// Validate webhook signature verification if provided
+	if r.VerifyHMAC != nil {
+		problems.addNested("verify_hmac", "verify_hmac", r.VerifyHMAC.collectErrors())
+	}
+
+	// Validate upstream request signing if provided
+	if r.SignRequests != nil {
+		problems.addNested("sign_requests", "sign_requests", r.SignRequests.collectErrors())
+	}
+
+	return problems
+}
+
+// collectConflictErrors reports route features that cannot be combined.
+func (r *RouteConfig) collectConflictErrors() (problems validationErrors) {
+	if r.SNIFromHost && !r.PreserveHost {
+		problems.add("sni_from_host", errors.New("sni_from_host requires preserve_host"))
+	}
+
+	// Validate header order preservation, which needs plain HTTP/1.1 upstream connections
+	if r.PreserveHeaderCasingAndOrder {
+		if r.SNIFromHost {
+			problems.add("preserve_header_casing_and_order", errors.New("preserve_header_casing_and_order cannot be used with sni_from_host"))
+		}
+
+		if r.Protocol != "" && r.Protocol != ProtocolHTTP {
+			problems.add("preserve_header_casing_and_order", fmt.Errorf("preserve_header_casing_and_order requires protocol 'http': %s", r.Protocol))
+		}
+
+		if r.EgressProxyURL != "" {
+			problems.add("preserve_header_casing_and_order", errors.New("preserve_header_casing_and_order cannot be used with egress_proxy_url"))
+		}
+	}
+
+	// Validate encoding transparency, which rules out re-encoding responses
+	if r.TransparentEncoding {
+		if r.CompressResponses {
+			problems.add("transparent_encoding", errors.New("transparent_encoding cannot be used with compress_responses"))
+		}
+
+		if r.ResponseBodyTransform != nil {
+			problems.add("transparent_encoding", errors.New("transparent_encoding cannot be used with response_body_transform"))
+		}
+	}
+
+	// Validate body streaming, which rules out features that buffer the body
+	if r.ForceStreamBody {
+		bufferingFeatures := []struct {
+			name    string
+			enabled bool
+		}{
+			{"request_body_transform", r.RequestBodyTransform != nil},
+			{"request_schema", r.RequestSchema != ""},
+			{"verify_hmac", r.VerifyHMAC != nil},
+			{"sign_requests", r.SignRequests != nil},
+			{"idempotency", r.Idempotency != nil},
+		}
+		for _, feature := range bufferingFeatures {
+			if feature.enabled {
+				problems.add("force_stream_body", fmt.Errorf("force_stream_body cannot be used with %s", feature.name))
+			}
+		}
+	}
+
+	return problems
+}
+
+// collectForwardingErrors validates how requests are rewritten on their way
+// upstream and how redirects are rewritten on their way back.
+func (r *RouteConfig) collectForwardingErrors() (problems validationErrors) {
+	var err error
+
+	// Validate TLS mode
+	if r.TLSMode != "" && r.TLSMode != "terminate" && r.TLSMode != "passthrough" {
+		problems.add("tls_mode", fmt.Errorf("tls_mode must be 'terminate' or 'passthrough': %s", r.TLSMode))
+	}
+
+	// Validate forwarded headers mode
+	switch r.ForwardedHeaders {
+	case "", ForwardedHeadersStrip:
+	case ForwardedHeadersStandard:
+		for i, pattern := range r.Headers.StripIncoming {
+			conflicts := slices.ContainsFunc(forwardedHeaderNames, func(name string) (match bool) {
+				match = matchesPattern(name, pattern)
+				return match
+			})
+			if conflicts {
+				problems.add(fmt.Sprintf("headers.strip_incoming[%d]", i), fmt.Errorf("forwarded_headers 'standard' conflicts with strip_incoming pattern %s", pattern))
+			}
+		}
+	default:
+		problems.add("forwarded_headers", fmt.Errorf("forwarded_headers must be 'strip' or 'standard': %s", r.ForwardedHeaders))
+	}
+
+	// Validate trailing slash mode
+	switch r.TrailingSlash {
+	case "", TrailingSlashPreserve, TrailingSlashStrip, TrailingSlashAdd:
+	default:
+		problems.add("trailing_slash", fmt.Errorf("trailing_slash must be 'preserve', 'strip', or 'add': %s", r.TrailingSlash))
+	}
+
+	// Validate protocol
+	switch r.Protocol {
+	case "", ProtocolHTTP, ProtocolWebSocket, ProtocolGRPC:
+	default:
+		problems.add("protocol", fmt.Errorf("protocol must be 'http', 'websocket', or 'grpc': %s", r.Protocol))
+	}
+
+	// Validate allowed methods
+	for i, method := range r.AllowedMethods {
+		if method == "" || strings.ContainsAny(method, " \t,") {
+			problems.add(fmt.Sprintf("allowed_methods[%d]", i), fmt.Errorf("allowed_methods contains an invalid method: %q", method))
+		}
+	}
+
+	for i, rule := range r.RequestRewrite {
+		_, err = compileRequestRewrite(rule)
+		if err != nil {
+			problems.add(fmt.Sprintf("request_rewrite[%d]", i), fmt.Errorf("request_rewrite %d: %w", i, err))
+		}
+	}
+
+	// Validate Via pseudonym (must be a single token)
+	if strings.ContainsAny(r.ViaPseudonym, " \t,") {
+		problems.add("via_pseudonym", fmt.Errorf("via_pseudonym must not contain whitespace or commas: %q", r.ViaPseudonym))
+	}
+
+	// Validate redirect base URL if provided
+	if r.RedirectBaseURL != "" {
+		var baseURL *url.URL
+		baseURL, err = url.Parse(r.RedirectBaseURL)
+		if err != nil {
+			problems.add("redirect_base_url", fmt.Errorf("invalid redirect_base_url: %w", err))
+		} else if baseURL.Scheme == "" || baseURL.Host == "" {
+			problems.add("redirect_base_url", fmt.Errorf("redirect_base_url must include scheme and host: %s", r.RedirectBaseURL))
+		}
+	}
+
+	return problems
+}
+
+// collectTimeoutErrors validates the route's timeouts and connection
+// lifetimes, none of which may be negative.
+func (r *RouteConfig) collectTimeoutErrors() (problems validationErrors) {
+	timeouts := []struct {
+		field string
+		value time.Duration
+	}{
+		{"request_timeout", r.RequestTimeout},
+		{"body_read_timeout", r.BodyReadTimeout},
+		{"max_retry_after", r.MaxRetryAfter},
+		{"slow_request_threshold", r.SlowRequestThreshold},
+		{"idle_conn_timeout", r.IdleConnTimeout},
+		{"max_conn_lifetime", r.MaxConnLifetime},
+	}
+	for _, timeout := range timeouts {
+		if timeout.value < 0 {
+			problems.add(timeout.field, fmt.Errorf("%s must not be negative: %s", timeout.field, timeout.value))
+		}
+	}
+
+	return problems
+}
+
+// collectConcurrencyErrors validates the route's concurrency limit and the
+// queue in front of it.
+func (r *RouteConfig) collectConcurrencyErrors() (problems validationErrors) {
+	if r.MaxConcurrent < 0 {
+		problems.add("max_concurrent", fmt.Errorf("max_concurrent must not be negative: %d", r.MaxConcurrent))
+	}
+
+	if r.QueueTimeout < 0 {
+		problems.add("queue_timeout", fmt.Errorf("queue_timeout must not be negative: %s", r.QueueTimeout))
+	}
+
+	if r.QueueTimeout > 0 && r.MaxConcurrent == 0 {
+		problems.add("queue_timeout", errors.New("queue_timeout requires max_concurrent"))
+	}
+
+	if r.QueueDepth < 0 {
+		problems.add("queue_depth", fmt.Errorf("queue_depth must not be negative: %d", r.QueueDepth))
+	}
+
+	if r.QueueDepth > 0 && r.QueueTimeout == 0 {
+		problems.add("queue_depth", errors.New("queue_depth requires queue_timeout"))
+	}
+
+	return problems
+}
+
+// collectResponseErrors validates how upstream responses are handled: status
+// code mapping, header size limits, and compression.
+func (r *RouteConfig) collectResponseErrors() (problems validationErrors) {
+	for _, from := range slices.Sorted(maps.Keys(r.StatusCodeMap)) {
+		to := r.StatusCodeMap[from]
+		field := fmt.Sprintf("status_code_map.%d", from)
+		switch {
+		case from < 200 || from > 599 || to < 200 || to > 599:
+			problems.add(field, fmt.Errorf("status_code_map codes must be between 200 and 599: %d -> %d", from, to))
+		case to == http.StatusNoContent || to == http.StatusNotModified:
+			problems.add(field, fmt.Errorf("status_code_map cannot map to %d, which has no body: %d -> %d", to, from, to))
+		}
+	}
+
+	// Validate the upstream header size limit
+	if r.MaxUpstreamHeaderBytes < 0 {
+		problems.add("max_upstream_header_bytes", fmt.Errorf("max_upstream_header_bytes must not be negative: %d", r.MaxUpstreamHeaderBytes))
+	}
+
+	switch r.UpstreamHeaderLimitPolicy {
+	case "", HeaderLimitReject, HeaderLimitTrim:
+	default:
+		problems.add("upstream_header_limit_policy", fmt.Errorf("upstream_header_limit_policy must be 'reject' or 'trim': %s", r.UpstreamHeaderLimitPolicy))
+	}
+
+	// Validate response compression
+	if r.CompressMinSize < 0 {
+		problems.add("compress_min_size", fmt.Errorf("compress_min_size must not be negative: %d", r.CompressMinSize))
+	}
+
+	for i, contentType := range r.CompressContentTypes {
+		if !strings.Contains(contentType, "/") {
+			problems.add(fmt.Sprintf("compress_content_types[%d]", i), fmt.Errorf("compress_content_types contains an invalid media type: %q", contentType))
+		}
+	}
+
+	return problems
+}
+
+// collectMetricLabelErrors validates the route's extra metric label.
+func (r *RouteConfig) collectMetricLabelErrors() (problems validationErrors) {
+	if r.MetricLabelName != "" {
+		if !metricLabelNamePattern.MatchString(r.MetricLabelName) || strings.HasPrefix(r.MetricLabelName, "__") {
+			problems.add("metric_label_name", fmt.Errorf("metric_label_name must be a valid Prometheus label name: %s", r.MetricLabelName))
+		}
+
+		if slices.Contains(reservedMetricLabels, r.MetricLabelName) {
+			problems.add("metric_label_name", fmt.Errorf("metric_label_name conflicts with built-in label: %s", r.MetricLabelName))
+		}
+	}
+
+	if r.MetricLabelValue != "" && r.MetricLabelName == "" {
+		problems.add("metric_label_value", errors.New("metric_label_value requires metric_label_name"))
+	}
+
+	return problems
+}
+
+// Validate validates basic auth credentials.
+func (b *BasicAuthConfig) Validate() (err error) {
+	err = b.collectErrors().err()
+	return err
+}
+
+// collectErrors validates basic auth credentials.
+func (b *BasicAuthConfig) collectErrors() (problems validationErrors) {
+	if b.Username == "" {
+		problems.add("username", errors.New("username is required"))
+	}
+
+	if b.Password == "" {
+		problems.add("password", errors.New("password is required"))
+	}
+
+	return problems
+}
+
+// Validate validates HMAC signature verification settings.
+func (h *HMACVerificationConfig) Validate() (err error) {
+	err = h.collectErrors().err()
+	return err
+}
+
+// collectErrors validates HMAC signature verification settings.
+func (h *HMACVerificationConfig) collectErrors() (problems validationErrors) {
+	problems = collectHMACErrors(h.SignatureHeader, h.Secret, h.Algorithm)
+	return problems
+}
+
+// Validate validates HMAC request signing settings.
+func (s *RequestSigningConfig) Validate() (err error) {
+	err = s.collectErrors().err()
+	return err
+}
+
+// collectErrors validates HMAC request signing settings.
+func (s *RequestSigningConfig) collectErrors() (problems validationErrors) {
+	problems = collectHMACErrors(s.SignatureHeader, s.Secret, s.Algorithm)
+	return problems
+}
+
+// collectHMACErrors validates the settings shared by HMAC verification and
+// signing.
+func collectHMACErrors(signatureHeader string, secret string, algorithm string) (problems validationErrors) {
+	if signatureHeader == "" {
+		problems.add("signature_header", errors.New("signature_header is required"))
+	}
+
+	if secret == "" {
+		problems.add("secret", errors.New("secret is required"))
+	}
 
-	// DisableKeepAlives disables HTTP keep-alives
-	DisableKeepAlives bool
+	var err error
+	err = validateHMACAlgorithm(algorithm)
+	if err != nil {
+		problems.add("algorithm", err)
+	}
 
-	// DisableCompression disables transparent compression
-	DisableCompression bool
+	return problems
 }
 
-// TLSConfig configures TLS settings.
-type TLSConfig struct {
-	// CertFile is the path to the TLS certificate for downstream (client) connections
-	CertFile string
+// validateHMACAlgorithm checks that algorithm names a supported HMAC hash.
+func validateHMACAlgorithm(algorithm string) (err error) {
+	switch algorithm {
+	case "", HMACAlgorithmSHA256, HMACAlgorithmSHA512:
+	default:
+		err = fmt.Errorf("algorithm must be 'sha256' or 'sha512': %s", algorithm)
+	}
+	return err
+}
 
-	// KeyFile is the path to the TLS private key for downstream connections
-	KeyFile string
+// Validate validates canary settings.
+func (c *CanaryConfig) Validate() (err error) {
+	err = c.collectErrors().err()
+	return err
+}
 
-	// CAFile is the path to CA certificates for verifying upstream servers
-	CAFile string
+// collectErrors validates canary settings.
+func (c *CanaryConfig) collectErrors() (problems validationErrors) {
+	var canaryURL *url.URL
+	var err error
+	canaryURL, err = url.Parse(c.Upstream)
+	if err != nil {
+		problems.add("upstream", fmt.Errorf("invalid canary upstream URL: %w", err))
+	} else if (canaryURL.Scheme != SchemeHTTP && canaryURL.Scheme != SchemeHTTPS) || canaryURL.Hostname() == "" {
+		problems.add("upstream", fmt.Errorf("canary upstream must be an http or https URL: %s", c.Upstream))
+	}
 
-	// InsecureSkipVerify disables upstream TLS verification (NOT RECOMMENDED)
-	InsecureSkipVerify bool
+	if c.Percentage < 0 || c.Percentage > 100 {
+		problems.add("percentage", fmt.Errorf("percentage must be between 0 and 100: %g", c.Percentage))
+	}
 
-	// MinVersion is the minimum TLS version (e.g., "1.2", "1.3")
-	MinVersion string
+	return problems
+}
 
-	// CipherSuites is the list of enabled cipher suites
-	CipherSuites []string
+// Validate validates idempotency settings.
+func (c *IdempotencyConfig) Validate() (err error) {
+	err = c.collectErrors().err()
+	return err
 }
 
-// MetricsConfig configures Prometheus metrics.
-type MetricsConfig struct {
-	// Enabled controls whether metrics are collected
-	Enabled bool
+// collectErrors validates idempotency settings.
+func (c *IdempotencyConfig) collectErrors() (problems validationErrors) {
+	if c.HeaderName != "" && strings.ContainsFunc(c.HeaderName, isNotTokenChar) {
+		problems.add("header_name", fmt.Errorf("header_name is not a valid header name: %q", c.HeaderName))
+	}
 
-	// Path is the HTTP path for the metrics endpoint (default: "/metrics")
-	Path string
+	if c.TTL < 0 {
+		problems.add("ttl", fmt.Errorf("ttl must not be negative: %s", c.TTL))
+	}
 
-	// Port is the port for the metrics server (if different from main server)
-	Port int
+	return problems
+}
 
-	// Namespace is the Prometheus namespace (default: "mimic_proxy")
-	Namespace string
+// Validate validates rate limit settings.
+func (l *RateLimitConfig) Validate() (err error) {
+	err = l.collectErrors().err()
+	return err
 }
 
-// LoggerConfig configures structured logging.
-type LoggerConfig struct {
-	// Level is the log level: "debug", "info", "warn", "error"
-	Level string
+// collectErrors validates rate limit settings.
+func (l *RateLimitConfig) collectErrors() (problems validationErrors) {
+	if l.RequestsPerSecond <= 0 {
+		problems.add("requests_per_second", fmt.Errorf("requests_per_second must be positive: %g", l.RequestsPerSecond))
+	}
 
-	// Format is the log format: "json" or "text"
-	Format string
+	if l.Burst < 0 {
+		problems.add("burst", fmt.Errorf("burst must not be negative: %d", l.Burst))
+	}
 
-	// Output is where to write logs: "stdout", "stderr", or a file path
-	Output string
+	return problems
 }
 
-// Validate validates the configuration and returns an error if invalid.
-func (c *Config) Validate() (err error) {
-	if len(c.Routes) == 0 {
-		err = errors.New("at least one route is required")
-		return err
-	}
+// Validate validates OAuth2 client-credentials settings.
+func (o *OAuth2Config) Validate() (err error) {
+	err = o.collectErrors().err()
+	return err
+}
 
-	// Validate each route
-	for i, route := range c.Routes {
-		err = route.Validate()
+// collectErrors validates OAuth2 client-credentials settings.
+func (o *OAuth2Config) collectErrors() (problems validationErrors) {
+	if o.TokenURL == "" {
+		problems.add("token_url", errors.New("token_url is required"))
+	} else {
+		var tokenURL *url.URL
+		var err error
+		tokenURL, err = url.Parse(o.TokenURL)
 		if err != nil {
-			err = fmt.Errorf("route %d (%s): %w", i, route.Name, err)
-			return err
+			problems.add("token_url", fmt.Errorf("invalid token_url: %w", err))
+		} else if (tokenURL.Scheme != SchemeHTTP && tokenURL.Scheme != SchemeHTTPS) || tokenURL.Host == "" {
+			problems.add("token_url", fmt.Errorf("token_url must be an http or https URL: %s", o.TokenURL))
 		}
 	}
 
-	// Check for conflicting route paths
-	err = c.checkConflictingRoutes()
-	if err != nil {
-		return err
+	if o.ClientID == "" {
+		problems.add("client_id", errors.New("client_id is required"))
 	}
 
-	// Validate TLS configuration if provided
-	if c.TLS.CertFile != "" || c.TLS.KeyFile != "" {
-		err = c.TLS.Validate()
+	if o.ClientSecret == "" {
+		problems.add("client_secret", errors.New("client_secret is required"))
+	}
+
+	return problems
+}
+
+// collectErrors validates a static response, optionally checking that
+// BodyFile exists.
+func (s *StaticResponseConfig) collectErrors(checkFiles bool) (problems validationErrors) {
+	if s.StatusCode != 0 && (s.StatusCode < 200 || s.StatusCode > 599) {
+		problems.add("status_code", fmt.Errorf("status_code must be between 200 and 599: %d", s.StatusCode))
+	}
+
+	if s.Body != "" && s.BodyFile != "" {
+		problems.add("body_file", errors.New("body and body_file are mutually exclusive"))
+	}
+
+	if checkFiles {
+		var err error
+		err = validateFile(s.BodyFile, "body_file")
 		if err != nil {
-			err = fmt.Errorf("TLS configuration: %w", err)
-			return err
+			problems.add("body_file", err)
 		}
 	}
 
+	return problems
+}
+
+// Validate validates header configuration.
+func (h *HeaderConfig) Validate() (err error) {
+	err = h.collectErrors(true).err()
 	return err
 }
 
-// Validate validates a route configuration.
-func (r *RouteConfig) Validate() (err error) {
-	if r.Name == "" {
-		err = errors.New("route name is required")
-		return err
+// collectErrors validates header configuration, optionally checking value
+// files. Header rules are checked in header name order.
+func (h *HeaderConfig) collectErrors(checkFiles bool) (problems validationErrors) {
+	var err error
+
+	// Check for environment variables and value files in added and appended headers
+	valueRules := []struct {
+		name   string
+		values map[string]string
+	}{
+		{"add_upstream", h.AddUpstream},
+		{"add_downstream", h.AddDownstream},
+		{"append_upstream", h.AppendUpstream},
+		{"append_downstream", h.AppendDownstream},
+	}
+	for _, rule := range valueRules {
+		for _, key := range slices.Sorted(maps.Keys(rule.values)) {
+			err = checkHeaderValue(key, rule.values[key], checkFiles)
+			if err != nil {
+				problems.add(rule.name+"."+key, err)
+			}
+		}
 	}
 
-	if r.PathPrefix == "" {
-		err = errors.New("path_prefix is required")
-		return err
+	for _, key := range slices.Sorted(maps.Keys(h.RewriteIncoming)) {
+		_, err = regexp.Compile(h.RewriteIncoming[key].Pattern)
+		if err != nil {
+			problems.add("rewrite_incoming."+key, fmt.Errorf("rewrite_incoming %s: invalid pattern: %w", key, err))
+		}
 	}
 
-	if !strings.HasPrefix(r.PathPrefix, "/") {
-		err = fmt.Errorf("path_prefix must start with /: %s", r.PathPrefix)
-		return err
+	for _, key := range slices.Sorted(maps.Keys(h.RewriteOutgoing)) {
+		_, err = regexp.Compile(h.RewriteOutgoing[key].Pattern)
+		if err != nil {
+			problems.add("rewrite_outgoing."+key, fmt.Errorf("rewrite_outgoing %s: invalid pattern: %w", key, err))
+		}
 	}
 
-	if r.Upstream == "" {
-		err = errors.New("upstream is required")
-		return err
+	if h.FileRefreshInterval < 0 {
+		problems.add("file_refresh_interval", fmt.Errorf("file_refresh_interval must not be negative: %s", h.FileRefreshInterval))
 	}
 
-	// Validate upstream URL
-	var upstreamURL *url.URL
-	upstreamURL, err = url.Parse(r.Upstream)
-	if err != nil {
-		err = fmt.Errorf("invalid upstream URL: %w", err)
-		return err
+	return problems
+}
+
+// metricLabelNamePattern matches a Prometheus label name.
+var metricLabelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// reservedMetricLabels are the labels the proxy's own metrics use, which
+// MetricLabelName may not shadow.
+//
+//nolint:gochecknoglobals // Read-only lookup table.
+var reservedMetricLabels = []string{LabelRoute, LabelMethod, LabelStatusCode, LabelRedirectType, LabelErrorClass, LabelErrorReason, LabelCanaryVariant, LabelUpstream}
+
+// essentialHeaders are headers whose removal breaks requests or responses in
+// confusing ways.
+//
+//nolint:gochecknoglobals // Read-only lookup table.
+var essentialHeaders = []string{"Host", "Content-Length", "Content-Type", "Connection"}
+
+// strippedEssentialHeader returns the first strip pattern matching an
+// essential header, and that header, if any.
+func strippedEssentialHeader(patterns []string) (pattern string, header string) {
+	for _, candidate := range patterns {
+		for _, essential := range essentialHeaders {
+			if matchesPattern(essential, candidate) {
+				pattern, header = candidate, essential
+				return pattern, header
+			}
+		}
 	}
+	return pattern, header
+}
 
-	if upstreamURL.Scheme != SchemeHTTP && upstreamURL.Scheme != SchemeHTTPS {
-		err = fmt.Errorf("upstream URL must use http or https scheme: %s", r.Upstream)
-		return err
+// collectEssentialHeaderErrors reports strip patterns matching an essential
+// header.
+func (h *HeaderConfig) collectEssentialHeaderErrors() (problems validationErrors) {
+	pattern, header := strippedEssentialHeader(h.StripIncoming)
+	if pattern != "" {
+		problems.add("strip_incoming", fmt.Errorf("strip_incoming pattern %s matches essential header %s", pattern, header))
 	}
 
-	// Validate TLS mode
-	if r.TLSMode != "" && r.TLSMode != "terminate" && r.TLSMode != "passthrough" {
-		err = fmt.Errorf("tls_mode must be 'terminate' or 'passthrough': %s", r.TLSMode)
-		return err
+	pattern, header = strippedEssentialHeader(h.StripOutgoing)
+	if pattern != "" {
+		problems.add("strip_outgoing", fmt.Errorf("strip_outgoing pattern %s matches essential header %s", pattern, header))
 	}
 
-	// Validate redirect base URL if provided
-	if r.RedirectBaseURL != "" {
-		var baseURL *url.URL
-		baseURL, err = url.Parse(r.RedirectBaseURL)
-		if err != nil {
-			err = fmt.Errorf("invalid redirect_base_url: %w", err)
-			return err
-		}
-		if baseURL.Scheme == "" || baseURL.Host == "" {
-			err = fmt.Errorf("redirect_base_url must include scheme and host: %s", r.RedirectBaseURL)
-			return err
+	return problems
+}
+
+// collectForbiddenValueErrors reports added and appended header values that
+// resolve to a placeholder in forbidden, or to a value still containing a
+// ${...} reference. A nil forbidden list uses DefaultForbiddenHeaderValues.
+// @file: values are only read when checking files.
+func (h *HeaderConfig) collectForbiddenValueErrors(forbidden []string, checkFiles bool) (problems validationErrors) {
+	if forbidden == nil {
+		forbidden = DefaultForbiddenHeaderValues
+	}
+
+	var err error
+	valueRules := []struct {
+		name   string
+		values map[string]string
+	}{
+		{"add_upstream", h.AddUpstream},
+		{"add_downstream", h.AddDownstream},
+		{"append_upstream", h.AppendUpstream},
+		{"append_downstream", h.AppendDownstream},
+	}
+	for _, rule := range valueRules {
+		for _, key := range slices.Sorted(maps.Keys(rule.values)) {
+			value := rule.values[key]
+
+			var resolved string
+			if strings.HasPrefix(value, FileValuePrefix) {
+				if !checkFiles {
+					continue
+				}
+
+				// An unreadable file is reported by checkHeaderValue
+				var content []byte
+				content, err = os.ReadFile(strings.TrimPrefix(value, FileValuePrefix))
+				if err != nil {
+					continue
+				}
+				resolved = strings.TrimSpace(string(content))
+			} else {
+				resolved = expandEnvVars(value)
+			}
+
+			err = checkResolvedHeaderValue(key, resolved, forbidden)
+			if err != nil {
+				problems.add(rule.name+"."+key, err)
+			}
 		}
 	}
 
-	// Validate header configuration
-	err = r.Headers.Validate()
-	if err != nil {
-		err = fmt.Errorf("headers: %w", err)
+	return problems
+}
+
+// checkResolvedHeaderValue verifies that an expanded header value is neither
+// a placeholder in forbidden nor still holding a ${...} reference. The value
+// itself is left out of errors, since it may be a secret.
+func checkResolvedHeaderValue(key, resolved string, forbidden []string) (err error) {
+	start := strings.Index(resolved, "${")
+	if start != -1 && strings.Contains(resolved[start:], "}") {
+		err = fmt.Errorf("header %s: value still contains an unexpanded ${...} reference after expansion", key)
 		return err
 	}
 
+	for _, word := range append([]string{resolved}, strings.Fields(resolved)...) {
+		for _, placeholder := range forbidden {
+			if strings.EqualFold(word, placeholder) {
+				err = fmt.Errorf("header %s: value is the placeholder %q", key, placeholder)
+				return err
+			}
+		}
+	}
+
 	return err
 }
 
-// Validate validates header configuration.
-func (h *HeaderConfig) Validate() (err error) {
-	// Check for environment variables in AddUpstream and AddDownstream
-	for key, value := range h.AddUpstream {
-		err = checkEnvVars(key, value)
-		if err != nil {
+// checkHeaderValue verifies that a header value's source is available: the file
+// for @file: values, or the referenced environment variables otherwise.
+func checkHeaderValue(key, value string, checkFiles bool) (err error) {
+	if strings.HasPrefix(value, FileValuePrefix) {
+		path := strings.TrimPrefix(value, FileValuePrefix)
+		if path == "" {
+			err = fmt.Errorf("header %s: empty file path in %s reference", key, FileValuePrefix)
 			return err
 		}
-	}
 
-	for key, value := range h.AddDownstream {
-		err = checkEnvVars(key, value)
-		if err != nil {
-			return err
+		if checkFiles {
+			err = checkValueFile(key, path)
 		}
+		return err
+	}
+
+	err = checkEnvVars(key, value)
+	return err
+}
+
+// checkValueFile verifies that a header value file exists and is readable.
+func checkValueFile(key, path string) (err error) {
+	var file *os.File
+	file, err = os.Open(path)
+	if err != nil {
+		err = fmt.Errorf("header %s: value file not readable: %w", key, err)
+		return err
+	}
+	defer file.Close()
+
+	var info os.FileInfo
+	info, err = file.Stat()
+	if err != nil {
+		err = fmt.Errorf("header %s: value file not readable: %w", key, err)
+		return err
+	}
+
+	if info.IsDir() {
+		err = fmt.Errorf("header %s: value file is a directory: %s", key, path)
+		return err
 	}
 
 	return err
@@ -329,48 +1940,149 @@ func checkEnvVars(key, value string) (err error) {
 	return err
 }
 
+// Validate validates metrics configuration.
+func (m *MetricsConfig) Validate() (err error) {
+	err = m.collectErrors().err()
+	return err
+}
+
+// collectErrors validates metrics configuration.
+func (m *MetricsConfig) collectErrors() (problems validationErrors) {
+	var err error
+	err = validateBuckets(m.DurationBuckets, "duration_buckets")
+	if err != nil {
+		problems.add("duration_buckets", err)
+	}
+
+	err = validateBuckets(m.UpstreamDurationBuckets, "upstream_duration_buckets")
+	if err != nil {
+		problems.add("upstream_duration_buckets", err)
+	}
+
+	return problems
+}
+
+// Validate validates logger configuration.
+func (l *LoggerConfig) Validate() (err error) {
+	err = l.collectErrors().err()
+	return err
+}
+
+// collectErrors validates logger configuration.
+func (l *LoggerConfig) collectErrors() (problems validationErrors) {
+	if l.SampleRate < 0 || l.SampleRate > 1 {
+		problems.add("sample_rate", fmt.Errorf("sample_rate must be between 0.0 and 1.0: %g", l.SampleRate))
+	}
+
+	return problems
+}
+
+// validateProxyURL validates a forward proxy URL.
+func validateProxyURL(rawURL, name string) (err error) {
+	var proxyURL *url.URL
+	proxyURL, err = url.Parse(rawURL)
+	if err != nil {
+		err = fmt.Errorf("invalid %s: %w", name, err)
+		return err
+	}
+
+	switch proxyURL.Scheme {
+	case SchemeHTTP, SchemeHTTPS, "socks5":
+	default:
+		err = fmt.Errorf("%s must use http, https, or socks5 scheme: %s", name, rawURL)
+		return err
+	}
+
+	if proxyURL.Host == "" {
+		err = fmt.Errorf("%s must include a host: %s", name, rawURL)
+		return err
+	}
+
+	return err
+}
+
+// validateBuckets validates that histogram buckets are strictly increasing.
+func validateBuckets(buckets []float64, name string) (err error) {
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			err = fmt.Errorf("%s must be in strictly increasing order: %v", name, buckets)
+			return err
+		}
+	}
+
+	return err
+}
+
 // Validate validates TLS configuration.
 func (t *TLSConfig) Validate() (err error) {
+	err = t.collectErrors(true).err()
+	return err
+}
+
+// collectErrors validates TLS configuration, optionally checking that files
+// exist.
+func (t *TLSConfig) collectErrors(checkFiles bool) (problems validationErrors) {
+	var err error
+
 	if t.CertFile != "" && t.KeyFile == "" {
-		err = errors.New("cert_file specified but key_file is missing")
-		return err
+		problems.add("key_file", errors.New("cert_file specified but key_file is missing"))
 	}
 
 	if t.KeyFile != "" && t.CertFile == "" {
-		err = errors.New("key_file specified but cert_file is missing")
-		return err
+		problems.add("cert_file", errors.New("key_file specified but cert_file is missing"))
 	}
 
 	// Check if files exist
-	err = validateTLSFile(t.CertFile, "cert_file")
-	if err != nil {
-		return err
+	if checkFiles {
+		files := []struct {
+			name string
+			path string
+		}{
+			{"cert_file", t.CertFile},
+			{"key_file", t.KeyFile},
+			{"ca_file", t.CAFile},
+			{"client_ca_file", t.ClientCAFile},
+		}
+		for _, file := range files {
+			err = validateFile(file.path, file.name)
+			if err != nil {
+				problems.add(file.name, err)
+			}
+		}
 	}
 
-	err = validateTLSFile(t.KeyFile, "key_file")
-	if err != nil {
-		return err
+	// Validate downstream client certificate verification
+	switch t.ClientAuth {
+	case "", ClientAuthNone:
+	case ClientAuthVerifyIfGiven, ClientAuthRequireAndVerify:
+		if t.ClientCAFile == "" {
+			problems.add("client_ca_file", fmt.Errorf("client_auth '%s' requires client_ca_file", t.ClientAuth))
+		}
+	default:
+		problems.add("client_auth", fmt.Errorf("client_auth must be 'none', 'verify_if_given', or 'require_and_verify': %s", t.ClientAuth))
 	}
 
-	err = validateTLSFile(t.CAFile, "ca_file")
-	if err != nil {
-		return err
+	if t.ClientCAFile != "" && t.CertFile == "" {
+		problems.add("cert_file", errors.New("client_ca_file requires cert_file and key_file"))
+	}
+
+	if t.CertReloadInterval < 0 {
+		problems.add("cert_reload_interval", fmt.Errorf("cert_reload_interval must not be negative: %s", t.CertReloadInterval))
 	}
 
 	// Validate TLS version
 	if t.MinVersion != "" {
 		err = parseTLSVersion(t.MinVersion)
 		if err != nil {
-			err = fmt.Errorf("min_version: %w", err)
-			return err
+			problems.add("min_version", fmt.Errorf("min_version: %w", err))
 		}
 	}
 
-	return err
+	return problems
 }
 
-// validateTLSFile validates that a TLS file exists and is not a directory.
-func validateTLSFile(path, name string) (err error) {
+// validateFile validates that a configured file exists and is not a directory.
+func validateFile(path, name string) (err error) {
 	if path == "" {
 		return err
 	}
@@ -401,21 +2113,35 @@ func parseTLSVersion(version string) (err error) {
 	}
 }
 
-// checkConflictingRoutes checks for conflicting route paths.
-func (c *Config) checkConflictingRoutes() (err error) {
+// collectConflictingRouteErrors reports routes whose path prefixes conflict.
+// Each conflict is reported against the later route's path_prefix.
+func (c *Config) collectConflictingRouteErrors() (problems validationErrors) {
 	seen := make(map[string]string)
 
-	for _, route := range c.Routes {
+	for i, route := range c.Routes {
 		// Check exact match
 		if existingRoute, exists := seen[route.PathPrefix]; exists {
-			err = fmt.Errorf("conflicting routes: %s and %s both use path_prefix: %s",
-				existingRoute, route.Name, route.PathPrefix)
-			return err
+			problems.add(fmt.Sprintf("routes[%d].path_prefix", i), fmt.Errorf("conflicting routes: %s and %s both use path_prefix: %s",
+				existingRoute, route.Name, route.PathPrefix))
+			continue
 		}
 		seen[route.PathPrefix] = route.Name
 	}
 
-	return err
+	// Case-insensitive routes also conflict with prefixes differing only in case
+	for i, route := range c.Routes {
+		for j, other := range c.Routes[i+1:] {
+			if route.PathPrefix == other.PathPrefix {
+				continue
+			}
+			if (route.CaseInsensitivePath || other.CaseInsensitivePath) && strings.EqualFold(route.PathPrefix, other.PathPrefix) {
+				problems.add(fmt.Sprintf("routes[%d].path_prefix", i+1+j), fmt.Errorf("conflicting routes: %s and %s both match path_prefix %s case-insensitively",
+					route.Name, other.Name, route.PathPrefix))
+			}
+		}
+	}
+
+	return problems
 }
 
 // DefaultTransportConfig returns default transport configuration.
@@ -430,6 +2156,7 @@ func DefaultTransportConfig() (config TransportConfig) {
 		ExpectContinueTimeout: 1 * time.Second,
 		DisableKeepAlives:     false,
 		DisableCompression:    false,
+		TLSSessionCacheSize:   DefaultTLSSessionCacheSize,
 	}
 	return config
 }
@@ -445,12 +2172,37 @@ func DefaultMetricsConfig() (config MetricsConfig) {
 	return config
 }
 
+// DefaultCompressContentTypes returns the media types compressed by default:
+// text, JSON, JavaScript, XML, and SVG.
+func DefaultCompressContentTypes() (contentTypes []string) {
+	contentTypes = []string{
+		"text/*",
+		"application/json",
+		"application/javascript",
+		"application/xml",
+		"image/svg+xml",
+	}
+	return contentTypes
+}
+
+// DefaultUpstreamHeaderTrimOrder returns the headers the "trim" policy drops
+// by default: the forwarding chains that accumulate across proxies.
+func DefaultUpstreamHeaderTrimOrder() (patterns []string) {
+	patterns = []string{
+		"Forwarded",
+		"X-Forwarded-*",
+		"Via",
+	}
+	return patterns
+}
+
 // DefaultLoggerConfig returns default logger configuration.
 func DefaultLoggerConfig() (config LoggerConfig) {
 	config = LoggerConfig{
-		Level:  "info",
-		Format: "json",
-		Output: "stdout",
+		Level:      "info",
+		Format:     "json",
+		Output:     "stdout",
+		SampleRate: 1.0,
 	}
 	return config
 }
@@ -459,6 +2211,10 @@ func DefaultLoggerConfig() (config LoggerConfig) {
 func (c *Config) ApplyDefaults() {
 	if c.Transport.MaxIdleConns == 0 {
 		defaults := DefaultTransportConfig()
+		defaults.UpstreamProxyURL = c.Transport.UpstreamProxyURL
+		if c.Transport.TLSSessionCacheSize != 0 {
+			defaults.TLSSessionCacheSize = c.Transport.TLSSessionCacheSize
+		}
 		c.Transport = defaults
 	}
 
@@ -482,13 +2238,88 @@ func (c *Config) ApplyDefaults() {
 		c.Logger.Output = "stdout"
 	}
 
+	if c.BodyBufferMaxBytes == 0 {
+		c.BodyBufferMaxBytes = DefaultBodyBufferMaxBytes
+	}
+
+	if c.MaxRedirectRewrites == 0 {
+		c.MaxRedirectRewrites = DefaultMaxRedirectRewrites
+	}
+
+	if c.Logger.SampleRate == 0 {
+		c.Logger.SampleRate = 1.0
+	}
+
+	if c.ForbiddenHeaderValues == nil {
+		c.ForbiddenHeaderValues = slices.Clone(DefaultForbiddenHeaderValues)
+	}
+
 	// Apply defaults to routes
 	for _, route := range c.Routes {
-		if route.TLSMode == "" {
-			route.TLSMode = "terminate"
-		}
-		if route.Timeout == 0 {
-			route.Timeout = 30 * time.Second
+		route.applyDefaults()
+	}
+}
+
+// applyDefaults applies default values to a route configuration.
+func (r *RouteConfig) applyDefaults() {
+	if r.Upstream == "" && len(r.Upstreams) > 0 {
+		r.Upstream = r.Upstreams[0]
+	}
+	if len(r.Upstreams) > 0 && r.Balancer == "" {
+		r.Balancer = BalancerRoundRobin
+	}
+	if r.TLSMode == "" {
+		r.TLSMode = "terminate"
+	}
+	if r.TrailingSlash == "" {
+		r.TrailingSlash = TrailingSlashPreserve
+	}
+	if r.ForwardedHeaders == "" {
+		r.ForwardedHeaders = ForwardedHeadersStrip
+	}
+	if r.Protocol == "" {
+		r.Protocol = ProtocolHTTP
+	}
+	if r.AddViaHeader && r.ViaPseudonym == "" {
+		r.ViaPseudonym = DefaultViaPseudonym
+	}
+	if r.Idempotency != nil && r.Idempotency.HeaderName == "" {
+		r.Idempotency.HeaderName = DefaultIdempotencyHeader
+	}
+	if r.Idempotency != nil && r.Idempotency.TTL == 0 {
+		r.Idempotency.TTL = DefaultIdempotencyTTL
+	}
+	if r.MirrorUpstream != "" && r.MirrorSampleRate == 0 {
+		r.MirrorSampleRate = 1.0
+	}
+	if r.CompressResponses && len(r.CompressContentTypes) == 0 {
+		r.CompressContentTypes = DefaultCompressContentTypes()
+	}
+	if r.CompressResponses && r.CompressMinSize == 0 {
+		r.CompressMinSize = DefaultCompressMinSize
+	}
+	if r.MaxUpstreamHeaderBytes > 0 && r.UpstreamHeaderLimitPolicy == "" {
+		r.UpstreamHeaderLimitPolicy = HeaderLimitReject
+	}
+	if r.UpstreamHeaderLimitPolicy == HeaderLimitTrim && len(r.UpstreamHeaderTrimOrder) == 0 {
+		r.UpstreamHeaderTrimOrder = DefaultUpstreamHeaderTrimOrder()
+	}
+	if r.StaticResponse != nil && r.StaticResponse.StatusCode == 0 {
+		r.StaticResponse.StatusCode = http.StatusServiceUnavailable
+	}
+	if r.VerifyHMAC != nil && r.VerifyHMAC.Algorithm == "" {
+		r.VerifyHMAC.Algorithm = HMACAlgorithmSHA256
+	}
+	if r.SignRequests != nil && r.SignRequests.Algorithm == "" {
+		r.SignRequests.Algorithm = HMACAlgorithmSHA256
+	}
+	if r.AuthStrategy == "" {
+		r.AuthStrategy = AuthStrategyReplace
+		if r.PreserveClientAuth {
+			r.AuthStrategy = AuthStrategyInjectIfAbsent
 		}
 	}
+	if r.RequestTimeout == 0 {
+		r.RequestTimeout = r.Timeout
+	}
 }
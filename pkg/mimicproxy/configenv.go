@@ -0,0 +1,396 @@
+package mimicproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// envFieldNames overrides the environment variable names of fields whose
+// upper snake case form reads badly.
+//
+//nolint:gochecknoglobals // Read-only lookup table.
+var envFieldNames = map[string]string{
+	"Routes": "ROUTE",
+	"OAuth2": "OAUTH2",
+}
+
+// LoadConfigFromEnv builds a Config from environment variables starting with
+// prefix and an underscore, applies defaults, and validates it.
+//
+// Each field is named by its upper snake case name, with nested sections
+// joined by underscores:
+//
+//	MIMIC_MAX_HEADER_BYTES=65536
+//	MIMIC_TRANSPORT_DIAL_TIMEOUT=5s
+//	MIMIC_GLOBAL_RATE_LIMIT_REQUESTS_PER_SECOND=100
+//
+// Routes, and other lists of sections, are numbered from 0 and end at the
+// first missing index:
+//
+//	MIMIC_ROUTE_0_NAME=api
+//	MIMIC_ROUTE_0_PATH_PREFIX=/api
+//	MIMIC_ROUTE_0_UPSTREAM=https://api.example.com
+//	MIMIC_ROUTE_0_REQUEST_REWRITE_0_TARGET=header.Authorization
+//
+// Lists of values are comma-separated, durations use time.ParseDuration, and
+// booleans strconv.ParseBool. Map entries put the key after the map's name;
+// header names are written with underscores for dashes:
+//
+//	MIMIC_ROUTE_0_HEADERS_ADD_UPSTREAM_X_API_KEY=${API_KEY}
+//	MIMIC_ROUTE_0_STATUS_CODE_MAP_404=200
+//
+// A variable under the prefix that names no field is an error, so a typo is
+// not silently ignored. Fields holding functions, such as body transforms,
+// cannot be set from the environment.
+func LoadConfigFromEnv(prefix string) (config *Config, err error) {
+	prefix = strings.TrimSuffix(prefix, "_")
+	if prefix == "" {
+		err = errors.New("environment variable prefix is required")
+		return config, err
+	}
+
+	loader := &envLoader{
+		vars: make(map[string]string),
+		used: make(map[string]bool),
+	}
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		if strings.HasPrefix(name, prefix+"_") {
+			loader.vars[name] = value
+		}
+	}
+
+	config = &Config{}
+	err = loader.loadStruct(reflect.ValueOf(config).Elem(), prefix)
+	if err != nil {
+		return config, err
+	}
+
+	var unknown []string
+	for name := range loader.vars {
+		if !loader.used[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+		err = fmt.Errorf("unknown environment variables: %s", strings.Join(unknown, ", "))
+		return config, err
+	}
+
+	config.ApplyDefaults()
+
+	err = config.Validate()
+	if err != nil {
+		err = fmt.Errorf("configuration validation failed: %w", err)
+		return config, err
+	}
+
+	return config, err
+}
+
+// envLoader sets configuration fields from environment variables.
+type envLoader struct {
+	// vars are the environment variables under the prefix
+	vars map[string]string
+
+	// used records the variables that set a field
+	used map[string]bool
+}
+
+// lookup returns the variable called name, marking it used.
+func (l *envLoader) lookup(name string) (value string, ok bool) {
+	value, ok = l.vars[name]
+	if ok {
+		l.used[name] = true
+	}
+	return value, ok
+}
+
+// has reports whether any variable belongs to the section called name.
+func (l *envLoader) has(name string) (found bool) {
+	for key := range l.vars {
+		if strings.HasPrefix(key, name+"_") {
+			found = true
+			return found
+		}
+	}
+	return found
+}
+
+// loadStruct sets the fields of the struct value from the variables of the
+// section called name.
+func (l *envLoader) loadStruct(value reflect.Value, name string) (err error) {
+	structType := value.Type()
+	for i := range structType.NumField() {
+		field := structType.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		err = l.loadField(value.Field(i), name+"_"+envFieldName(field.Name))
+		if err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// loadField sets value from the variable, or section, called name.
+func (l *envLoader) loadField(value reflect.Value, name string) (err error) {
+	switch value.Kind() {
+	case reflect.Struct:
+		err = l.loadStruct(value, name)
+
+	case reflect.Pointer:
+		// Optional sections are only allocated when configured
+		if value.Type().Elem().Kind() != reflect.Struct || !l.has(name) {
+			return err
+		}
+		section := reflect.New(value.Type().Elem())
+		err = l.loadStruct(section.Elem(), name)
+		value.Set(section)
+
+	case reflect.Slice:
+		err = l.loadSlice(value, name)
+
+	case reflect.Map:
+		err = l.loadMap(value, name)
+
+	case reflect.Func:
+		// Functions can only be set in code
+
+	default:
+		raw, ok := l.lookup(name)
+		if !ok {
+			return err
+		}
+		err = setEnvValue(value, raw)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return err
+}
+
+// loadSlice sets a list of sections from numbered sections, or a list of
+// values from one comma-separated variable.
+func (l *envLoader) loadSlice(value reflect.Value, name string) (err error) {
+	elemType := value.Type().Elem()
+	sectionType := elemType
+	if sectionType.Kind() == reflect.Pointer {
+		sectionType = sectionType.Elem()
+	}
+
+	if sectionType.Kind() == reflect.Struct {
+		for i := 0; l.has(name + "_" + strconv.Itoa(i)); i++ {
+			section := reflect.New(sectionType)
+			err = l.loadStruct(section.Elem(), name+"_"+strconv.Itoa(i))
+			if err != nil {
+				return err
+			}
+			if elemType.Kind() != reflect.Pointer {
+				section = section.Elem()
+			}
+			value.Set(reflect.Append(value, section))
+		}
+		return err
+	}
+
+	raw, ok := l.lookup(name)
+	if !ok {
+		return err
+	}
+
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		elem := reflect.New(elemType).Elem()
+		err = setEnvValue(elem, item)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", name, err)
+			return err
+		}
+		value.Set(reflect.Append(value, elem))
+	}
+	return err
+}
+
+// loadMap sets the entries of a map from the variables named after it, each
+// naming its key, and for maps of sections the field, after the map's name.
+func (l *envLoader) loadMap(value reflect.Value, name string) (err error) {
+	mapType := value.Type()
+	elemType := mapType.Elem()
+
+	var names []string
+	for key := range l.vars {
+		if strings.HasPrefix(key, name+"_") {
+			names = append(names, key)
+		}
+	}
+	slices.Sort(names)
+
+	sections := make(map[string]reflect.Value)
+	for _, varName := range names {
+		rest := strings.TrimPrefix(varName, name+"_")
+
+		var elem reflect.Value
+		var keyName string
+		if elemType.Kind() == reflect.Struct {
+			// The key is whatever precedes a field name of the section
+			var field string
+			for i := range elemType.NumField() {
+				suffix := "_" + envFieldName(elemType.Field(i).Name)
+				if strings.HasSuffix(rest, suffix) && len(rest) > len(suffix) {
+					field = elemType.Field(i).Name
+					keyName = strings.TrimSuffix(rest, suffix)
+					break
+				}
+			}
+			if field == "" {
+				continue
+			}
+
+			section, ok := sections[keyName]
+			if !ok {
+				section = reflect.New(elemType).Elem()
+				sections[keyName] = section
+			}
+			elem = section.FieldByName(field)
+		} else {
+			keyName = rest
+			elem = reflect.New(elemType).Elem()
+		}
+
+		raw, _ := l.lookup(varName)
+		err = setEnvValue(elem, raw)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", varName, err)
+			return err
+		}
+
+		if elemType.Kind() != reflect.Struct {
+			err = setEnvMapEntry(value, keyName, elem)
+			if err != nil {
+				err = fmt.Errorf("%s: %w", varName, err)
+				return err
+			}
+		}
+	}
+
+	for keyName, section := range sections {
+		err = setEnvMapEntry(value, keyName, section)
+		if err != nil {
+			err = fmt.Errorf("%s_%s: %w", name, keyName, err)
+			return err
+		}
+	}
+	return err
+}
+
+// setEnvMapEntry stores elem in the map value under the key written as keyName.
+// String keys are header names, with underscores standing in for dashes.
+func setEnvMapEntry(value reflect.Value, keyName string, elem reflect.Value) (err error) {
+	if value.IsNil() {
+		value.Set(reflect.MakeMap(value.Type()))
+	}
+
+	key := reflect.New(value.Type().Key()).Elem()
+	if key.Kind() == reflect.String {
+		key.SetString(http.CanonicalHeaderKey(strings.ReplaceAll(keyName, "_", "-")))
+	} else {
+		err = setEnvValue(key, keyName)
+		if err != nil {
+			return err
+		}
+	}
+
+	value.SetMapIndex(key, elem)
+	return err
+}
+
+// setEnvValue parses raw into value, a string, bool, number, or duration.
+func setEnvValue(value reflect.Value, raw string) (err error) {
+	if value.Type() == reflect.TypeFor[time.Duration]() {
+		var duration time.Duration
+		duration, err = time.ParseDuration(raw)
+		if err != nil {
+			err = fmt.Errorf("invalid duration: %s", raw)
+			return err
+		}
+		value.SetInt(int64(duration))
+		return err
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+
+	case reflect.Bool:
+		var parsed bool
+		parsed, err = strconv.ParseBool(raw)
+		if err != nil {
+			err = fmt.Errorf("invalid boolean: %s", raw)
+			return err
+		}
+		value.SetBool(parsed)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var parsed int64
+		parsed, err = strconv.ParseInt(raw, 10, value.Type().Bits())
+		if err != nil {
+			err = fmt.Errorf("invalid integer: %s", raw)
+			return err
+		}
+		value.SetInt(parsed)
+
+	case reflect.Float32, reflect.Float64:
+		var parsed float64
+		parsed, err = strconv.ParseFloat(raw, value.Type().Bits())
+		if err != nil {
+			err = fmt.Errorf("invalid number: %s", raw)
+			return err
+		}
+		value.SetFloat(parsed)
+
+	default:
+		err = fmt.Errorf("cannot be set from the environment: %s", value.Type())
+	}
+	return err
+}
+
+// envFieldName returns the environment variable name of a field, its name
+// in upper snake case: PathPrefix is PATH_PREFIX and SNIFromHost is
+// SNI_FROM_HOST.
+func envFieldName(field string) (name string) {
+	name, ok := envFieldNames[field]
+	if ok {
+		return name
+	}
+
+	runes := []rune(field)
+	var builder strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			previous := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(previous) || unicode.IsDigit(previous) || (unicode.IsUpper(previous) && nextLower) {
+				builder.WriteByte('_')
+			}
+		}
+		builder.WriteRune(unicode.ToUpper(r))
+	}
+	name = builder.String()
+	return name
+}
@@ -0,0 +1,161 @@
+package mimicproxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// handleConnect serves a CONNECT request in forward-proxy mode: it dials the
+// requested host, answers 200, and splices bytes between the client and the
+// host until either side closes or the proxy is closed.
+func (p *Proxy) handleConnect(w http.ResponseWriter, r *http.Request) {
+	target := r.Host
+
+	var err error
+	_, _, err = net.SplitHostPort(target)
+	if err != nil {
+		p.writeError(w, nil, http.StatusBadRequest, "CONNECT target must be host:port")
+		return
+	}
+
+	if !connectAllowed(target, p.config.ConnectAllowedHosts) {
+		p.logger.Warn("CONNECT to disallowed host",
+			"target", target,
+			"remote_addr", r.RemoteAddr)
+		p.writeError(w, nil, http.StatusForbidden, "CONNECT to this host is not allowed")
+		return
+	}
+
+	var upstream net.Conn
+	upstream, err = p.connectDial(r.Context(), "tcp", target)
+	if err != nil {
+		p.logger.Error("CONNECT dial failed",
+			"target", target,
+			"remote_addr", r.RemoteAddr,
+			"error", err)
+		p.writeError(w, nil, http.StatusBadGateway, http.StatusText(http.StatusBadGateway))
+		return
+	}
+	defer upstream.Close()
+
+	var client net.Conn
+	var clientRW *bufio.ReadWriter
+	client, clientRW, err = http.NewResponseController(w).Hijack()
+	if err != nil {
+		p.logger.Warn("Cannot tunnel CONNECT over this connection",
+			"target", target,
+			"proto", r.Proto,
+			"error", err)
+		p.writeError(w, nil, http.StatusHTTPVersionNotSupported, "CONNECT requires HTTP/1.1")
+		return
+	}
+	defer client.Close()
+
+	// The hijacked connection bypasses the status writer; credit it for logging
+	status, ok := w.(*statusCapturingResponseWriter)
+	if ok {
+		status.statusCode = http.StatusOK
+		status.wroteHeader = true
+	}
+
+	_, err = client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	if err != nil {
+		return
+	}
+
+	// Tear the tunnel down when the proxy is closed
+	stop := context.AfterFunc(p.ctx, func() {
+		_ = client.Close()
+		_ = upstream.Close()
+	})
+	defer stop()
+
+	p.logger.Debug("CONNECT tunnel established",
+		"target", target,
+		"remote_addr", r.RemoteAddr)
+
+	start := time.Now()
+	sent, received := splice(client, clientRW.Reader, upstream)
+
+	p.logger.Debug("CONNECT tunnel closed",
+		"target", target,
+		"remote_addr", r.RemoteAddr,
+		"bytes_sent", sent,
+		"bytes_received", received,
+		"duration_ms", time.Since(start).Milliseconds())
+}
+
+// splice copies bytes between client and upstream in both directions until
+// both are done, returning the byte counts sent upstream and received from
+// it. clientReader reads from client, including anything it has buffered.
+func splice(client net.Conn, clientReader io.Reader, upstream net.Conn) (sent int64, received int64) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sent, _ = io.Copy(upstream, clientReader)
+		closeWrite(upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		received, _ = io.Copy(client, upstream)
+		closeWrite(client)
+	}()
+	wg.Wait()
+	return sent, received
+}
+
+// closeWrite signals the end of one direction of a tunnel, shutting down the
+// write side of conn if it supports half-close and closing it otherwise.
+func closeWrite(conn net.Conn) {
+	halfCloser, ok := conn.(interface{ CloseWrite() error })
+	if ok {
+		_ = halfCloser.CloseWrite()
+		return
+	}
+	_ = conn.Close()
+}
+
+// connectAllowed reports whether target (host:port) matches an entry of
+// allowed. Entries are "host:port", or "host" for any port; a host of the
+// form "*.example.com" matches any subdomain of example.com. Matching is
+// case-insensitive.
+func connectAllowed(target string, allowed []string) (ok bool) {
+	var host, port string
+	var err error
+	host, port, err = net.SplitHostPort(target)
+	if err != nil {
+		return ok
+	}
+
+	for _, entry := range allowed {
+		var entryHost, entryPort string
+		entryHost, entryPort, err = net.SplitHostPort(entry)
+		if err != nil {
+			entryHost, entryPort = entry, ""
+		}
+
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+
+		wildcard, isWildcard := strings.CutPrefix(entryHost, "*")
+		if strings.EqualFold(entryHost, host) || (isWildcard && strings.HasPrefix(wildcard, ".") && hasSuffixFold(host, wildcard)) {
+			ok = true
+			return ok
+		}
+	}
+	return ok
+}
+
+// hasSuffixFold reports whether s ends with suffix, ignoring case.
+func hasSuffixFold(s string, suffix string) (has bool) {
+	has = len(s) > len(suffix) && strings.EqualFold(s[len(s)-len(suffix):], suffix)
+	return has
+}
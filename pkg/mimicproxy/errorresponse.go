@@ -0,0 +1,122 @@
+package mimicproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"text/template"
+)
+
+// ErrorResponse is the data Config.ErrorResponseTemplate is executed with to
+// render the body of a proxy-generated error response.
+type ErrorResponse struct {
+	// Status is the response status code, e.g. 404
+	Status int
+
+	// StatusText is the standard text of Status, e.g. "Not Found"
+	StatusText string
+
+	// Message describes the error, e.g. "No route found"
+	Message string
+
+	// Route is the name of the matched route; empty if no route matched
+	Route string
+}
+
+// errorTemplateFuncs are the functions available to ErrorResponseTemplate.
+//
+//nolint:gochecknoglobals // Read-only function map shared by all templates.
+var errorTemplateFuncs = template.FuncMap{
+	"json": jsonValue,
+}
+
+// jsonValue encodes value as JSON, so strings are quoted and escaped.
+func jsonValue(value any) (encoded string, err error) {
+	var data []byte
+	data, err = json.Marshal(value)
+	encoded = string(data)
+	return encoded, err
+}
+
+// parseErrorTemplate parses an ErrorResponseTemplate, checking that it
+// renders valid JSON for a sample error.
+func parseErrorTemplate(text string) (tmpl *template.Template, err error) {
+	tmpl, err = template.New("error_response").Funcs(errorTemplateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return tmpl, err
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, ErrorResponse{
+		Status:     http.StatusBadGateway,
+		StatusText: http.StatusText(http.StatusBadGateway),
+		Message:    `sample "error" message`,
+		Route:      "route",
+	})
+	if err != nil {
+		return tmpl, err
+	}
+
+	if !json.Valid(buf.Bytes()) {
+		err = errors.New("template does not render valid JSON")
+	}
+	return tmpl, err
+}
+
+// writeErrorResponse writes an error response whose body is tmpl rendered for
+// data, as application/json. Without a template, or if rendering fails, the
+// body is data.Message as plain text, like http.Error.
+func writeErrorResponse(w http.ResponseWriter, tmpl *template.Template, data ErrorResponse) {
+	if data.StatusText == "" {
+		data.StatusText = http.StatusText(data.Status)
+	}
+
+	if tmpl == nil {
+		http.Error(w, data.Message, data.Status)
+		return
+	}
+
+	var buf bytes.Buffer
+	var err error
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		http.Error(w, data.Message, data.Status)
+		return
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "application/json")
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(data.Status)
+	_, _ = io.Copy(w, &buf)
+}
+
+// writeError writes a proxy-generated error response, rendered with the
+// configured ErrorResponseTemplate if there is one. route is nil if no
+// route matched.
+func (p *Proxy) writeError(w http.ResponseWriter, route *Route, status int, message string) {
+	data := ErrorResponse{Status: status, Message: message}
+	if route != nil {
+		data.Route = route.config.Name
+	}
+	writeErrorResponse(w, p.errorTemplate, data)
+}
+
+// writeError writes an error response for a failed upstream request. Without
+// an ErrorResponseTemplate the response has no body.
+func (r *Route) writeError(w http.ResponseWriter, status int) {
+	if r.errorTemplate == nil {
+		w.WriteHeader(status)
+		return
+	}
+
+	writeErrorResponse(w, r.errorTemplate, ErrorResponse{
+		Status:  status,
+		Message: http.StatusText(status),
+		Route:   r.config.Name,
+	})
+}
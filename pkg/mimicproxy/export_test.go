@@ -0,0 +1,7 @@
+package mimicproxy
+
+// ErrorClass exposes errorClass to the package's external tests.
+func ErrorClass(err error) (class string) {
+	class = errorClass(err)
+	return class
+}
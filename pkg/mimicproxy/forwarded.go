@@ -0,0 +1,190 @@
+package mimicproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// forwardedHeaderNames are the headers the standard forwarded headers mode
+// maintains; strip patterns matching them conflict with that mode.
+//
+//nolint:gochecknoglobals // Read-only lookup table.
+var forwardedHeaderNames = []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"}
+
+// parseTrustedProxies parses TrustedProxies entries, each an IP address or a
+// CIDR prefix.
+func parseTrustedProxies(entries []string) (prefixes []netip.Prefix, err error) {
+	for _, entry := range entries {
+		var prefix netip.Prefix
+		prefix, err = netip.ParsePrefix(entry)
+		if err != nil {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(entry)
+			if err != nil {
+				err = fmt.Errorf("invalid address or CIDR: %s", entry)
+				return prefixes, err
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, err
+}
+
+// isForwardedHeader reports whether key is Forwarded or an X-Forwarded-* header.
+func isForwardedHeader(key string) (forwarded bool) {
+	forwarded = strings.EqualFold(key, "Forwarded") || matchesPattern(key, "X-Forwarded-*")
+	return forwarded
+}
+
+// stripForwardedHeaders removes Forwarded and every X-Forwarded-* header, and
+// marks X-Forwarded-For so ReverseProxy does not add it back.
+func stripForwardedHeaders(header http.Header) {
+	for key := range header {
+		if isForwardedHeader(key) {
+			delete(header, key)
+		}
+	}
+	header["X-Forwarded-For"] = nil
+}
+
+// setForwardedHeaders appends the proxy's hop to the Forwarded and
+// X-Forwarded-* headers of an outgoing request whose Host has not yet been
+// rewritten. Headers from a peer outside trusted are discarded first, since
+// the client could have forged them. ReverseProxy appends the client IP to
+// X-Forwarded-For after the director runs.
+func setForwardedHeaders(req *http.Request, trusted []netip.Prefix) {
+	clientIP := remoteIP(req)
+
+	if !isTrustedPeer(clientIP, trusted) {
+		for key := range req.Header {
+			if isForwardedHeader(key) {
+				delete(req.Header, key)
+			}
+		}
+	}
+
+	proto := SchemeHTTP
+	if req.TLS != nil {
+		proto = SchemeHTTPS
+	}
+
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		req.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if req.Header.Get("X-Forwarded-Host") == "" && req.Host != "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+
+	element := "for=" + forwardedNode(clientIP)
+	if req.Host != "" {
+		element += ";host=" + forwardedValue(req.Host)
+	}
+	element += ";proto=" + proto
+
+	prior := req.Header.Values("Forwarded")
+	if len(prior) > 0 {
+		element = strings.Join(prior, ", ") + ", " + element
+	}
+	req.Header.Set("Forwarded", element)
+}
+
+// remoteIP returns the IP address of the peer req came from.
+func remoteIP(req *http.Request) (ip string) {
+	var err error
+	ip, _, err = net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	return ip
+}
+
+// resolveClientIP returns the IP address of the client req originates from.
+// A peer within trusted is a proxy, so the X-Forwarded-For addresses are
+// walked from the nearest hop back to the first one outside trusted. Any
+// other peer is the client itself, whatever headers it sent.
+func resolveClientIP(req *http.Request, trusted []netip.Prefix) (ip string) {
+	ip = remoteIP(req)
+	if !isTrustedPeer(ip, trusted) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		var addr netip.Addr
+		var err error
+		addr, err = netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		ip = addr.Unmap().String()
+		if !isTrustedPeer(ip, trusted) {
+			break
+		}
+	}
+	return ip
+}
+
+// isTrustedPeer reports whether ip is within one of the trusted prefixes.
+func isTrustedPeer(ip string, trusted []netip.Prefix) (ok bool) {
+	var addr netip.Addr
+	var err error
+	addr, err = netip.ParseAddr(ip)
+	if err != nil {
+		return ok
+	}
+	addr = addr.Unmap()
+
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			ok = true
+			return ok
+		}
+	}
+	return ok
+}
+
+// forwardedNode formats ip as an RFC 7239 node: IPv6 addresses are bracketed
+// and quoted, and an unparseable address is "unknown".
+func forwardedNode(ip string) (node string) {
+	var addr netip.Addr
+	var err error
+	addr, err = netip.ParseAddr(ip)
+	switch {
+	case err != nil:
+		node = "unknown"
+	case addr.Is6() && !addr.Is4In6():
+		node = `"[` + addr.String() + `]"`
+	default:
+		node = addr.Unmap().String()
+	}
+	return node
+}
+
+// forwardedValue returns value as an RFC 7239 token, quoting it when it
+// contains characters a token cannot.
+func forwardedValue(value string) (formatted string) {
+	formatted = value
+	if value != "" && !strings.ContainsFunc(value, isNotTokenChar) {
+		return formatted
+	}
+
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	formatted = `"` + replacer.Replace(value) + `"`
+	return formatted
+}
+
+// isTokenChar reports whether r may appear in an RFC 7230 token.
+func isTokenChar(r rune) (ok bool) {
+	ok = r < 0x7f && r > 0x20 && !strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r)
+	return ok
+}
+
+// isNotTokenChar reports whether r may not appear in an RFC 7230 token.
+func isNotTokenChar(r rune) (not bool) {
+	not = !isTokenChar(r)
+	return not
+}
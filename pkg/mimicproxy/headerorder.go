@@ -0,0 +1,367 @@
+package mimicproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// maxRecordedHeaderBytes bounds how much of a response is buffered while
+// looking for the end of its header block.
+const maxRecordedHeaderBytes = 1 << 20
+
+// headerValueSanitizer replaces line breaks that must not appear in a header
+// value written to the wire.
+//
+//nolint:gochecknoglobals // Stateless replacer shared by all connections.
+var headerValueSanitizer = strings.NewReplacer("\r", " ", "\n", " ")
+
+// headerCaptureKey is the context key for the headerCapture of a request on a
+// route with PreserveHeaderCasingAndOrder.
+type headerCaptureKey struct{}
+
+// headerCapture links a proxied request to the upstream connection that
+// carried its response, so the raw response header block can be recovered.
+type headerCapture struct {
+	conn atomic.Pointer[headerRecordingConn]
+}
+
+// headerBlock returns the raw header block of the upstream's final response,
+// or nil if none was recorded.
+func (c *headerCapture) headerBlock() (block []byte) {
+	conn := c.conn.Load()
+	if conn == nil {
+		return block
+	}
+
+	block = conn.headerBlock()
+	return block
+}
+
+// headerRecordingTransport returns a copy of transport whose connections record
+// the raw header block of the response they carry. Each request gets its own
+// HTTP/1.1 connection so a connection's recording belongs to one response;
+// TLS is done by the dialer so the recording sees plaintext. Forward proxies
+// are bypassed because their CONNECT handshake would be recorded instead.
+func headerRecordingTransport(transport *http.Transport) (recording *http.Transport) {
+	recording = transport.Clone()
+	recording.Proxy = nil
+	recording.DisableKeepAlives = true
+	recording.ForceAttemptHTTP2 = false
+	recording.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+
+	dial := dialFunc(recording.DialContext)
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	tlsConfig := recording.TLSClientConfig
+	handshakeTimeout := recording.TLSHandshakeTimeout
+
+	recording.DialContext = func(ctx context.Context, network string, addr string) (conn net.Conn, err error) {
+		conn, err = dial(ctx, network, addr)
+		if err != nil {
+			return conn, err
+		}
+
+		conn = &headerRecordingConn{Conn: conn}
+		return conn, err
+	}
+
+	recording.DialTLSContext = func(ctx context.Context, network string, addr string) (conn net.Conn, err error) {
+		var rawConn net.Conn
+		rawConn, err = dial(ctx, network, addr)
+		if err != nil {
+			return conn, err
+		}
+
+		config := &tls.Config{}
+		if tlsConfig != nil {
+			config = tlsConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		config.NextProtos = []string{"http/1.1"}
+
+		if handshakeTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, handshakeTimeout)
+			defer cancel()
+		}
+
+		tlsConn := tls.Client(rawConn, config)
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			_ = rawConn.Close()
+			return conn, err
+		}
+
+		conn = &headerRecordingConn{Conn: tlsConn}
+		return conn, err
+	}
+
+	return recording
+}
+
+// withHeaderCaptureTrace attaches a client trace that links capture to the
+// connection the request is sent on.
+func withHeaderCaptureTrace(req *http.Request, capture *headerCapture) (traced *http.Request) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn, ok := info.Conn.(*headerRecordingConn)
+			if ok {
+				capture.conn.Store(conn)
+			}
+		},
+	}
+
+	traced = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	return traced
+}
+
+// headerRecordingConn is an upstream connection that records the raw header
+// block of the first final (non-1xx) response read from it.
+type headerRecordingConn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	pending []byte
+	header  []byte
+	done    bool
+}
+
+// Read reads from the connection, recording bytes until the response header
+// block is complete.
+func (c *headerRecordingConn) Read(data []byte) (n int, err error) {
+	n, err = c.Conn.Read(data)
+	if n > 0 {
+		c.record(data[:n])
+	}
+	return n, err
+}
+
+// record appends data to the pending bytes and extracts the final response's
+// header block once its terminating blank line has been read.
+func (c *headerRecordingConn) record(data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.done {
+		return
+	}
+
+	c.pending = append(c.pending, data...)
+	for {
+		end := bytes.Index(c.pending, []byte("\r\n\r\n"))
+		if end == -1 {
+			if len(c.pending) > maxRecordedHeaderBytes {
+				c.pending = nil
+				c.done = true
+			}
+			return
+		}
+
+		block := c.pending[:end+2]
+		c.pending = c.pending[end+4:]
+
+		statusCode, _ := parseStatusLine(block)
+		if isInformational(statusCode) {
+			continue
+		}
+
+		c.header = block
+		c.pending = nil
+		c.done = true
+		return
+	}
+}
+
+// headerBlock returns the recorded header block, or nil if it is incomplete.
+func (c *headerRecordingConn) headerBlock() (block []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	block = c.header
+	return block
+}
+
+// parseStatusLine returns the status code and reason phrase from the first
+// line of a response header block.
+func parseStatusLine(block []byte) (statusCode int, reason string) {
+	line, _, _ := bytes.Cut(block, []byte("\r\n"))
+
+	_, status, found := strings.Cut(string(line), " ")
+	if !found {
+		return statusCode, reason
+	}
+
+	code, reason, _ := strings.Cut(status, " ")
+	statusCode, _ = strconv.Atoi(code)
+	return statusCode, reason
+}
+
+// parseHeaderNames returns the header field names of a response header block
+// in the order and casing they appeared, one entry per field line.
+func parseHeaderNames(block []byte) (names []string) {
+	lines := strings.Split(string(block), "\r\n")
+	for _, line := range lines[1:] {
+		// Skip obsolete line folding continuations and malformed lines
+		if line == "" || line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+
+		name, _, found := strings.Cut(line, ":")
+		if found && name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// headerOrderResponseWriter writes the response status line and headers
+// directly to the client connection, in the order and casing the upstream
+// used. Header values come from the final (manipulated) header map; headers
+// the proxy added follow the upstream's in canonical form. The connection is
+// closed after the response, and the body is delimited by Content-Length or
+// by the close. Clients that cannot be hijacked (HTTP/2) get normal writes.
+type headerOrderResponseWriter struct {
+	http.ResponseWriter
+	capture     *headerCapture
+	logger      Logger
+	routeName   string
+	wroteHeader bool
+	conn        net.Conn
+	bufrw       *bufio.ReadWriter
+
+	// status is credited with what is written to a hijacked connection,
+	// which bypasses it; nil when not available
+	status *statusCapturingResponseWriter
+}
+
+// WriteHeader hijacks the client connection and writes the raw header block.
+// Informational (1xx) responses are passed through.
+func (w *headerOrderResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+
+	if isInformational(statusCode) {
+		w.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+
+	w.wroteHeader = true
+
+	var conn net.Conn
+	var bufrw *bufio.ReadWriter
+	var err error
+	conn, bufrw, err = http.NewResponseController(w.ResponseWriter).Hijack()
+	if err != nil {
+		w.logger.Debug("Cannot preserve header casing and order, writing headers normally",
+			"route", w.routeName,
+			"error", err)
+		w.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+
+	w.conn = conn
+	w.bufrw = bufrw
+	if w.status != nil {
+		w.status.statusCode = statusCode
+		w.status.wroteHeader = true
+	}
+	writeOrderedHeader(bufrw.Writer, statusCode, w.Header(), w.capture.headerBlock())
+}
+
+// Write writes the response body.
+func (w *headerOrderResponseWriter) Write(data []byte) (n int, err error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.bufrw == nil {
+		n, err = w.ResponseWriter.Write(data)
+		return n, err
+	}
+
+	n, err = w.bufrw.Write(data)
+	if w.status != nil {
+		w.status.bytesWritten += int64(n)
+	}
+	return n, err
+}
+
+// FlushError flushes buffered data to the client.
+func (w *headerOrderResponseWriter) FlushError() (err error) {
+	if w.bufrw == nil {
+		err = http.NewResponseController(w.ResponseWriter).Flush()
+		return err
+	}
+
+	err = w.bufrw.Flush()
+	return err
+}
+
+// finish flushes and closes a hijacked client connection.
+func (w *headerOrderResponseWriter) finish() {
+	if w.conn == nil {
+		return
+	}
+
+	_ = w.bufrw.Flush()
+	_ = w.conn.Close()
+}
+
+// writeOrderedHeader writes the status line and headers of header, ordering
+// and casing names as they appear in the upstream's raw header block.
+func writeOrderedHeader(buf *bufio.Writer, statusCode int, header http.Header, block []byte) {
+	upstreamCode, reason := parseStatusLine(block)
+	if upstreamCode != statusCode || reason == "" {
+		reason = http.StatusText(statusCode)
+	}
+
+	_, _ = buf.WriteString("HTTP/1.1 " + strconv.Itoa(statusCode) + " " + reason + "\r\n")
+
+	// The connection is always closed after the response
+	written := map[string]int{"Connection": len(header["Connection"])}
+	writeField := func(name string, key string) {
+		values := header[key]
+		index := written[key]
+		if index >= len(values) {
+			return
+		}
+		_, _ = buf.WriteString(name + ": " + headerValueSanitizer.Replace(values[index]) + "\r\n")
+		written[key] = index + 1
+	}
+
+	for _, name := range parseHeaderNames(block) {
+		writeField(name, http.CanonicalHeaderKey(name))
+	}
+
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			continue
+		}
+		for written[key] < len(header[key]) {
+			writeField(key, key)
+		}
+	}
+
+	_, _ = buf.WriteString("Connection: close\r\n\r\n")
+}
@@ -1,29 +1,134 @@
 package mimicproxy
 
 import (
+	"maps"
 	"net/http"
 	"net/url"
 	"os"
+	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 )
 
+// FileValuePrefix marks a header value that is read from a file rather than given
+// literally, e.g. "@file:/var/run/secrets/aiprise/api-key". The file contents are
+// trimmed of surrounding whitespace.
+const FileValuePrefix = "@file:"
+
 // HeaderManipulator handles header transformation rules.
 type HeaderManipulator struct {
 	config    *HeaderConfig
 	routeName string
 	logger    Logger
+	files     *fileValueCache
+
+	// incomingRewrites and outgoingRewrites are the compiled
+	// RewriteIncoming and RewriteOutgoing rules
+	incomingRewrites []headerRewrite
+	outgoingRewrites []headerRewrite
+}
+
+// headerRewrite is a compiled HeaderRewrite for one header.
+type headerRewrite struct {
+	header      string
+	pattern     *regexp.Regexp
+	replacement string
 }
 
 // NewHeaderManipulator creates a new header manipulator.
+// File-backed header values are read immediately.
 func NewHeaderManipulator(config *HeaderConfig, routeName string, logger Logger) (hm *HeaderManipulator) {
 	hm = &HeaderManipulator{
 		config:    config,
 		routeName: routeName,
 		logger:    logger,
+		files: &fileValueCache{
+			refreshInterval: config.FileRefreshInterval,
+			entries:         make(map[string]fileValue),
+		},
+	}
+
+	hm.incomingRewrites = compileHeaderRewrites(config.RewriteIncoming, routeName, logger)
+	hm.outgoingRewrites = compileHeaderRewrites(config.RewriteOutgoing, routeName, logger)
+
+	for _, values := range []map[string]string{config.AddUpstream, config.AddDownstream, config.AppendUpstream, config.AppendDownstream} {
+		for _, value := range values {
+			if strings.HasPrefix(value, FileValuePrefix) {
+				hm.resolveValue(value)
+			}
+		}
 	}
+
 	return hm
 }
 
+// fileValueCache holds header values read from files, re-reading them once
+// they are older than the refresh interval (never, if the interval is zero).
+type fileValueCache struct {
+	mu              sync.Mutex
+	refreshInterval time.Duration
+	entries         map[string]fileValue
+}
+
+// fileValue is a cached file-backed header value.
+type fileValue struct {
+	value  string
+	readAt time.Time
+}
+
+// resolveValue returns the header value to send, reading file-backed values
+// and expanding environment variables in literal values. ok is false when a
+// file-backed value has never been read successfully, in which case the
+// header should be left out rather than sent empty.
+func (hm *HeaderManipulator) resolveValue(value string) (resolved string, ok bool) {
+	if !strings.HasPrefix(value, FileValuePrefix) {
+		resolved = expandEnvVars(value)
+		ok = true
+		return resolved, ok
+	}
+
+	path := strings.TrimPrefix(value, FileValuePrefix)
+
+	hm.files.mu.Lock()
+	cached, exists := hm.files.entries[path]
+	hm.files.mu.Unlock()
+
+	stale := hm.files.refreshInterval > 0 && time.Since(cached.readAt) >= hm.files.refreshInterval
+	if exists && !stale {
+		resolved = cached.value
+		ok = true
+		return resolved, ok
+	}
+
+	// Read without holding the lock so a slow filesystem only delays the
+	// requests that need this file
+	var content []byte
+	var err error
+	content, err = os.ReadFile(path)
+	if err != nil {
+		// Keep serving the last known value rather than dropping the header
+		hm.logger.Warn("Failed to read header value file",
+			"route", hm.routeName,
+			"path", path,
+			"cached", exists,
+			"error", err)
+		resolved = cached.value
+		ok = exists
+		return resolved, ok
+	}
+
+	resolved = strings.TrimSpace(string(content))
+	ok = true
+
+	hm.files.mu.Lock()
+	hm.files.entries[path] = fileValue{value: resolved, readAt: time.Now()}
+	hm.files.mu.Unlock()
+
+	return resolved, ok
+}
+
 // ProcessIncoming applies header rules to client request before forwarding.
 // Returns a new http.Header with transformations applied.
 func (hm *HeaderManipulator) ProcessIncoming(inHeader http.Header) (outHeader http.Header) {
@@ -31,7 +136,9 @@ func (hm *HeaderManipulator) ProcessIncoming(inHeader http.Header) (outHeader ht
 		inHeader,
 		hm.config.StripIncoming,
 		hm.config.ReplaceIncoming,
+		hm.incomingRewrites,
 		hm.config.AddUpstream,
+		hm.config.AppendUpstream,
 		"incoming",
 		"upstream",
 	)
@@ -45,7 +152,9 @@ func (hm *HeaderManipulator) ProcessOutgoing(inHeader http.Header) (outHeader ht
 		inHeader,
 		hm.config.StripOutgoing,
 		hm.config.ReplaceOutgoing,
+		hm.outgoingRewrites,
 		hm.config.AddDownstream,
+		hm.config.AppendDownstream,
 		"outgoing",
 		"downstream",
 	)
@@ -57,7 +166,9 @@ func (hm *HeaderManipulator) processHeaders(
 	inHeader http.Header,
 	stripPatterns []string,
 	replaceHeaders map[string]string,
+	rewrites []headerRewrite,
 	addHeaders map[string]string,
+	appendHeaders map[string]string,
 	direction string,
 	addDirection string,
 ) (outHeader http.Header) {
@@ -89,11 +200,42 @@ func (hm *HeaderManipulator) processHeaders(
 			"header", key)
 	}
 
-	// Add headers with environment variable expansion
+	// Rewrite parts of header values
+	for _, rewrite := range rewrites {
+		values := outHeader[rewrite.header]
+		if len(values) == 0 {
+			continue
+		}
+
+		rewritten := make([]string, len(values))
+		for i, value := range values {
+			rewritten[i] = rewrite.pattern.ReplaceAllString(value, rewrite.replacement)
+		}
+		outHeader[rewrite.header] = rewritten
+		hm.logger.Debug("Rewrote "+direction+" header",
+			"route", hm.routeName,
+			"header", rewrite.header)
+	}
+
+	// Add headers with environment variable expansion and file-backed values;
+	// headers whose file-backed value has never been readable are left out
 	addedCount := 0
 	for key, value := range addHeaders {
-		expanded := expandEnvVars(value)
-		outHeader.Set(key, expanded)
+		resolved, ok := hm.resolveValue(value)
+		if !ok {
+			continue
+		}
+		outHeader.Set(key, resolved)
+		addedCount++
+	}
+
+	// Append headers, keeping existing values
+	for key, value := range appendHeaders {
+		resolved, ok := hm.resolveValue(value)
+		if !ok {
+			continue
+		}
+		outHeader.Add(key, resolved)
 		addedCount++
 	}
 
@@ -106,6 +248,32 @@ func (hm *HeaderManipulator) processHeaders(
 	return outHeader
 }
 
+// compileHeaderRewrites compiles rewrite rules, sorted by header name so they
+// apply in a stable order. Rules with invalid patterns, which validation
+// rejects, are logged and skipped.
+func compileHeaderRewrites(rules map[string]HeaderRewrite, routeName string, logger Logger) (rewrites []headerRewrite) {
+	for _, name := range slices.Sorted(maps.Keys(rules)) {
+		rule := rules[name]
+		var pattern *regexp.Regexp
+		var err error
+		pattern, err = regexp.Compile(rule.Pattern)
+		if err != nil {
+			logger.Warn("Ignoring header rewrite with invalid pattern",
+				"route", routeName,
+				"header", name,
+				"error", err)
+			continue
+		}
+
+		rewrites = append(rewrites, headerRewrite{
+			header:      http.CanonicalHeaderKey(name),
+			pattern:     pattern,
+			replacement: rule.Replacement,
+		})
+	}
+	return rewrites
+}
+
 // stripHeaders removes headers matching patterns (supports wildcards).
 func stripHeaders(header http.Header, patterns []string) (result http.Header) {
 	result = make(http.Header)
@@ -151,6 +319,17 @@ func matchesPattern(headerName, pattern string) (matches bool) {
 	return matches
 }
 
+// matchesAnyPattern checks if a header name matches any of the patterns.
+func matchesAnyPattern(headerName string, patterns []string) (matches bool) {
+	for _, pattern := range patterns {
+		if matchesPattern(headerName, pattern) {
+			matches = true
+			return matches
+		}
+	}
+	return matches
+}
+
 // expandEnvVars expands environment variables in header values.
 // Supports ${VAR_NAME} syntax.
 func expandEnvVars(value string) (expanded string) {
@@ -275,6 +454,197 @@ func RewriteRedirect(
 	return rewrittenLocation, rewritten, rewriteType
 }
 
+// RewriteAuthChallenge rewrites the URLs in a WWW-Authenticate header value,
+// such as a Bearer challenge's realm or resource, to route through the proxy,
+// the way RewriteRedirect rewrites a Location. Every quoted parameter of every
+// challenge in the value is considered; URLs that don't point at a known
+// upstream are left as-is.
+func RewriteAuthChallenge(
+	challenge string,
+	incomingHost string,
+	incomingScheme string,
+	routes []*RouteConfig,
+	currentRoute *RouteConfig,
+) (rewrittenChallenge string, rewritten bool) {
+	var builder strings.Builder
+	rest := challenge
+
+	for {
+		start := strings.IndexByte(rest, '"')
+		if start == -1 {
+			break
+		}
+
+		// Find the closing quote, skipping quoted-pairs
+		end := -1
+		for i := start + 1; i < len(rest); i++ {
+			if rest[i] == '\\' {
+				i++
+				continue
+			}
+			if rest[i] == '"' {
+				end = i
+				break
+			}
+		}
+		if end == -1 {
+			break
+		}
+
+		builder.WriteString(rest[:start])
+		quoted := rest[start : end+1]
+		rest = rest[end+1:]
+
+		value := unquoteParameter(quoted)
+		rewrittenValue, valueRewritten, _ := RewriteRedirect(value, incomingHost, incomingScheme, routes, currentRoute)
+		if !valueRewritten {
+			builder.WriteString(quoted)
+			continue
+		}
+
+		builder.WriteString(quoteParameter(rewrittenValue))
+		rewritten = true
+	}
+
+	if !rewritten {
+		rewrittenChallenge = challenge
+		return rewrittenChallenge, rewritten
+	}
+
+	builder.WriteString(rest)
+	rewrittenChallenge = builder.String()
+	return rewrittenChallenge, rewritten
+}
+
+// RewriteLinkHeader rewrites the target URLs in a Link header value, such as a
+// paginated API's next and prev links, to route through the proxy, the way
+// RewriteRedirect rewrites a Location. Every link of a comma-separated value
+// is considered and its rel and other parameters are kept as they are; URLs
+// that don't point at a known upstream are left as-is.
+func RewriteLinkHeader(
+	link string,
+	incomingHost string,
+	incomingScheme string,
+	routes []*RouteConfig,
+	currentRoute *RouteConfig,
+) (rewrittenLink string, rewritten bool) {
+	var builder strings.Builder
+	inQuotes := false
+
+	for i := 0; i < len(link); i++ {
+		c := link[i]
+		switch {
+		case inQuotes && c == '\\' && i+1 < len(link):
+			builder.WriteByte(c)
+			i++
+			c = link[i]
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == '<' && !inQuotes:
+			// A URI reference runs to the closing angle bracket
+			end := strings.IndexByte(link[i+1:], '>')
+			if end == -1 {
+				break
+			}
+
+			target := link[i+1 : i+1+end]
+			rewrittenTarget, targetRewritten, _ := RewriteRedirect(target, incomingHost, incomingScheme, routes, currentRoute)
+			if targetRewritten {
+				target = rewrittenTarget
+				rewritten = true
+			}
+			builder.WriteString("<" + target + ">")
+			i += end + 1
+			continue
+		}
+		builder.WriteByte(c)
+	}
+
+	if !rewritten {
+		rewrittenLink = link
+		return rewrittenLink, rewritten
+	}
+
+	rewrittenLink = builder.String()
+	return rewrittenLink, rewritten
+}
+
+// unquoteParameter returns the unescaped content of an RFC 9110
+// quoted-string given with its surrounding quotes.
+func unquoteParameter(quoted string) (value string) {
+	var builder strings.Builder
+	inner := quoted[1 : len(quoted)-1]
+	for i := 0; i < len(inner); i++ {
+		if inner[i] == '\\' && i+1 < len(inner) {
+			i++
+		}
+		builder.WriteByte(inner[i])
+	}
+	value = builder.String()
+	return value
+}
+
+// quoteParameter returns value as an RFC 9110 quoted-string.
+func quoteParameter(value string) (quoted string) {
+	quoted = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+	return quoted
+}
+
+// RewriteReferer maps a Referer URL pointing at the proxy back into the upstream's
+// host and path space, the reverse of redirect rewriting. Only URLs whose host is one
+// of proxyHosts and whose path falls under the route's PathPrefix are rewritten. The
+// path is mapped as the director maps request paths, including the base path of upstream.
+func RewriteReferer(
+	referer string,
+	proxyHosts []string,
+	route *RouteConfig,
+	upstream *url.URL,
+) (rewrittenReferer string, rewritten bool) {
+	rewrittenReferer = referer
+
+	var refererURL *url.URL
+	var err error
+	refererURL, err = url.Parse(referer)
+	if err != nil || !refererURL.IsAbs() {
+		return rewrittenReferer, rewritten
+	}
+
+	if !isProxyHost(refererURL.Host, proxyHosts) || !hasPathPrefix(refererURL.Path, route.PathPrefix, route.CaseInsensitivePath) {
+		return rewrittenReferer, rewritten
+	}
+
+	path := refererURL.Path
+	if route.UpstreamPathPrefix != "" || route.StripPathPrefix {
+		path = rootedPath(trimDoubleSlash(route.UpstreamPathPrefix + trimPathPrefix(path, route.PathPrefix, route.CaseInsensitivePath)))
+	}
+
+	upstreamReferer := url.URL{
+		Scheme:   upstream.Scheme,
+		Host:     upstream.Host,
+		Path:     path,
+		RawQuery: refererURL.RawQuery,
+	}
+
+	// Prefix the upstream's base path, as the director does for the request
+	prependBasePath(&upstreamReferer, upstream)
+
+	rewrittenReferer = upstreamReferer.String()
+	rewritten = true
+	return rewrittenReferer, rewritten
+}
+
+// isProxyHost reports whether host is one of proxyHosts. Hosts are compared
+// case-insensitively.
+func isProxyHost(host string, proxyHosts []string) (found bool) {
+	for _, proxyHost := range proxyHosts {
+		if strings.EqualFold(host, proxyHost) {
+			found = true
+			break
+		}
+	}
+	return found
+}
+
 // buildProxyURL constructs a rewritten URL that routes through the proxy.
 func buildProxyURL(
 	scheme string,
@@ -305,6 +675,14 @@ func buildProxyURL(
 	// Add route path prefix
 	proxyURL += route.PathPrefix
 
+	// Remove the upstream's base path, which the director prepends
+	var upstreamURL *url.URL
+	var err error
+	upstreamURL, err = url.Parse(route.Upstream)
+	if err == nil && upstreamURL.Scheme != SchemeUnix {
+		path = strings.TrimPrefix(path, strings.TrimSuffix(upstreamURL.Path, "/"))
+	}
+
 	// Rewrite path if upstream path prefix is configured
 	if route.UpstreamPathPrefix != "" {
 		// Remove upstream path prefix from path if present
@@ -0,0 +1,52 @@
+package mimicproxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Drain makes the proxy reject new requests with 503 Service Unavailable and
+// report unhealthy from HealthHandler, while requests already in flight run to
+// completion. The server keeps running; call Undrain to resume.
+func (p *Proxy) Drain() {
+	if !p.draining.Swap(true) {
+		p.logger.Info("Proxy draining, rejecting new requests")
+	}
+}
+
+// Undrain resumes serving requests after Drain.
+func (p *Proxy) Undrain() {
+	if p.draining.Swap(false) {
+		p.logger.Info("Proxy resumed serving requests")
+	}
+}
+
+// Draining reports whether the proxy is draining.
+func (p *Proxy) Draining() (draining bool) {
+	draining = p.draining.Load()
+	return draining
+}
+
+// HealthHandler returns a handler for load balancer health checks. It responds
+// 200 OK, or 503 Service Unavailable while the proxy is draining. Routes in
+// maintenance are listed in the body but leave the proxy healthy.
+func (p *Proxy) HealthHandler() (handler http.Handler) {
+	handler = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+
+		status := "ok\n"
+		if p.draining.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			status = "draining\n"
+		}
+
+		maintenance := p.MaintenanceRoutes()
+		if len(maintenance) > 0 {
+			status += "maintenance: " + strings.Join(maintenance, ", ") + "\n"
+		}
+
+		_, _ = w.Write([]byte(status))
+	})
+	return handler
+}
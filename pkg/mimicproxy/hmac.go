@@ -0,0 +1,101 @@
+package mimicproxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// errSignatureMismatch reports a request whose signature header is missing or
+// does not match the HMAC of its body.
+var errSignatureMismatch = errors.New("request signature does not match body")
+
+// bodyHashKey is the context key for the hex-encoded body hash of a request
+// the director signs.
+type bodyHashKey struct{}
+
+// hmacHash returns the hash constructor for an HMAC algorithm, defaulting to
+// SHA-256.
+func hmacHash(algorithm string) (newHash func() hash.Hash) {
+	newHash = sha256.New
+	if algorithm == HMACAlgorithmSHA512 {
+		newHash = sha512.New
+	}
+	return newHash
+}
+
+// computeHMAC returns the HMAC of data keyed with secret.
+func computeHMAC(algorithm string, secret string, data []byte) (mac []byte) {
+	h := hmac.New(hmacHash(algorithm), []byte(secret))
+	_, _ = h.Write(data)
+	mac = h.Sum(nil)
+	return mac
+}
+
+// verifyRequestSignature buffers req's raw body into one of buffers and checks
+// it against the hex-encoded HMAC in the configured signature header,
+// returning a copy of req that replays the body unchanged. A missing,
+// malformed, or wrong signature yields errSignatureMismatch.
+func verifyRequestSignature(req *http.Request, config *HMACVerificationConfig, buffers *requestBuffers) (out *http.Request, err error) {
+	var body []byte
+	out, body, err = bufferRequestBody(req, buffers)
+	if err != nil {
+		return out, err
+	}
+
+	signature := strings.TrimSpace(req.Header.Get(config.SignatureHeader))
+	signature = strings.TrimPrefix(signature, config.Algorithm+"=")
+
+	var provided []byte
+	provided, err = hex.DecodeString(signature)
+	if err != nil || signature == "" {
+		err = errSignatureMismatch
+		return out, err
+	}
+
+	expected := computeHMAC(config.Algorithm, expandEnvVars(config.Secret), body)
+	if !hmac.Equal(provided, expected) {
+		err = errSignatureMismatch
+		return out, err
+	}
+
+	return out, err
+}
+
+// hashRequestBody buffers req's raw body into one of buffers and returns a
+// copy of req that replays it, carrying the body's hex-encoded hash for
+// signRequest.
+func hashRequestBody(req *http.Request, algorithm string, buffers *requestBuffers) (out *http.Request, err error) {
+	var body []byte
+	out, body, err = bufferRequestBody(req, buffers)
+	if err != nil {
+		return out, err
+	}
+
+	digest := hmacHash(algorithm)()
+	_, _ = digest.Write(body)
+	bodyHash := hex.EncodeToString(digest.Sum(nil))
+
+	out = out.WithContext(context.WithValue(out.Context(), bodyHashKey{}, bodyHash))
+	return out, err
+}
+
+// signRequest sets the signature header on an outgoing request whose URL has
+// been rewritten for the upstream.
+func signRequest(req *http.Request, config *RequestSigningConfig) {
+	bodyHash, ok := req.Context().Value(bodyHashKey{}).(string)
+	if !ok {
+		digest := hmacHash(config.Algorithm)()
+		bodyHash = hex.EncodeToString(digest.Sum(nil))
+	}
+
+	canonical := req.Method + "\n" + req.URL.EscapedPath() + "\n" + bodyHash
+	signature := computeHMAC(config.Algorithm, expandEnvVars(config.Secret), []byte(canonical))
+	req.Header.Set(config.SignatureHeader, hex.EncodeToString(signature))
+}
@@ -0,0 +1,311 @@
+package mimicproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Idempotency defaults.
+const (
+	// DefaultIdempotencyHeader is the IdempotencyConfig.HeaderName used when none is set.
+	DefaultIdempotencyHeader = "Idempotency-Key"
+
+	// DefaultIdempotencyTTL is the IdempotencyConfig.TTL used when none is set.
+	DefaultIdempotencyTTL = 24 * time.Hour
+)
+
+// A route keeps at most maxIdempotencyEntries keys and maxIdempotencyBytes of
+// response bodies; responses larger than maxIdempotencyResponseBytes are not
+// kept at all.
+const (
+	maxIdempotencyEntries       = 10000
+	maxIdempotencyBytes         = 64 << 20
+	maxIdempotencyResponseBytes = 1 << 20
+)
+
+// recordedResponse is a response kept for replay to duplicate requests.
+type recordedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// idempotencyEntry is the state of one idempotency key: in flight until done
+// is closed, then holding the response, or nil if it could not be kept.
+type idempotencyEntry struct {
+	// requestHash is the hash of the first request's body
+	requestHash string
+
+	done     chan struct{}
+	response *recordedResponse
+	expires  time.Time
+}
+
+// idempotencyStore tracks a route's requests by idempotency key, so
+// duplicates wait for the first request and replay its response. Keys are
+// scoped to the client, method, and path they were sent with.
+type idempotencyStore struct {
+	header string
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+	bytes   int
+}
+
+// newIdempotencyStore creates the store for a route's Idempotency settings.
+func newIdempotencyStore(config *IdempotencyConfig) (store *idempotencyStore) {
+	store = &idempotencyStore{
+		header:  config.HeaderName,
+		ttl:     config.TTL,
+		entries: make(map[string]*idempotencyEntry),
+	}
+	return store
+}
+
+// storeKey returns the key r's idempotency key is stored under. It covers the
+// client, identified by its verified certificate subject or else its
+// Authorization header, and the request's method and path, so the same key
+// from another client or for another operation is a different request.
+func (s *idempotencyStore) storeKey(r *http.Request, key string) (storeKey string) {
+	client, ok := ClientSubjectFromContext(r.Context())
+	if !ok {
+		client = r.Header.Get("Authorization")
+	}
+
+	digest := sha256.New()
+	for _, part := range []string{client, r.Method, r.URL.Path, key} {
+		_, _ = digest.Write([]byte(part))
+		_, _ = digest.Write([]byte{0})
+	}
+	storeKey = hex.EncodeToString(digest.Sum(nil))
+	return storeKey
+}
+
+// hashRequest returns the hash of a request body, stored with its key so a
+// reused key can be told apart from a retry.
+func hashRequest(body []byte) (requestHash string) {
+	sum := sha256.Sum256(body)
+	requestHash = hex.EncodeToString(sum[:])
+	return requestHash
+}
+
+// begin returns the entry of key and whether the caller is the first request
+// with it, which must call finish once its response is written. A new entry
+// records requestHash; callers compare it to their own to detect a key reused
+// for a different request. Completed entries past their TTL are replaced.
+func (s *idempotencyStore) begin(key string, requestHash string, now time.Time) (entry *idempotencyEntry, first bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.entries[key]
+	if ok && !s.expired(existing, now) {
+		entry = existing
+		return entry, first
+	}
+	if ok {
+		s.remove(key, existing)
+	}
+
+	entry = &idempotencyEntry{requestHash: requestHash, done: make(chan struct{})}
+	s.entries[key] = entry
+	first = true
+	return entry, first
+}
+
+// finish completes the first request's entry with its response, releasing
+// the duplicates waiting for it. Server errors, 499s, and responses that could
+// not be recorded are handed to those waiting but not kept, so a later retry
+// is forwarded again.
+func (s *idempotencyStore) finish(key string, entry *idempotencyEntry, response *recordedResponse, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry.response = response
+	entry.expires = now.Add(s.ttl)
+	close(entry.done)
+
+	if response == nil || response.status == StatusClientClosedRequest || response.status >= http.StatusInternalServerError {
+		if s.entries[key] == entry {
+			delete(s.entries, key)
+		}
+		return
+	}
+
+	s.bytes += len(response.body)
+	s.evict(now)
+}
+
+// await waits for entry's first request to finish, returning its response, or
+// nil if none was recorded. It gives up with ctx's error if ctx ends first.
+func (s *idempotencyStore) await(ctx context.Context, entry *idempotencyEntry) (response *recordedResponse, err error) {
+	select {
+	case <-entry.done:
+		response = entry.response
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return response, err
+}
+
+// expired reports whether a completed entry is past its TTL. The caller must
+// hold s.mu.
+func (s *idempotencyStore) expired(entry *idempotencyEntry, now time.Time) (expired bool) {
+	select {
+	case <-entry.done:
+		expired = !now.Before(entry.expires)
+	default:
+	}
+	return expired
+}
+
+// remove deletes key if it still refers to entry. The caller must hold s.mu.
+func (s *idempotencyStore) remove(key string, entry *idempotencyEntry) {
+	if s.entries[key] != entry {
+		return
+	}
+
+	delete(s.entries, key)
+	select {
+	case <-entry.done:
+		if entry.response != nil {
+			s.bytes -= len(entry.response.body)
+		}
+	default:
+	}
+}
+
+// evict brings the store within its limits, dropping expired entries first
+// and then arbitrary completed ones. In-flight entries are never dropped. The
+// caller must hold s.mu.
+func (s *idempotencyStore) evict(now time.Time) {
+	if len(s.entries) <= maxIdempotencyEntries && s.bytes <= maxIdempotencyBytes {
+		return
+	}
+
+	for key, entry := range s.entries {
+		if s.expired(entry, now) {
+			s.remove(key, entry)
+		}
+	}
+
+	for key, entry := range s.entries {
+		if len(s.entries) <= maxIdempotencyEntries && s.bytes <= maxIdempotencyBytes {
+			return
+		}
+		select {
+		case <-entry.done:
+			s.remove(key, entry)
+		default:
+		}
+	}
+}
+
+// replay writes a recorded response to w, marked with Idempotent-Replayed.
+func (r *recordedResponse) replay(w http.ResponseWriter) {
+	header := w.Header()
+	for key, values := range r.header {
+		header[key] = append([]string(nil), values...)
+	}
+	header.Set("Idempotent-Replayed", "true")
+	w.WriteHeader(r.status)
+	_, _ = w.Write(r.body)
+}
+
+// idempotencyRecorderKey is the request context key holding the
+// idempotencyRecorder of a request that is first with its idempotency key.
+type idempotencyRecorderKey struct{}
+
+// idempotencyRecorder records the response written through it, up to
+// maxIdempotencyResponseBytes of body, for replay to duplicate requests.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool
+
+	// fromUpstream is set once the upstream's response has been accepted for
+	// copying to the client, so errors the proxy generates are never recorded
+	fromUpstream atomic.Bool
+
+	// completed is set once the response has been proxied to the end
+	completed bool
+
+	// store, key, and entry are where finish records the response
+	store *idempotencyStore
+	key   string
+	entry *idempotencyEntry
+}
+
+// finish records the response under the request's idempotency key and
+// releases the duplicates waiting for it.
+func (w *idempotencyRecorder) finish() {
+	w.store.finish(w.key, w.entry, w.recorded(), time.Now())
+}
+
+// markUpstreamResponse records that the upstream response resp is being
+// copied to the client, if its request is first with its idempotency key.
+func markUpstreamResponse(resp *http.Response) {
+	recorder, ok := resp.Request.Context().Value(idempotencyRecorderKey{}).(*idempotencyRecorder)
+	if ok {
+		recorder.fromUpstream.Store(true)
+	}
+}
+
+// WriteHeader records the final status and headers; interim responses pass
+// through unrecorded.
+func (w *idempotencyRecorder) WriteHeader(statusCode int) {
+	if w.status == 0 && (statusCode < 100 || statusCode >= 200) {
+		w.status = statusCode
+		w.header = w.ResponseWriter.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write records the body while it fits.
+func (w *idempotencyRecorder) Write(data []byte) (n int, err error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if !w.overflow {
+		if w.body.Len()+len(data) > maxIdempotencyResponseBytes {
+			w.overflow = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(data)
+		}
+	}
+
+	n, err = w.ResponseWriter.Write(data)
+	return n, err
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *idempotencyRecorder) Unwrap() (rw http.ResponseWriter) {
+	rw = w.ResponseWriter
+	return rw
+}
+
+// recorded returns the recorded response, or nil if it was not completed, did
+// not come from the upstream, had nothing written, or had a body too large to
+// keep.
+func (w *idempotencyRecorder) recorded() (response *recordedResponse) {
+	if !w.completed || !w.fromUpstream.Load() || w.status == 0 || w.overflow {
+		return response
+	}
+
+	response = &recordedResponse{
+		status: w.status,
+		header: w.header,
+		body:   bytes.Clone(w.body.Bytes()),
+	}
+	return response
+}
@@ -1,6 +1,13 @@
 package mimicproxy
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
 
 // Label constants for metrics.
 const (
@@ -10,8 +17,35 @@ const (
 	LabelMethod = "method"
 	// LabelStatusCode identifies the HTTP response status code.
 	LabelStatusCode = "status_code"
+	// LabelUpstream identifies the upstream host (host:port).
+	LabelUpstream = "upstream"
 	// LabelRedirectType identifies the type of redirect (relative, internal, external_known, external_unknown).
 	LabelRedirectType = "redirect_type"
+	// LabelErrorClass identifies the kind of upstream failure (one of the ErrorClass constants).
+	LabelErrorClass = "class"
+	// LabelErrorReason identifies why an upstream request failed (one of the ErrorReason constants).
+	LabelErrorReason = "reason"
+	// LabelCanaryVariant identifies whether a request went to the canary or the stable upstream.
+	LabelCanaryVariant = "variant"
+	// LabelPathPrefix identifies the first path segment of a request no route matched.
+	LabelPathPrefix = "path_prefix"
+	// LabelVersion identifies the version of the program embedding the proxy.
+	LabelVersion = "version"
+	// LabelCommit identifies the source revision of the program embedding the proxy.
+	LabelCommit = "commit"
+	// LabelBuiltAt identifies when the program embedding the proxy was built.
+	LabelBuiltAt = "built_at"
+)
+
+// Unmatched path prefixes are tracked up to maxNoRoutePrefixes distinct values
+// per proxy, each at most maxNoRoutePrefixLength bytes; any others are counted
+// under NoRoutePrefixOther so clients cannot grow the label space.
+const (
+	maxNoRoutePrefixes     = 100
+	maxNoRoutePrefixLength = 64
+
+	// NoRoutePrefixOther is the path_prefix of unmatched requests beyond the tracked prefixes.
+	NoRoutePrefixOther = "other"
 )
 
 var (
@@ -28,107 +62,694 @@ var (
 	RedirectLabels = []string{LabelRoute, LabelRedirectType}
 
 	//nolint:gochecknoglobals // This is how the prometheus magic works.
+	// BuildInfoLabels are labels for the build information metric.
+	BuildInfoLabels = []string{LabelVersion, LabelCommit, LabelBuiltAt}
+)
+
+// defaultMetricsNamespace is the MetricsConfig.Namespace used when none is set.
+const defaultMetricsNamespace = "mimic_proxy"
+
+var (
+	//nolint:gochecknoglobals // Backs the deprecated package-level collectors.
+	// defaultMetrics holds the collectors of proxies with the default metrics
+	// setup, registered with the default registry by the first such proxy.
+	defaultMetrics = buildMetrics(&MetricsConfig{Namespace: defaultMetricsNamespace}, nil)
+
+	//nolint:gochecknoglobals // Backs the deprecated package-level collectors.
+	// registerDefaultMetrics registers defaultMetrics once.
+	registerDefaultMetrics sync.Once
+)
+
+// The package-level collectors predate per-proxy metrics. They record the
+// requests of proxies whose metrics use the default registry, namespace, and
+// buckets and no MetricLabelName; other proxies only record into their own
+// Metrics.
+var (
+	//nolint:gochecknoglobals // Kept for compatibility.
 	// ProxyRequestsTotal tracks the total number of requests handled by the proxy.
-	ProxyRequestsTotal = prometheus.NewCounterVec(
+	//
+	// Deprecated: Use Metrics.RequestsTotal.
+	ProxyRequestsTotal = defaultMetrics.RequestsTotal
+
+	//nolint:gochecknoglobals // Kept for compatibility.
+	// ProxyRequestDuration tracks the duration of proxy requests in seconds.
+	//
+	// Deprecated: Use Metrics.RequestDuration.
+	ProxyRequestDuration = defaultMetrics.RequestDuration
+
+	//nolint:gochecknoglobals // Kept for compatibility.
+	// ProxyRequestErrorsTotal tracks the total number of proxy request errors.
+	//
+	// Deprecated: Use Metrics.RequestErrorsTotal.
+	ProxyRequestErrorsTotal = defaultMetrics.RequestErrorsTotal
+
+	//nolint:gochecknoglobals // Kept for compatibility.
+	// ProxyResponsesTotal tracks responses by status code.
+	//
+	// Deprecated: Use Metrics.ResponsesTotal.
+	ProxyResponsesTotal = defaultMetrics.ResponsesTotal
+
+	//nolint:gochecknoglobals // Kept for compatibility.
+	// ProxyRedirectRewritesTotal tracks the number of redirect rewrites performed.
+	//
+	// Deprecated: Use Metrics.RedirectRewritesTotal.
+	ProxyRedirectRewritesTotal = defaultMetrics.RedirectRewritesTotal
+
+	//nolint:gochecknoglobals // Kept for compatibility.
+	// ProxyHeaderStripsTotal tracks the number of headers stripped.
+	//
+	// Deprecated: Use Metrics.HeaderStripsTotal.
+	ProxyHeaderStripsTotal = defaultMetrics.HeaderStripsTotal
+
+	//nolint:gochecknoglobals // Kept for compatibility.
+	// ProxyHeaderAddsTotal tracks the number of headers added.
+	//
+	// Deprecated: Use Metrics.HeaderAddsTotal.
+	ProxyHeaderAddsTotal = defaultMetrics.HeaderAddsTotal
+
+	//nolint:gochecknoglobals // Kept for compatibility.
+	// ProxyUpstreamDuration tracks the duration of upstream requests in seconds.
+	//
+	// Deprecated: Use Metrics.UpstreamDuration.
+	ProxyUpstreamDuration = defaultMetrics.UpstreamDuration
+
+	//nolint:gochecknoglobals // Kept for compatibility.
+	// ProxyUpstreamErrorsTotal tracks upstream request errors.
+	//
+	// Deprecated: Use Metrics.UpstreamErrorsTotal.
+	ProxyUpstreamErrorsTotal = defaultMetrics.UpstreamErrorsTotal
+)
+
+// DefaultDurationBuckets returns the default histogram buckets for durations in seconds (1ms..10s).
+func DefaultDurationBuckets() (buckets []float64) {
+	buckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0, 10.0}
+	return buckets
+}
+
+// Metrics holds the Prometheus collectors for a proxy instance.
+type Metrics struct {
+	// RequestsTotal tracks the total number of requests handled by the proxy.
+	RequestsTotal *prometheus.CounterVec
+
+	// InflightRequests tracks the number of requests currently being proxied.
+	InflightRequests *prometheus.GaugeVec
+
+	// RequestDuration tracks the duration of proxy requests in seconds.
+	RequestDuration *prometheus.HistogramVec
+
+	// RequestBytes tracks the size of request bodies received from clients.
+	RequestBytes *prometheus.HistogramVec
+
+	// ResponseBytes tracks the size of response bodies written to clients.
+	ResponseBytes *prometheus.HistogramVec
+
+	// RequestErrorsTotal tracks the total number of proxy request errors.
+	RequestErrorsTotal *prometheus.CounterVec
+
+	// ResponsesTotal tracks responses by status code.
+	ResponsesTotal *prometheus.CounterVec
+
+	// RedirectRewritesTotal tracks the number of redirect rewrites performed.
+	RedirectRewritesTotal *prometheus.CounterVec
+
+	// HeaderStripsTotal tracks the number of headers stripped.
+	HeaderStripsTotal *prometheus.CounterVec
+
+	// HeaderAddsTotal tracks the number of headers added.
+	HeaderAddsTotal *prometheus.CounterVec
+
+	// UpstreamDuration tracks the duration of upstream requests in seconds.
+	UpstreamDuration *prometheus.HistogramVec
+
+	// UpstreamTTFB tracks the time from sending a request upstream to receiving the first response byte.
+	UpstreamTTFB *prometheus.HistogramVec
+
+	// UpstreamErrorsTotal tracks upstream request errors.
+	UpstreamErrorsTotal *prometheus.CounterVec
+
+	// UpstreamTLSErrorsTotal tracks upstream TLS certificate verification failures.
+	UpstreamTLSErrorsTotal *prometheus.CounterVec
+
+	// UpstreamGoAwayRetriesTotal tracks requests retried after the upstream sent an HTTP/2 GOAWAY.
+	UpstreamGoAwayRetriesTotal *prometheus.CounterVec
+
+	// UpstreamRetryAfterRetriesTotal tracks requests retried after the delay an upstream asked for with Retry-After.
+	UpstreamRetryAfterRetriesTotal *prometheus.CounterVec
+
+	// RetryBudgetExhaustedTotal tracks retries skipped because the retry budget was exhausted.
+	RetryBudgetExhaustedTotal *prometheus.CounterVec
+
+	// CanaryRequestsTotal tracks requests on routes with a Canary by whether they went to the canary.
+	CanaryRequestsTotal *prometheus.CounterVec
+
+	// IdempotentReplaysTotal tracks duplicate requests served a recorded response for their idempotency key.
+	IdempotentReplaysTotal *prometheus.CounterVec
+
+	// SlowRequestsTotal tracks requests that took longer than their route's SlowRequestThreshold.
+	SlowRequestsTotal *prometheus.CounterVec
+
+	// ConcurrencyQueueDepth tracks requests waiting for a route concurrency slot.
+	ConcurrencyQueueDepth *prometheus.GaugeVec
+
+	// ConcurrencyRejectionsTotal tracks requests rejected by a route concurrency limit.
+	ConcurrencyRejectionsTotal *prometheus.CounterVec
+
+	// ConcurrencyQueueWait tracks how long queued requests waited for a route concurrency slot.
+	ConcurrencyQueueWait *prometheus.HistogramVec
+
+	// TransportIdleConns tracks HTTP/1.1 upstream connections idle in the transport's pool.
+	TransportIdleConns *prometheus.GaugeVec
+
+	// TransportNewConnsTotal tracks upstream requests that needed a newly dialed connection.
+	TransportNewConnsTotal *prometheus.CounterVec
+
+	// TransportReusedConnsTotal tracks upstream requests that reused a pooled connection.
+	TransportReusedConnsTotal *prometheus.CounterVec
+
+	// GlobalRateLimitedTotal tracks requests rejected by the global rate limit.
+	GlobalRateLimitedTotal *prometheus.CounterVec
+
+	// NoRouteTotal tracks requests that matched no route by the first segment of their path.
+	NoRouteTotal *prometheus.CounterVec
+
+	// BuildInfo is a constant 1 labelled with Config.BuildInfo.
+	BuildInfo *prometheus.GaugeVec
+
+	// Up is 1 while the proxy is serving and 0 once it has been shut down.
+	// Proxies sharing a registry share it; it stays 1 while any of them is serving.
+	Up prometheus.Gauge
+
+	// extraLabels are the MetricLabelName labels added to per-route metrics
+	extraLabels []string
+
+	// noRouteMu guards noRoutePrefixes, the path_prefix values NoRouteTotal has used
+	noRouteMu       sync.Mutex
+	noRoutePrefixes map[string]struct{}
+}
+
+// NewMetrics creates the proxy metrics and registers them with registerer.
+// Metric names are prefixed with config.Namespace. If a metric with the same
+// name is already registered, e.g. by another proxy in the same process, the
+// existing collector is shared (including its buckets).
+func NewMetrics(config *MetricsConfig, registerer prometheus.Registerer) (metrics *Metrics, err error) {
+	metrics, err = newMetrics(config, registerer, nil)
+	return metrics, err
+}
+
+// newMetrics is NewMetrics with extra labels on every per-route metric, for
+// routes' MetricLabelName labels. Collectors already registered with other
+// labels cannot be shared, and registering returns an error.
+func newMetrics(config *MetricsConfig, registerer prometheus.Registerer, extraLabels []string) (metrics *Metrics, err error) {
+	metrics = buildMetrics(config, extraLabels)
+
+	// Proxies with the default setup share the deprecated package-level
+	// collectors, so they keep recording what they did before metrics were
+	// built per proxy
+	if registerer == prometheus.DefaultRegisterer && usesDefaultMetrics(config, extraLabels) {
+		registerDefaultMetrics.Do(func() {
+			_ = defaultMetrics.register(registerer)
+		})
+	}
+
+	err = metrics.register(registerer)
+	return metrics, err
+}
+
+// buildMetrics creates the proxy metrics without registering them.
+func buildMetrics(config *MetricsConfig, extraLabels []string) (metrics *Metrics) {
+	namespace := config.Namespace
+
+	durationBuckets := config.DurationBuckets
+	if len(durationBuckets) == 0 {
+		durationBuckets = DefaultDurationBuckets()
+	}
+
+	upstreamDurationBuckets := config.UpstreamDurationBuckets
+	if len(upstreamDurationBuckets) == 0 {
+		upstreamDurationBuckets = DefaultDurationBuckets()
+	}
+
+	metrics = &Metrics{
+		extraLabels:     extraLabels,
+		noRoutePrefixes: make(map[string]struct{}),
+	}
+	metrics.buildRequestMetrics(namespace, durationBuckets)
+	metrics.buildUpstreamMetrics(namespace, upstreamDurationBuckets)
+	metrics.buildRouteFeatureMetrics(namespace, durationBuckets)
+	metrics.buildProxyMetrics(namespace)
+
+	return metrics
+}
+
+// withRouteLabels returns labels followed by the MetricLabelName labels,
+// the label names of a per-route metric.
+func (m *Metrics) withRouteLabels(labels []string) (all []string) {
+	all = slices.Concat(labels, m.extraLabels)
+	return all
+}
+
+// buildRequestMetrics creates the metrics of requests and responses as the
+// client sees them.
+func (m *Metrics) buildRequestMetrics(namespace string, durationBuckets []float64) {
+	sizeBuckets := prometheus.ExponentialBuckets(128, 2, 20) // 128B .. 64MB
+
+	m.RequestsTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "mimic_proxy_requests_total",
-			Help: "Total number of requests handled by the mimic proxy",
+			Namespace: namespace,
+			Name:      "requests_total",
+			Help:      "Total number of requests handled by the mimic proxy",
 		},
-		RequestLabels,
+		m.withRouteLabels(RequestLabels),
 	)
-
-	//nolint:gochecknoglobals // This is how the prometheus magic works.
-	// ProxyRequestDuration tracks the duration of proxy requests in seconds.
-	ProxyRequestDuration = prometheus.NewHistogramVec(
+	m.InflightRequests = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "inflight_requests",
+			Help:      "Number of requests currently being handled by the mimic proxy",
+		},
+		m.withRouteLabels([]string{LabelRoute}),
+	)
+	m.RequestDuration = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
-			Name:    "mimic_proxy_request_duration_seconds",
-			Help:    "Duration of proxy requests in seconds",
-			Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0, 10.0},
+			Namespace: namespace,
+			Name:      "request_duration_seconds",
+			Help:      "Duration of proxy requests in seconds",
+			Buckets:   durationBuckets,
 		},
-		RequestLabels,
+		m.withRouteLabels(RequestLabels),
 	)
-
-	//nolint:gochecknoglobals // This is how the prometheus magic works.
-	// ProxyRequestErrorsTotal tracks the total number of proxy request errors.
-	ProxyRequestErrorsTotal = prometheus.NewCounterVec(
+	m.RequestBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_bytes",
+			Help:      "Size of request bodies received from clients in bytes",
+			Buckets:   sizeBuckets,
+		},
+		m.withRouteLabels([]string{LabelRoute}),
+	)
+	m.ResponseBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "response_bytes",
+			Help:      "Size of response bodies written to clients in bytes",
+			Buckets:   sizeBuckets,
+		},
+		m.withRouteLabels([]string{LabelRoute}),
+	)
+	m.RequestErrorsTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "mimic_proxy_request_errors_total",
-			Help: "Total number of errors when handling proxy requests",
+			Namespace: namespace,
+			Name:      "request_errors_total",
+			Help:      "Total number of errors when handling proxy requests",
 		},
-		RequestLabels,
+		m.withRouteLabels(RequestLabels),
 	)
-
-	//nolint:gochecknoglobals // This is how the prometheus magic works.
-	// ProxyResponsesTotal tracks responses by status code.
-	ProxyResponsesTotal = prometheus.NewCounterVec(
+	m.ResponsesTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "mimic_proxy_responses_total",
-			Help: "Total number of responses by status code",
+			Namespace: namespace,
+			Name:      "responses_total",
+			Help:      "Total number of responses by status code",
 		},
-		RequestStatusLabels,
+		m.withRouteLabels(RequestStatusLabels),
 	)
-
-	//nolint:gochecknoglobals // This is how the prometheus magic works.
-	// ProxyRedirectRewritesTotal tracks the number of redirect rewrites performed.
-	ProxyRedirectRewritesTotal = prometheus.NewCounterVec(
+	m.RedirectRewritesTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "mimic_proxy_redirect_rewrites_total",
-			Help: "Total number of redirect rewrites performed by type",
+			Namespace: namespace,
+			Name:      "redirect_rewrites_total",
+			Help:      "Total number of redirect rewrites performed by type",
 		},
-		RedirectLabels,
+		m.withRouteLabels(RedirectLabels),
 	)
-
-	//nolint:gochecknoglobals // This is how the prometheus magic works.
-	// ProxyHeaderStripsTotal tracks the number of headers stripped.
-	ProxyHeaderStripsTotal = prometheus.NewCounterVec(
+	m.HeaderStripsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "header_strips_total",
+			Help:      "Total number of headers stripped for transparency",
+		},
+		m.withRouteLabels([]string{LabelRoute}),
+	)
+	m.HeaderAddsTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "mimic_proxy_header_strips_total",
-			Help: "Total number of headers stripped for transparency",
+			Namespace: namespace,
+			Name:      "header_adds_total",
+			Help:      "Total number of headers added to upstream requests",
 		},
-		[]string{LabelRoute},
+		m.withRouteLabels([]string{LabelRoute}),
 	)
+}
 
-	//nolint:gochecknoglobals // This is how the prometheus magic works.
-	// ProxyHeaderAddsTotal tracks the number of headers added.
-	ProxyHeaderAddsTotal = prometheus.NewCounterVec(
+// buildUpstreamMetrics creates the metrics of requests sent upstream and their
+// retries.
+func (m *Metrics) buildUpstreamMetrics(namespace string, upstreamDurationBuckets []float64) {
+	m.UpstreamDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "upstream_duration_seconds",
+			Help:      "Duration of upstream requests in seconds",
+			Buckets:   upstreamDurationBuckets,
+		},
+		m.withRouteLabels(RequestLabels),
+	)
+	m.UpstreamTTFB = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "upstream_ttfb_seconds",
+			Help:      "Time from sending a request upstream to receiving the first response byte in seconds",
+			Buckets:   upstreamDurationBuckets,
+		},
+		m.withRouteLabels([]string{LabelRoute}),
+	)
+	m.UpstreamErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "upstream_errors_total",
+			Help:      "Total number of upstream request errors by class and reason",
+		},
+		m.withRouteLabels([]string{LabelRoute, LabelMethod, LabelErrorClass, LabelErrorReason}),
+	)
+	m.UpstreamTLSErrorsTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "mimic_proxy_header_adds_total",
-			Help: "Total number of headers added to upstream requests",
+			Namespace: namespace,
+			Name:      "upstream_tls_errors_total",
+			Help:      "Total number of upstream TLS certificate verification failures",
 		},
-		[]string{LabelRoute},
+		m.withRouteLabels([]string{LabelRoute}),
 	)
+	m.UpstreamGoAwayRetriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "upstream_goaway_retries_total",
+			Help:      "Total number of upstream requests retried after an HTTP/2 GOAWAY",
+		},
+		m.withRouteLabels(RequestLabels),
+	)
+	m.UpstreamRetryAfterRetriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "upstream_retry_after_retries_total",
+			Help:      "Total number of upstream requests retried after the delay given by Retry-After",
+		},
+		m.withRouteLabels(RequestLabels),
+	)
+	m.RetryBudgetExhaustedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "retry_budget_exhausted_total",
+			Help:      "Total number of upstream retries skipped because the retry budget was exhausted",
+		},
+		m.withRouteLabels([]string{LabelRoute}),
+	)
+}
 
-	//nolint:gochecknoglobals // This is how the prometheus magic works.
-	// ProxyUpstreamDuration tracks the duration of upstream requests in seconds.
-	ProxyUpstreamDuration = prometheus.NewHistogramVec(
+// buildRouteFeatureMetrics creates the metrics of optional route features: canaries,
+// idempotency, slow requests, and concurrency limits.
+func (m *Metrics) buildRouteFeatureMetrics(namespace string, durationBuckets []float64) {
+	m.CanaryRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "canary_requests_total",
+			Help:      "Total number of requests on canary routes, by whether they went to the canary or the stable upstream",
+		},
+		m.withRouteLabels([]string{LabelRoute, LabelCanaryVariant}),
+	)
+	m.IdempotentReplaysTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "idempotent_replays_total",
+			Help:      "Total number of duplicate requests served the recorded response for their idempotency key",
+		},
+		m.withRouteLabels([]string{LabelRoute}),
+	)
+	m.SlowRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "slow_requests_total",
+			Help:      "Total number of requests that took longer than the route's slow request threshold",
+		},
+		m.withRouteLabels([]string{LabelRoute}),
+	)
+	m.ConcurrencyQueueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "concurrency_queue_depth",
+			Help:      "Number of requests waiting for a route concurrency slot",
+		},
+		m.withRouteLabels([]string{LabelRoute}),
+	)
+	m.ConcurrencyRejectionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "concurrency_rejections_total",
+			Help:      "Total number of requests rejected because a route concurrency limit was reached",
+		},
+		m.withRouteLabels([]string{LabelRoute}),
+	)
+	m.ConcurrencyQueueWait = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
-			Name:    "mimic_proxy_upstream_duration_seconds",
-			Help:    "Duration of upstream requests in seconds",
-			Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0, 10.0},
+			Namespace: namespace,
+			Name:      "concurrency_queue_wait_seconds",
+			Help:      "Time requests spent queued for a route concurrency slot in seconds, whether or not they got one",
+			Buckets:   durationBuckets,
 		},
-		RequestLabels,
+		m.withRouteLabels([]string{LabelRoute}),
 	)
+}
 
-	//nolint:gochecknoglobals // This is how the prometheus magic works.
-	// ProxyUpstreamErrorsTotal tracks upstream request errors.
-	ProxyUpstreamErrorsTotal = prometheus.NewCounterVec(
+// buildProxyMetrics creates the metrics that are not per route: the transport
+// connection pool, the global rate limit, unmatched requests, build_info, and up.
+func (m *Metrics) buildProxyMetrics(namespace string) {
+	m.TransportIdleConns = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "transport_idle_conns",
+			Help:      "Number of idle HTTP/1.1 upstream connections in the transport pool",
+		},
+		[]string{LabelUpstream},
+	)
+	m.TransportNewConnsTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "mimic_proxy_upstream_errors_total",
-			Help: "Total number of upstream request errors",
+			Namespace: namespace,
+			Name:      "transport_new_conns_total",
+			Help:      "Total number of upstream requests sent on a newly dialed connection",
 		},
-		RequestLabels,
+		[]string{LabelUpstream},
 	)
-)
+	m.TransportReusedConnsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "transport_reused_conns_total",
+			Help:      "Total number of upstream requests sent on a reused connection",
+		},
+		[]string{LabelUpstream},
+	)
+	m.GlobalRateLimitedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "global_rate_limited_total",
+			Help:      "Total number of requests rejected because the global rate limit was exceeded",
+		},
+		m.withRouteLabels([]string{LabelRoute}),
+	)
+	m.NoRouteTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "no_route_total",
+			Help:      "Total number of requests that matched no route by path prefix",
+		},
+		[]string{LabelPathPrefix},
+	)
+	m.BuildInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "build_info",
+			Help:      "A constant 1 labelled with the version, commit, and build time of the program embedding the mimic proxy",
+		},
+		BuildInfoLabels,
+	)
+	m.Up = &upGauge{
+		Gauge: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "up",
+				Help:      "Whether the mimic proxy is serving: 1 until it is shut down, then 0",
+			},
+		),
+	}
+}
+
+// upGauge is the up metric. Proxies registering with the same registry share
+// it, so it counts the proxies still serving and only drops to 0 once the
+// last of them has stopped.
+type upGauge struct {
+	prometheus.Gauge
+
+	mu      sync.Mutex
+	serving int
+}
+
+// start records a proxy that has started serving.
+func (g *upGauge) start() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.serving++
+	g.Set(1)
+}
+
+// stop records a proxy that has stopped serving.
+func (g *upGauge) stop() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.serving--
+	if g.serving <= 0 {
+		g.serving = 0
+		g.Set(0)
+	}
+}
+
+// startServing sets up to 1 for a proxy that has started serving.
+func (m *Metrics) startServing() {
+	up, ok := m.Up.(*upGauge)
+	if !ok {
+		m.Up.Set(1)
+		return
+	}
+	up.start()
+}
+
+// stopServing sets up to 0 once no proxy sharing it is serving. Each proxy
+// calls it at most once.
+func (m *Metrics) stopServing() {
+	up, ok := m.Up.(*upGauge)
+	if !ok {
+		m.Up.Set(0)
+		return
+	}
+	up.stop()
+}
+
+// register registers the metrics with registerer, replacing each collector
+// already registered under the same name with the registered one.
+func (m *Metrics) register(registerer prometheus.Registerer) (err error) {
+	err = errors.Join(
+		registerCollector(registerer, &m.RequestsTotal),
+		registerCollector(registerer, &m.InflightRequests),
+		registerCollector(registerer, &m.RequestDuration),
+		registerCollector(registerer, &m.RequestBytes),
+		registerCollector(registerer, &m.ResponseBytes),
+		registerCollector(registerer, &m.RequestErrorsTotal),
+		registerCollector(registerer, &m.ResponsesTotal),
+		registerCollector(registerer, &m.RedirectRewritesTotal),
+		registerCollector(registerer, &m.HeaderStripsTotal),
+		registerCollector(registerer, &m.HeaderAddsTotal),
+		registerCollector(registerer, &m.UpstreamDuration),
+		registerCollector(registerer, &m.UpstreamTTFB),
+		registerCollector(registerer, &m.UpstreamErrorsTotal),
+		registerCollector(registerer, &m.UpstreamTLSErrorsTotal),
+		registerCollector(registerer, &m.UpstreamGoAwayRetriesTotal),
+		registerCollector(registerer, &m.UpstreamRetryAfterRetriesTotal),
+		registerCollector(registerer, &m.RetryBudgetExhaustedTotal),
+		registerCollector(registerer, &m.CanaryRequestsTotal),
+		registerCollector(registerer, &m.IdempotentReplaysTotal),
+		registerCollector(registerer, &m.SlowRequestsTotal),
+		registerCollector(registerer, &m.ConcurrencyQueueDepth),
+		registerCollector(registerer, &m.ConcurrencyRejectionsTotal),
+		registerCollector(registerer, &m.ConcurrencyQueueWait),
+		registerCollector(registerer, &m.TransportIdleConns),
+		registerCollector(registerer, &m.TransportNewConnsTotal),
+		registerCollector(registerer, &m.TransportReusedConnsTotal),
+		registerCollector(registerer, &m.GlobalRateLimitedTotal),
+		registerCollector(registerer, &m.NoRouteTotal),
+		registerCollector(registerer, &m.BuildInfo),
+		registerCollector(registerer, &m.Up),
+	)
+
+	return err
+}
+
+// usesDefaultMetrics reports whether metrics built from config and extraLabels
+// match defaultMetrics: the default namespace and buckets, and no extra labels.
+func usesDefaultMetrics(config *MetricsConfig, extraLabels []string) (matches bool) {
+	defaultBuckets := func(buckets []float64) (isDefault bool) {
+		isDefault = len(buckets) == 0 || slices.Equal(buckets, DefaultDurationBuckets())
+		return isDefault
+	}
+
+	matches = config.Namespace == defaultMetricsNamespace &&
+		len(extraLabels) == 0 &&
+		defaultBuckets(config.DurationBuckets) &&
+		defaultBuckets(config.UpstreamDurationBuckets)
+	return matches
+}
+
+// routeLabels returns the label values of a per-route series: values followed
+// by the route's value for each extra label, empty for labels the route does
+// not set. A nil route (no route matched) has no extra label values.
+func (m *Metrics) routeLabels(route *RouteConfig, values ...string) (labels []string) {
+	labels = values
+	for _, name := range m.extraLabels {
+		value := ""
+		if route != nil && route.MetricLabelName == name {
+			value = route.MetricLabelValue
+		}
+		labels = append(labels, value)
+	}
+	return labels
+}
+
+// noRoutePrefix returns the path_prefix label of an unmatched request path:
+// its first segment, or NoRoutePrefixOther once maxNoRoutePrefixes distinct
+// prefixes have been seen.
+func (m *Metrics) noRoutePrefix(path string) (prefix string) {
+	segment, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if len(segment) > maxNoRoutePrefixLength {
+		segment = segment[:maxNoRoutePrefixLength]
+	}
+	// Label values must be valid UTF-8; decoded paths need not be
+	prefix = "/" + strings.ToValidUTF8(segment, "\uFFFD")
+
+	m.noRouteMu.Lock()
+	defer m.noRouteMu.Unlock()
+
+	_, seen := m.noRoutePrefixes[prefix]
+	if !seen {
+		if len(m.noRoutePrefixes) >= maxNoRoutePrefixes {
+			prefix = NoRoutePrefixOther
+			return prefix
+		}
+		m.noRoutePrefixes[prefix] = struct{}{}
+	}
+	return prefix
+}
+
+// metricLabelNames returns the distinct MetricLabelName labels of routes, sorted.
+func metricLabelNames(routes []*RouteConfig) (names []string) {
+	for _, route := range routes {
+		if route.MetricLabelName != "" && !slices.Contains(names, route.MetricLabelName) {
+			names = append(names, route.MetricLabelName)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// registerCollector registers *collector, replacing it with the already
+// registered collector of the same name if there is one.
+func registerCollector[T prometheus.Collector](registerer prometheus.Registerer, collector *T) (err error) {
+	err = registerer.Register(*collector)
+	if err == nil {
+		return err
+	}
+
+	var alreadyRegistered prometheus.AlreadyRegisteredError
+	if errors.As(err, &alreadyRegistered) {
+		existing, ok := alreadyRegistered.ExistingCollector.(T)
+		if ok {
+			*collector = existing
+			err = nil
+		}
+	}
 
-//nolint:gochecknoinits // This is how the prometheus magic works.
-func init() {
-	_ = prometheus.Register(ProxyRequestsTotal)
-	_ = prometheus.Register(ProxyRequestDuration)
-	_ = prometheus.Register(ProxyRequestErrorsTotal)
-	_ = prometheus.Register(ProxyResponsesTotal)
-	_ = prometheus.Register(ProxyRedirectRewritesTotal)
-	_ = prometheus.Register(ProxyHeaderStripsTotal)
-	_ = prometheus.Register(ProxyHeaderAddsTotal)
-	_ = prometheus.Register(ProxyUpstreamDuration)
-	_ = prometheus.Register(ProxyUpstreamErrorsTotal)
+	return err
 }
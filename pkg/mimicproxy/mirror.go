@@ -0,0 +1,183 @@
+package mimicproxy
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/sync/semaphore"
+)
+
+const (
+	// maxMirrorBodyBytes is the largest request body buffered for mirroring;
+	// requests with larger bodies are not mirrored.
+	maxMirrorBodyBytes = 1 << 20
+
+	// maxInflightMirrors caps concurrent mirror requests per route. Requests
+	// arriving while the cap is reached are not mirrored.
+	maxInflightMirrors = 100
+)
+
+// mirror replays sampled requests to a shadow upstream and discards the
+// responses. Mirroring never delays or alters the primary request.
+type mirror struct {
+	route    *Route
+	upstream *url.URL
+	client   *http.Client
+	inflight *semaphore.Weighted
+}
+
+// newMirror creates a mirror sending to upstream over transport.
+func newMirror(route *Route, upstream *url.URL, transport http.RoundTripper) (m *mirror) {
+	m = &mirror{
+		route:    route,
+		upstream: upstream,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   route.config.RequestTimeout,
+			CheckRedirect: func(*http.Request, []*http.Request) (err error) {
+				err = http.ErrUseLastResponse
+				return err
+			},
+		},
+		inflight: semaphore.NewWeighted(maxInflightMirrors),
+	}
+	return m
+}
+
+// sample reports whether req should be mirrored.
+func (m *mirror) sample() (sampled bool) {
+	sampled = rand.Float64() < m.route.config.MirrorSampleRate
+	return sampled
+}
+
+// send buffers req's body into one of buffers so both the primary and the
+// mirror can read it, and replays a copy of req to the mirror in the
+// background. The returned request must be used for the primary path.
+func (m *mirror) send(req *http.Request, buffers *requestBuffers) (out *http.Request) {
+	out = req
+
+	var body *bufferedBody
+	if req.Body != nil && req.Body != http.NoBody {
+		if m.route.config.ForceStreamBody {
+			m.route.logger.Debug("Not mirroring request with body on a streaming route",
+				"route", m.route.config.Name,
+				"path", req.URL.Path)
+			return out
+		}
+
+		var err error
+		body, err = buffers.read(req.Body, maxMirrorBodyBytes+1)
+
+		// Hand the primary the full body whatever happens below
+		prefix := body.reader()
+		out = req.Clone(req.Context())
+		out.Body = &multiReadCloser{Reader: io.MultiReader(prefix, req.Body), Closer: closeAll{prefix, req.Body}}
+
+		if err != nil || len(body.bytes()) > maxMirrorBodyBytes {
+			m.route.logger.Debug("Not mirroring request with unreadable or oversized body",
+				"route", m.route.config.Name,
+				"path", req.URL.Path)
+			return out
+		}
+	}
+
+	if !m.inflight.TryAcquire(1) {
+		m.route.logger.Debug("Mirror busy, not mirroring request",
+			"route", m.route.config.Name,
+			"path", req.URL.Path)
+		return out
+	}
+
+	// The mirror outlives the request, so it holds the body until it is done
+	if body != nil {
+		body.retain()
+	}
+	release := func() {
+		m.inflight.Release(1)
+		if body != nil {
+			body.release()
+		}
+	}
+
+	mirrored := m.buildRequest(req, body)
+	started := m.route.workers.start(func() {
+		defer release()
+
+		// Abandon the mirror request when the proxy shuts down
+		ctx, cancel := context.WithCancel(mirrored.Context())
+		defer cancel()
+		stop := context.AfterFunc(m.route.ctx, cancel)
+		defer stop()
+
+		m.replay(mirrored.WithContext(ctx))
+	})
+	if !started {
+		_ = mirrored.Body.Close()
+		release()
+	}
+
+	return out
+}
+
+// buildRequest prepares the copy of req sent to the mirror, rewritten the way
+// the route rewrites requests for its upstream. body is nil for a bodiless
+// request.
+func (m *mirror) buildRequest(req *http.Request, body *bufferedBody) (mirrored *http.Request) {
+	// Detach from the client's request so a finished or cancelled primary
+	// request does not cancel the mirror
+	mirrored = req.Clone(context.WithoutCancel(req.Context()))
+	mirrored.RequestURI = ""
+	mirrored.Body = http.NoBody
+	mirrored.GetBody = nil
+	mirrored.ContentLength = 0
+	mirrored.TransferEncoding = nil
+	if body != nil && len(body.bytes()) > 0 {
+		mirrored.Body = body.reader()
+		mirrored.GetBody = func() (replay io.ReadCloser, err error) {
+			replay = body.reader()
+			return replay, err
+		}
+		mirrored.ContentLength = int64(len(body.bytes()))
+	}
+
+	mirrored.Header = m.route.headerManipulator.ProcessIncoming(mirrored.Header)
+	mirrored.URL.Scheme = m.upstream.Scheme
+	mirrored.URL.Host = m.upstream.Host
+	if m.route.config.UpstreamPathPrefix != "" || m.route.config.StripPathPrefix {
+		m.route.rewritePath(mirrored.URL)
+	}
+	prependBasePath(mirrored.URL, m.upstream)
+	normalizeTrailingSlash(mirrored.URL, m.route.config.TrailingSlash)
+	mirrored.Host = m.upstream.Host
+	removeHopByHopHeaders(mirrored.Header, m.route.hopByHopExemptions)
+
+	return mirrored
+}
+
+// replay sends the mirrored request and discards the response. Failures are
+// logged and never reach the client.
+func (m *mirror) replay(mirrored *http.Request) {
+	var resp *http.Response
+	var err error
+	resp, err = m.client.Do(mirrored)
+	if err != nil {
+		m.route.logger.Warn("Mirror request failed",
+			"route", m.route.config.Name,
+			"mirror_host", m.upstream.Host,
+			"path", mirrored.URL.Path,
+			"error", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		m.route.logger.Warn("Failed to read mirror response",
+			"route", m.route.config.Name,
+			"mirror_host", m.upstream.Host,
+			"error", err)
+	}
+}
@@ -0,0 +1,194 @@
+package mimicproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// oauth2TokenTimeout bounds a single token endpoint request.
+	oauth2TokenTimeout = 10 * time.Second
+
+	// oauth2MaxRefreshLead caps how long before expiry a token is refreshed.
+	oauth2MaxRefreshLead = time.Minute
+)
+
+// oauth2TokenKey is the context key for the bearer token the director injects.
+type oauth2TokenKey struct{}
+
+// oauth2TokenSource obtains client-credentials access tokens for a route and
+// caches them until they expire. Once a token is three quarters through its
+// lifetime (or within oauth2MaxRefreshLead of expiry), the next request
+// triggers a background refresh while the cached token keeps being served.
+type oauth2TokenSource struct {
+	config *OAuth2Config
+	client *http.Client
+	logger Logger
+	route  string
+
+	// ctx bounds token requests; cancelling it stops background refreshes
+	ctx context.Context
+
+	// workers tracks background refreshes; nil outside a Proxy
+	workers *workerGroup
+
+	mu        sync.Mutex
+	token     string
+	expiry    time.Time
+	refreshAt time.Time
+
+	fetches    singleflight.Group
+	refreshing atomic.Bool
+}
+
+// oauth2TokenResponse is the token endpoint response (RFC 6749 section 5.1).
+type oauth2TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// newOAuth2TokenSource creates a token source that calls the token endpoint
+// over transport.
+func newOAuth2TokenSource(config *OAuth2Config, transport http.RoundTripper, routeName string, logger Logger) (source *oauth2TokenSource) {
+	source = &oauth2TokenSource{
+		config: config,
+		client: &http.Client{Transport: transport, Timeout: oauth2TokenTimeout},
+		logger: logger,
+		route:  routeName,
+		ctx:    context.Background(),
+	}
+	return source
+}
+
+// Token returns a valid access token, fetching one synchronously if none is
+// cached or the cached token has expired.
+func (s *oauth2TokenSource) Token() (token string, err error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	token = s.token
+	valid := token != "" && (s.expiry.IsZero() || now.Before(s.expiry))
+	refreshDue := valid && !s.refreshAt.IsZero() && !now.Before(s.refreshAt)
+	s.mu.Unlock()
+
+	if valid {
+		if refreshDue && s.refreshing.CompareAndSwap(false, true) {
+			if !s.workers.start(s.backgroundRefresh) {
+				s.refreshing.Store(false)
+			}
+		}
+		return token, err
+	}
+
+	token, err = s.fetchShared()
+	return token, err
+}
+
+// backgroundRefresh replaces the cached token before it expires. On failure
+// the cached token stays in use and the next request retries.
+func (s *oauth2TokenSource) backgroundRefresh() {
+	defer s.refreshing.Store(false)
+
+	var err error
+	_, err = s.fetchShared()
+	if err != nil {
+		s.logger.Error("Failed to refresh OAuth2 token",
+			"route", s.route,
+			"token_url", s.config.TokenURL,
+			"error", err)
+	}
+}
+
+// fetchShared fetches a new token, collapsing concurrent fetches into one
+// token endpoint request.
+func (s *oauth2TokenSource) fetchShared() (token string, err error) {
+	var result interface{}
+	result, err, _ = s.fetches.Do("token", func() (value interface{}, fetchErr error) {
+		value, fetchErr = s.fetch()
+		return value, fetchErr
+	})
+	if err != nil {
+		return token, err
+	}
+
+	token = result.(string)
+	return token, err
+}
+
+// fetch requests a token from the token endpoint and caches it.
+func (s *oauth2TokenSource) fetch() (token string, err error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(s.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.config.Scopes, " "))
+	}
+
+	var req *http.Request
+	req, err = http.NewRequestWithContext(s.ctx, http.MethodPost, s.config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return token, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	// client_secret_basic: credentials are form-encoded before base64 (RFC 6749 section 2.3.1)
+	req.SetBasicAuth(url.QueryEscape(expandEnvVars(s.config.ClientID)), url.QueryEscape(expandEnvVars(s.config.ClientSecret)))
+
+	var resp *http.Response
+	resp, err = s.client.Do(req)
+	if err != nil {
+		return token, err
+	}
+	defer resp.Body.Close()
+
+	var body []byte
+	body, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		err = fmt.Errorf("failed to read token response: %w", err)
+		return token, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("token endpoint returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		return token, err
+	}
+
+	var tokenResponse oauth2TokenResponse
+	err = json.Unmarshal(body, &tokenResponse)
+	if err != nil {
+		err = fmt.Errorf("invalid token response: %w", err)
+		return token, err
+	}
+
+	if tokenResponse.AccessToken == "" {
+		err = errors.New("token response has no access_token")
+		return token, err
+	}
+
+	token = tokenResponse.AccessToken
+	obtained := time.Now()
+
+	s.mu.Lock()
+	s.token = token
+	s.expiry = time.Time{}
+	s.refreshAt = time.Time{}
+	if tokenResponse.ExpiresIn > 0 {
+		lifetime := time.Duration(tokenResponse.ExpiresIn) * time.Second
+		s.expiry = obtained.Add(lifetime)
+		s.refreshAt = s.expiry.Add(-min(lifetime/4, oauth2MaxRefreshLead))
+	}
+	s.mu.Unlock()
+
+	return token, err
+}
@@ -1,12 +1,26 @@
 package mimicproxy
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	"net/netip"
+	"runtime/debug"
+	"slices"
 	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Proxy is a transparent reverse proxy that provides perfect transparency
@@ -16,10 +30,161 @@ type Proxy struct {
 	routes    []*Route
 	transport *http.Transport
 	logger    Logger
+
+	// metrics is nil when metrics are disabled
+	metrics *Metrics
+
+	// draining is set between Drain and Undrain
+	draining atomic.Bool
+
+	// rateLimit enforces GlobalRateLimit; nil when unlimited
+	rateLimit *tokenBucket
+
+	// certificate is the downstream TLS certificate served by ServerTLS
+	certificate certificateHolder
+
+	// ctx is the base context of background work, cancelled by Close
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// workers tracks background work so Close can wait for it
+	workers workerGroup
+
+	// bodyBuffers recycles the buffers request bodies are read into
+	bodyBuffers *bodyBufferPool
+
+	// redirects tracks chains of rewritten redirects to stop rewrite loops
+	redirects *redirectChains
+
+	// errorTemplate renders error response bodies; nil without an
+	// ErrorResponseTemplate
+	errorTemplate *template.Template
+
+	// connectDial dials CONNECT targets, bypassing the connection tracking
+	// of the transport's dialer
+	connectDial dialFunc
+
+	// servers are the servers running under Serve; once shutDown is set by
+	// Shutdown, Serve refuses to start more
+	serversMu sync.Mutex
+	servers   []*http.Server
+	shutDown  bool
+
+	// stopped ensures the proxy stops counting towards the up metric once,
+	// whether Shutdown, Close, or both are called
+	stopped sync.Once
+}
+
+// contextKey is the type of context keys exported by this package.
+type contextKey string
+
+// ContextKeyRoute is the request context key holding the name (a string) of
+// the route that matched the request. It is set before the request is handed
+// to the route, so the director, Balancer, and transport can read it.
+const ContextKeyRoute contextKey = "mimicproxy.route"
+
+// ContextKeyClientSubject is the request context key holding the subject
+// distinguished name (a string) of the client's verified TLS certificate. It
+// is only set for requests over mTLS connections whose client certificate was
+// verified.
+const ContextKeyClientSubject contextKey = "mimicproxy.client_subject"
+
+// RouteFromContext returns the name of the route that matched the request
+// carrying ctx.
+func RouteFromContext(ctx context.Context) (routeName string, ok bool) {
+	routeName, ok = ctx.Value(ContextKeyRoute).(string)
+	return routeName, ok
+}
+
+// ClientSubjectFromContext returns the subject of the verified client
+// certificate of the request carrying ctx.
+func ClientSubjectFromContext(ctx context.Context) (subject string, ok bool) {
+	subject, ok = ctx.Value(ContextKeyClientSubject).(string)
+	return subject, ok
+}
+
+// Option customizes how New builds a Proxy.
+type Option func(options *proxyOptions)
+
+// proxyOptions holds the dependencies Options can inject.
+type proxyOptions struct {
+	logger    Logger
+	registry  *prometheus.Registry
+	transport *http.Transport
+	balancer  Balancer
+	ctx       context.Context
+	dial      dialFunc
+
+	// transformers are the RouteTransformers by route name
+	transformers map[string]RouteTransformer
+}
+
+// WithLogger sets the Logger, overriding the one built from config.Logger.
+func WithLogger(logger Logger) (option Option) {
+	option = func(options *proxyOptions) {
+		options.logger = logger
+	}
+	return option
+}
+
+// WithRegistry registers the proxy's metrics with registry instead of the
+// default Prometheus registry. Metrics must still be enabled in config.Metrics.
+func WithRegistry(registry *prometheus.Registry) (option Option) {
+	option = func(options *proxyOptions) {
+		options.registry = registry
+	}
+	return option
+}
+
+// WithTransport sets the upstream transport, overriding the one built from
+// config.Transport and config.TLS. The transport is used as-is, so its idle
+// connections are not reflected in the idle connections gauge, and requests
+// failed by an HTTP/2 GOAWAY are only retried if it was set up with
+// http2.ConfigureTransports.
+func WithTransport(transport *http.Transport) (option Option) {
+	option = func(options *proxyOptions) {
+		options.transport = transport
+	}
+	return option
+}
+
+// WithDialContext sets the function the upstream transport dials connections
+// with, such as a SOCKS5 dialer or a service mesh's dialer, in place of a plain
+// TCP dial. Transport.DialTimeout still bounds each dial. It has no effect with
+// WithTransport, whose transport is used as-is, or on Unix socket upstreams.
+func WithDialContext(dial func(ctx context.Context, network string, addr string) (net.Conn, error)) (option Option) {
+	option = func(options *proxyOptions) {
+		options.dial = dial
+	}
+	return option
+}
+
+// WithBalancer sets the Balancer used by every route with Upstreams,
+// overriding the routes' configured Balancer.
+func WithBalancer(balancer Balancer) (option Option) {
+	option = func(options *proxyOptions) {
+		options.balancer = balancer
+	}
+	return option
+}
+
+// WithContext sets the parent context of the proxy's background work, such as
+// mirror requests and OAuth2 token refreshes. Cancelling it, or calling Close,
+// stops that work. Defaults to context.Background.
+func WithContext(ctx context.Context) (option Option) {
+	option = func(options *proxyOptions) {
+		options.ctx = ctx
+	}
+	return option
 }
 
 // New creates a new Proxy instance with the given configuration.
-func New(config *Config) (proxy *Proxy, err error) {
+func New(config *Config, opts ...Option) (proxy *Proxy, err error) {
+	var options proxyOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
 	// Apply defaults
 	config.ApplyDefaults()
 
@@ -31,47 +196,55 @@ func New(config *Config) (proxy *Proxy, err error) {
 	}
 
 	// Create logger
-	var logger Logger
-	if config.Logger.Level == "" || config.Logger.Level == "none" {
-		logger = &NoOpLogger{}
-	} else {
-		var logLevel LogLevel
-		switch config.Logger.Level {
-		case "debug":
-			logLevel = LogLevelDebug
-		case "info":
-			logLevel = LogLevelInfo
-		case "warn":
-			logLevel = LogLevelWarn
-		case "error":
-			logLevel = LogLevelError
-		default:
-			logLevel = LogLevelInfo
-		}
-		logger = NewStandardLogger(logLevel)
+	logger := options.logger
+	if logger == nil {
+		logger = newLogger(&config.Logger)
 	}
 
-	// Create TLS configuration for upstream connections
-	var tlsConfig *tls.Config
-	if config.TLS.CAFile != "" || config.TLS.InsecureSkipVerify {
-		tlsConfig = &tls.Config{
-			InsecureSkipVerify: config.TLS.InsecureSkipVerify,
+	// Create metrics
+	var metrics *Metrics
+	if config.Metrics.Enabled {
+		metrics, err = newProxyMetrics(config, options.registry)
+		if err != nil {
+			err = fmt.Errorf("failed to register metrics: %w", err)
+			return proxy, err
 		}
 	}
 
 	// Create HTTP transport
 	var transport *http.Transport
-	transport, err = NewTransport(&config.Transport, tlsConfig)
+	var template *http.Transport
+	transport, template, err = newProxyTransport(config, &options, metrics)
 	if err != nil {
 		err = fmt.Errorf("failed to create transport: %w", err)
 		return proxy, err
 	}
 
+	dialer := &net.Dialer{
+		Timeout:   config.Transport.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	baseContext := options.ctx
+	if baseContext == nil {
+		baseContext = context.Background()
+	}
+
 	proxy = &Proxy{
 		config:    config,
 		routes:    make([]*Route, 0, len(config.Routes)),
 		transport: transport,
 		logger:    logger,
+		metrics:   metrics,
+
+		bodyBuffers: newBodyBufferPool(config.BodyBufferMaxBytes),
+		redirects:   newRedirectChains(),
+		connectDial: connectDial(&options, dialer),
+	}
+	proxy.ctx, proxy.cancel = context.WithCancel(baseContext)
+
+	if config.GlobalRateLimit != nil {
+		proxy.rateLimit = newTokenBucket(config.GlobalRateLimit.RequestsPerSecond, config.GlobalRateLimit.Burst)
 	}
 
 	// Log proxy initialization
@@ -79,157 +252,1041 @@ func New(config *Config) (proxy *Proxy, err error) {
 		"num_routes", len(config.Routes),
 		"metrics_enabled", config.Metrics.Enabled)
 
-	// Create routes
+	// Unix socket upstreams dial with the transport's settings and, unless
+	// the transport is the caller's, its connection tracking
+	transports := routeTransports{shared: transport, template: template, socketDialer: dialer}
+	if options.transport == nil {
+		transports.connMetrics = metrics
+	}
+
+	err = proxy.addRoutes(&options, transports)
+	if err != nil {
+		proxy.cancel()
+		return proxy, err
+	}
+
+	// Sort routes by priority, then path prefix length (longest first) for correct matching
+	sortRoutesByPrefixLength(proxy.routes)
+
+	if metrics != nil {
+		metrics.startServing()
+	}
+
+	logger.Info("Mimic-proxy initialized successfully")
+
+	return proxy, err
+}
+
+// newLogger creates the logger described by config: none for level "none"
+// or no level, otherwise a StandardLogger.
+func newLogger(config *LoggerConfig) (logger Logger) {
+	if config.Level == "" || config.Level == "none" {
+		logger = &NoOpLogger{}
+		return logger
+	}
+
+	var logLevel LogLevel
+	switch config.Level {
+	case "debug":
+		logLevel = LogLevelDebug
+	case "info":
+		logLevel = LogLevelInfo
+	case "warn":
+		logLevel = LogLevelWarn
+	case "error":
+		logLevel = LogLevelError
+	default:
+		logLevel = LogLevelInfo
+	}
+	logger = NewStandardLogger(logLevel)
+	return logger
+}
+
+// newProxyMetrics creates the proxy's metrics and registers them with
+// registry, or the default registry if it is nil.
+func newProxyMetrics(config *Config, registry *prometheus.Registry) (metrics *Metrics, err error) {
+	var registerer prometheus.Registerer = prometheus.DefaultRegisterer
+	if registry != nil {
+		registerer = registry
+	}
+
+	metrics, err = newMetrics(&config.Metrics, registerer, metricLabelNames(config.Routes))
+	if err != nil {
+		return metrics, err
+	}
+
+	metrics.BuildInfo.WithLabelValues(config.BuildInfo.Version, config.BuildInfo.Commit, config.BuildInfo.BuiltAt).Set(1)
+	return metrics, err
+}
+
+// newProxyTransport returns the transport requests are sent over and the
+// template routes copy their own transports from: the WithTransport
+// transport for both, or a transport built from config, dialing with the
+// WithDialContext function and tracking connections in metrics if not nil.
+func newProxyTransport(config *Config, options *proxyOptions, metrics *Metrics) (transport *http.Transport, template *http.Transport, err error) {
+	if options.transport != nil {
+		transport = options.transport
+		template = transport
+		return transport, template, err
+	}
+
+	// Create TLS configuration for upstream connections
+	var tlsConfig *tls.Config
+	if config.TLS.CAFile != "" || config.TLS.InsecureSkipVerify {
+		tlsConfig = &tls.Config{
+			InsecureSkipVerify: config.TLS.InsecureSkipVerify,
+		}
+	}
+
+	template, err = NewTransport(&config.Transport, tlsConfig)
+	if err != nil {
+		return transport, template, err
+	}
+
+	if options.dial != nil {
+		template.DialContext = withDialTimeout(options.dial, config.Transport.DialTimeout)
+	}
+
+	if metrics != nil {
+		template.DialContext = trackConnections(template.DialContext, metrics)
+	}
+
+	// Routes copy the unconfigured template; requests go over a copy
+	// speaking HTTP/2 through golang.org/x/net/http2
+	transport = template.Clone()
+	err = configureHTTP2(transport)
+	return transport, template, err
+}
+
+// connectDial returns the function CONNECT targets are dialed with. CONNECT
+// tunnels are not pooled upstream connections, so they dial without the
+// connection tracking that feeds the pool metrics.
+func connectDial(options *proxyOptions, dialer *net.Dialer) (dial dialFunc) {
+	switch {
+	case options.transport != nil && options.transport.DialContext != nil:
+		dial = options.transport.DialContext
+	case options.dial != nil:
+		dial = withDialTimeout(options.dial, dialer.Timeout)
+	default:
+		dial = dialer.DialContext
+	}
+	return dial
+}
+
+// addRoutes creates the proxy's routes, sending over transports, with the
+// settings they share: the retry budget, trusted proxies, and error template.
+func (p *Proxy) addRoutes(options *proxyOptions, transports routeTransports) (err error) {
+	config := p.config
+
+	for name := range options.transformers {
+		known := slices.ContainsFunc(config.Routes, func(route *RouteConfig) (match bool) {
+			match = route.Name == name
+			return match
+		})
+		if !known {
+			err = fmt.Errorf("route transformer registered for unknown route: %s", name)
+			return err
+		}
+	}
+
+	// One retry budget is shared by all routes
+	var budget *retryBudget
+	if config.RetryBudget > 0 {
+		budget = newRetryBudget(config.RetryBudget)
+	}
+
+	var trustedProxies []netip.Prefix
+	trustedProxies, err = parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		err = fmt.Errorf("invalid trusted proxies: %w", err)
+		return err
+	}
+
+	if config.ErrorResponseTemplate != "" {
+		p.errorTemplate, err = parseErrorTemplate(config.ErrorResponseTemplate)
+		if err != nil {
+			err = fmt.Errorf("invalid error response template: %w", err)
+			return err
+		}
+	}
+
 	for _, routeConfig := range config.Routes {
 		var route *Route
-		route, err = NewRoute(routeConfig, transport, logger)
+		route, err = newRoute(routeConfig, transports, p.logger)
 		if err != nil {
 			err = fmt.Errorf("failed to create route %s: %w", routeConfig.Name, err)
-			return proxy, err
+			return err
+		}
+		if !routeConfig.DisableMetrics {
+			route.metrics = p.metrics
 		}
-		proxy.routes = append(proxy.routes, route)
-		logger.Debug("Created route",
+		route.retryBudget = budget
+		route.trustedProxies = trustedProxies
+		route.errorTemplate = p.errorTemplate
+		route.transformer = options.transformers[routeConfig.Name]
+		route.setBackground(p.ctx, &p.workers)
+		if options.balancer != nil && route.balancer != nil {
+			route.balancer = options.balancer
+		}
+		p.routes = append(p.routes, route)
+		p.logger.Debug("Created route",
 			"name", routeConfig.Name,
 			"path_prefix", routeConfig.PathPrefix,
 			"upstream", routeConfig.Upstream)
 	}
-
-	// Sort routes by path prefix length (longest first) for correct matching
-	sortRoutesByPrefixLength(proxy.routes)
-
-	logger.Info("Mimic-proxy initialized successfully")
-
-	return proxy, err
+	return err
 }
 
 // ServeHTTP implements http.Handler for use in HTTP servers.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
 
-	// Find matching route
+	// Wrap response writer to capture status code. This happens first so that
+	// panic recovery can tell whether the response has already started.
+	statusWriter := &statusCapturingResponseWriter{
+		ResponseWriter: w,
+		statusCode:     http.StatusOK,
+	}
+	w = statusWriter
+
 	var matchedRoute *Route
-	for _, route := range p.routes {
-		if route.Match(r) {
-			matchedRoute = route
-			break
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			p.handlePanic(statusWriter, r, matchedRoute, recovered)
+		}
+	}()
+
+	// HTTP/1.0 clients get an HTTP/1.1 upstream's response framed by
+	// closing the connection, never chunked; say so and don't keep it alive
+	if r.ProtoMajor == 1 && r.ProtoMinor == 0 {
+		w.Header().Set("Connection", "close")
+	}
+
+	// Turn away new requests while draining; in-flight requests finish
+	if p.draining.Load() {
+		w.Header().Set("Connection", "close")
+		p.writeError(w, nil, http.StatusServiceUnavailable, "Proxy is draining")
+		return
+	}
+
+	// Tunnel CONNECT requests in forward-proxy mode; they never match a route
+	// but are held to the same header and global rate limits
+	if r.Method == http.MethodConnect && p.config.AllowConnect {
+		if p.rejectOversizedHeaders(w, r, nil) || p.rejectOverRateLimit(w, r, nil) {
+			return
 		}
+		p.handleConnect(w, r)
+		return
 	}
 
+	// Find matching route
+	matchedRoute = p.matchRoute(r)
 	if matchedRoute == nil {
-		p.logger.Warn("No matching route found",
+		p.handleNoRoute(w, r)
+		return
+	}
+
+	routeName := matchedRoute.config.Name
+	routeConfig := matchedRoute.config
+
+	// HTTP/1.0 clients must not be sent interim responses
+	statusWriter.forwardEarlyHints = routeConfig.ForwardEarlyHints && r.ProtoAtLeast(1, 1)
+
+	// Routes with DisableMetrics have no metrics
+	metrics := matchedRoute.metrics
+
+	// Reject oversized header blocks before anything reaches the upstream
+	if p.rejectOversizedHeaders(w, r, matchedRoute) {
+		return
+	}
+
+	r = withRouteContext(r, routeName)
+
+	// Sample the per-request debug logs; warnings and errors are never sampled
+	logSampled := p.config.Logger.SampleRate >= 1 || rand.Float64() < p.config.Logger.SampleRate
+
+	if logSampled {
+		p.logger.Debug("Handling request",
+			"route", routeName,
 			"path", r.URL.Path,
 			"method", r.Method,
 			"remote_addr", r.RemoteAddr)
+	}
+
+	// Track metrics if enabled
+	if metrics != nil {
+		metrics.RequestsTotal.WithLabelValues(metrics.routeLabels(routeConfig, routeName, r.Method)...).Inc()
+
+		// Deferred so the gauge is decremented on every exit path, including panics
+		inflight := metrics.InflightRequests.WithLabelValues(metrics.routeLabels(routeConfig, routeName)...)
+		inflight.Inc()
+		defer inflight.Dec()
+	}
+
+	// Count request body bytes when the client didn't declare a Content-Length
+	var requestBody *countingReadCloser
+	if metrics != nil && r.ContentLength < 0 && r.Body != nil {
+		requestBody = &countingReadCloser{ReadCloser: r.Body}
+		r.Body = requestBody
+	}
+
+	// Proxy the request
+	p.handleRoute(w, r, matchedRoute)
+
+	// Record metrics and log completion
+	duration := time.Since(startTime)
+	p.recordRequest(r, matchedRoute, statusWriter, requestBody, duration)
+	p.logCompletion(r, routeName, statusWriter.statusCode, duration, logSampled)
+}
+
+// handleNoRoute answers a request that matched no route with 404 Not Found.
+func (p *Proxy) handleNoRoute(w http.ResponseWriter, r *http.Request) {
+	p.logger.Warn("No matching route found",
+		"path", r.URL.Path,
+		"method", r.Method,
+		"remote_addr", r.RemoteAddr)
+
+	if p.metrics != nil {
+		p.metrics.RequestErrorsTotal.WithLabelValues(p.metrics.routeLabels(nil, "none", r.Method)...).Inc()
+		p.metrics.NoRouteTotal.WithLabelValues(p.metrics.noRoutePrefix(r.URL.Path)).Inc()
+	}
+
+	p.writeError(w, nil, http.StatusNotFound, "No route found")
+}
+
+// withRouteContext exposes the matched route, and the verified mTLS client
+// identity if there is one, to everything downstream of routing.
+func withRouteContext(r *http.Request, routeName string) (annotated *http.Request) {
+	annotated = r.WithContext(context.WithValue(r.Context(), ContextKeyRoute, routeName))
+
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		subject := r.TLS.VerifiedChains[0][0].Subject.String()
+		annotated = annotated.WithContext(context.WithValue(annotated.Context(), ContextKeyClientSubject, subject))
+	}
+	return annotated
+}
+
+// recordRequest records the metrics of a completed request and warns about
+// it if it was slow. requestBody counts the body of requests without a
+// Content-Length, and is nil for others.
+func (p *Proxy) recordRequest(r *http.Request, route *Route, statusWriter *statusCapturingResponseWriter, requestBody *countingReadCloser, duration time.Duration) {
+	routeConfig := route.config
+	routeName := routeConfig.Name
 
-		if p.config.Metrics.Enabled {
-			ProxyRequestErrorsTotal.WithLabelValues("none", r.Method).Inc()
+	// Routes with DisableMetrics have no metrics
+	metrics := route.metrics
+	if metrics != nil {
+		metrics.RequestDuration.WithLabelValues(metrics.routeLabels(routeConfig, routeName, r.Method)...).Observe(duration.Seconds())
+		metrics.ResponsesTotal.WithLabelValues(metrics.routeLabels(routeConfig, routeName, r.Method, strconv.Itoa(statusWriter.statusCode))...).Inc()
+		metrics.ResponseBytes.WithLabelValues(metrics.routeLabels(routeConfig, routeName)...).Observe(float64(statusWriter.bytesWritten))
+
+		requestBytes := r.ContentLength
+		if requestBody != nil {
+			requestBytes = requestBody.bytesRead.Load()
 		}
+		metrics.RequestBytes.WithLabelValues(metrics.routeLabels(routeConfig, routeName)...).Observe(float64(requestBytes))
+	}
 
-		http.Error(w, "No route found", http.StatusNotFound)
-		return
+	// Warn about slow requests whatever their status
+	threshold := routeConfig.SlowRequestThreshold
+	if threshold > 0 && duration > threshold {
+		p.logger.Warn("Slow request",
+			"route", routeName,
+			"path", r.URL.Path,
+			"method", r.Method,
+			"status", statusWriter.statusCode,
+			"duration_ms", duration.Milliseconds(),
+			"threshold_ms", threshold.Milliseconds())
+
+		if metrics != nil {
+			metrics.SlowRequestsTotal.WithLabelValues(metrics.routeLabels(routeConfig, routeName)...).Inc()
+		}
 	}
+}
 
-	routeName := matchedRoute.config.Name
+// logCompletion logs a completed request at a level based on its status:
+// errors for 5xx, warnings for 4xx, and debug logs for the rest if sampled.
+func (p *Proxy) logCompletion(r *http.Request, routeName string, status int, duration time.Duration, logSampled bool) {
+	var log func(msg string, keysAndValues ...interface{})
+	switch {
+	case status >= 500:
+		log = p.logger.Error
+	case status >= 400:
+		log = p.logger.Warn
+	case logSampled:
+		log = p.logger.Debug
+	default:
+		return
+	}
 
-	p.logger.Debug("Handling request",
+	log("Request completed",
 		"route", routeName,
 		"path", r.URL.Path,
 		"method", r.Method,
+		"status", status,
+		"duration_ms", duration.Milliseconds(),
 		"remote_addr", r.RemoteAddr)
+}
 
-	// Track metrics if enabled
-	if p.config.Metrics.Enabled {
-		ProxyRequestsTotal.WithLabelValues(routeName, r.Method).Inc()
+// MatchRoute returns the configuration of the route that would handle the
+// request, using the same priority and longest-prefix matching as ServeHTTP.
+// The request is not modified.
+func (p *Proxy) MatchRoute(r *http.Request) (config *RouteConfig, matched bool) {
+	route := p.matchRoute(r)
+	if route == nil {
+		return config, matched
 	}
 
-	// If redirect rewriting is enabled, wrap the response writer
-	if matchedRoute.config.RewriteRedirects {
-		// Determine incoming scheme
-		scheme := "https"
-		if r.TLS == nil {
-			scheme = "http"
+	config = route.config
+	matched = true
+	return config, matched
+}
+
+// matchRoute returns the route that handles the request, or nil if none does.
+// Routes are sorted by priority and then longest prefix first, so the first
+// match wins.
+func (p *Proxy) matchRoute(r *http.Request) (matchedRoute *Route) {
+	for _, route := range p.routes {
+		if route.Match(r) {
+			matchedRoute = route
+			return matchedRoute
 		}
-		if forwardedProto := r.Header.Get("X-Forwarded-Proto"); forwardedProto != "" {
-			scheme = forwardedProto
+	}
+
+	return matchedRoute
+}
+
+// handleRoute applies route-level request checks and proxies the request to the
+// route's upstream. Rejections are written to w and recorded like any other response.
+func (p *Proxy) handleRoute(w http.ResponseWriter, r *http.Request, route *Route) {
+	if p.answerWithoutUpstream(w, r, route) {
+		return
+	}
+
+	// Limit concurrent requests to the upstream. The deferred release also runs
+	// if proxying panics, so a slot is never leaked.
+	if route.concurrency != nil {
+		if !p.acquireConcurrencySlot(r, route) {
+			p.writeError(w, route, http.StatusServiceUnavailable, "Too many concurrent requests")
+			return
 		}
+		defer route.concurrency.Release(1)
+	}
+
+	// Bound the whole upstream exchange; long-lived routes run until either
+	// side closes
+	var cancel context.CancelFunc
+	r, cancel = route.withDeadline(r)
+	defer cancel()
+
+	// Report completion to balancers that track requests in flight
+	var done func()
+	r, done = route.trackUpstreamSelection(r)
+	defer done()
+
+	// Buffered request bodies go back to the pool once the request is done
+	buffers := &requestBuffers{pool: p.bodyBuffers}
+	defer buffers.release()
+
+	var ok bool
+	r, ok = p.prepareRequest(w, r, route, buffers)
+	if !ok {
+		return
+	}
+
+	// Replay the response to an earlier request with the same idempotency
+	// key, or record this one's for later duplicates
+	var recorder *idempotencyRecorder
+	var replayed bool
+	recorder, r, replayed = p.beginIdempotent(w, r, route, buffers)
+	if replayed {
+		return
+	}
+	if recorder != nil {
+		// Finishing also releases the duplicates if proxying panics
+		defer recorder.finish()
+		w = recorder
+	}
+
+	// Shadow a sample of traffic to the mirror without waiting for it
+	if route.mirror != nil && route.mirror.sample() {
+		r = route.mirror.send(r, buffers)
+	}
+
+	// Snapshot hop-by-hop headers the route preserves so they survive ReverseProxy
+	r = route.withPreservedHeaders(r)
+
+	// Write the upstream's raw header order and casing straight to the client
+	if route.config.PreserveHeaderCasingAndOrder {
+		capture := &headerCapture{}
+		r = r.WithContext(context.WithValue(r.Context(), headerCaptureKey{}, capture))
 
-		// Wrap response writer to intercept redirects
-		wrappedWriter := &redirectRewritingResponseWriter{
+		orderedWriter := &headerOrderResponseWriter{
 			ResponseWriter: w,
-			route:          matchedRoute,
-			routes:         p.routes,
-			incomingHost:   r.Host,
-			incomingScheme: scheme,
+			capture:        capture,
 			logger:         p.logger,
-			metricsEnabled: p.config.Metrics.Enabled,
+			routeName:      route.config.Name,
 		}
-		w = wrappedWriter
+		orderedWriter.status, _ = w.(*statusCapturingResponseWriter)
+		defer orderedWriter.finish()
+		w = orderedWriter
 	}
 
-	// Wrap response writer to capture status code
-	statusWriter := &statusCapturingResponseWriter{
-		ResponseWriter: w,
-		statusCode:     http.StatusOK,
+	// If redirect, challenge, or link rewriting is enabled, wrap the response writer
+	if route.config.RewriteRedirects || route.config.RewriteAuthChallenge || route.config.RewriteLinkHeader {
+		w = p.redirectRewritingWriter(w, r, route)
 	}
 
-	// Proxy the request
-	matchedRoute.reverseProxy.ServeHTTP(statusWriter, r)
-
-	// Record metrics and log completion
-	duration := time.Since(startTime)
+	route.reverseProxy.ServeHTTP(w, r)
 
-	if p.config.Metrics.Enabled {
-		ProxyRequestDuration.WithLabelValues(routeName, r.Method).Observe(duration.Seconds())
-		ProxyResponsesTotal.WithLabelValues(routeName, r.Method, strconv.Itoa(statusWriter.statusCode)).Inc()
+	// Only a response proxied to the end is kept for replay
+	if recorder != nil {
+		recorder.completed = true
 	}
+}
+
+// answerWithoutUpstream answers requests the route turns away or serves
+// itself: during maintenance, with a static response, for disallowed
+// methods, and over the global rate limit. It reports whether it did.
+func (p *Proxy) answerWithoutUpstream(w http.ResponseWriter, r *http.Request, route *Route) (answered bool) {
+	answered = true
 
-	// Log completion at appropriate level based on status code
 	switch {
-	case statusWriter.statusCode >= 500:
-		p.logger.Error("Request completed",
-			"route", routeName,
+	case route.maintenance.Load():
+		// Turn requests away while the route is in maintenance
+		p.writeError(w, route, http.StatusServiceUnavailable, "Route is in maintenance")
+	case route.config.StaticResponse != nil:
+		// Serve the canned response without contacting the upstream
+		route.serveStatic(w)
+	case !route.methodAllowed(r.Method):
+		// Reject disallowed methods before anything reaches the upstream
+		w.Header().Set("Allow", route.allowHeader)
+		p.writeError(w, route, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+	default:
+		// Hold all routes together to the global upstream request rate
+		answered = p.rejectOverRateLimit(w, r, route)
+	}
+
+	return answered
+}
+
+// prepareRequest runs the route's request body checks and rewrites, and
+// obtains its upstream OAuth2 token. A request that fails any of them is
+// answered with an error and ok is false.
+func (p *Proxy) prepareRequest(w http.ResponseWriter, r *http.Request, route *Route, buffers *requestBuffers) (prepared *http.Request, ok bool) {
+	prepared, ok = p.verifySignature(w, r, route, buffers)
+	if !ok {
+		return prepared, ok
+	}
+
+	prepared, ok = p.attachOAuth2Token(w, prepared, route)
+	if !ok {
+		return prepared, ok
+	}
+
+	prepared, ok = p.validateSchema(w, prepared, route, buffers)
+	if !ok {
+		return prepared, ok
+	}
+
+	prepared, ok = p.transformBody(w, prepared, route)
+	if !ok {
+		return prepared, ok
+	}
+
+	prepared, ok = p.hashBodyForSigning(w, prepared, route, buffers)
+	return prepared, ok
+}
+
+// verifySignature rejects requests whose body signature doesn't verify.
+func (p *Proxy) verifySignature(w http.ResponseWriter, r *http.Request, route *Route, buffers *requestBuffers) (verified *http.Request, ok bool) {
+	verified = r
+	ok = true
+	if route.config.VerifyHMAC == nil {
+		return verified, ok
+	}
+
+	var err error
+	verified, err = verifyRequestSignature(r, route.config.VerifyHMAC, buffers)
+	if err != nil {
+		p.logger.Warn("Request signature verification failed",
+			"route", route.config.Name,
 			"path", r.URL.Path,
 			"method", r.Method,
-			"status", statusWriter.statusCode,
-			"duration_ms", duration.Milliseconds(),
-			"remote_addr", r.RemoteAddr)
-	case statusWriter.statusCode >= 400:
-		p.logger.Warn("Request completed",
-			"route", routeName,
+			"error", err)
+
+		switch {
+		case errors.Is(err, errSignatureMismatch):
+			p.writeError(w, route, http.StatusUnauthorized, "Invalid request signature")
+		default:
+			status := bodyErrorStatus(err)
+			p.writeError(w, route, status, http.StatusText(status))
+		}
+		ok = false
+	}
+	return verified, ok
+}
+
+// attachOAuth2Token obtains the upstream OAuth2 token for the director,
+// failing closed if none is available.
+func (p *Proxy) attachOAuth2Token(w http.ResponseWriter, r *http.Request, route *Route) (authorized *http.Request, ok bool) {
+	authorized = r
+	ok = true
+	if route.oauth2 == nil || route.preservesClientAuth(r) {
+		return authorized, ok
+	}
+
+	var token string
+	var err error
+	token, err = route.oauth2.Token()
+	if err != nil {
+		p.logger.Error("Failed to obtain OAuth2 token",
+			"route", route.config.Name,
+			"token_url", route.config.OAuth2.TokenURL,
+			"error", err)
+		p.writeError(w, route, http.StatusServiceUnavailable, "Upstream authentication unavailable")
+		ok = false
+		return authorized, ok
+	}
+
+	authorized = r.WithContext(context.WithValue(r.Context(), oauth2TokenKey{}, token))
+	return authorized, ok
+}
+
+// validateSchema rejects JSON request bodies that don't match the route's schema.
+func (p *Proxy) validateSchema(w http.ResponseWriter, r *http.Request, route *Route, buffers *requestBuffers) (validated *http.Request, ok bool) {
+	validated = r
+	ok = true
+	if route.requestSchema == nil {
+		return validated, ok
+	}
+
+	var err error
+	validated, err = validateRequestBody(r, route.requestSchema, buffers)
+	if err != nil {
+		p.logger.Warn("Request body failed schema validation",
+			"route", route.config.Name,
 			"path", r.URL.Path,
 			"method", r.Method,
-			"status", statusWriter.statusCode,
-			"duration_ms", duration.Milliseconds(),
-			"remote_addr", r.RemoteAddr)
-	default:
-		p.logger.Debug("Request completed",
-			"route", routeName,
+			"error", err)
+
+		var violation *schemaViolationError
+		if errors.As(err, &violation) {
+			p.writeError(w, route, http.StatusBadRequest, violation.Error())
+		} else {
+			status := bodyErrorStatus(err)
+			p.writeError(w, route, status, http.StatusText(status))
+		}
+		ok = false
+	}
+	return validated, ok
+}
+
+// transformBody rewrites JSON request bodies before they are forwarded (or
+// mirrored).
+func (p *Proxy) transformBody(w http.ResponseWriter, r *http.Request, route *Route) (transformed *http.Request, ok bool) {
+	transformed = r
+	ok = true
+	if route.config.RequestBodyTransform == nil {
+		return transformed, ok
+	}
+
+	var err error
+	transformed, err = transformRequestBody(r, route.config.RequestBodyTransform)
+	if err != nil {
+		p.logger.Warn("Request body transform failed",
+			"route", route.config.Name,
 			"path", r.URL.Path,
 			"method", r.Method,
-			"status", statusWriter.statusCode,
-			"duration_ms", duration.Milliseconds(),
-			"remote_addr", r.RemoteAddr)
+			"error", err)
+
+		status := bodyErrorStatus(err)
+		p.writeError(w, route, status, http.StatusText(status))
+		ok = false
+	}
+	return transformed, ok
+}
+
+// hashBodyForSigning hashes the final request body for the director to sign.
+func (p *Proxy) hashBodyForSigning(w http.ResponseWriter, r *http.Request, route *Route, buffers *requestBuffers) (hashed *http.Request, ok bool) {
+	hashed = r
+	ok = true
+	if route.config.SignRequests == nil {
+		return hashed, ok
+	}
+
+	var err error
+	hashed, err = hashRequestBody(r, route.config.SignRequests.Algorithm, buffers)
+	if err != nil {
+		p.logger.Warn("Failed to buffer request body for signing",
+			"route", route.config.Name,
+			"path", r.URL.Path,
+			"method", r.Method,
+			"error", err)
+
+		status := bodyErrorStatus(err)
+		p.writeError(w, route, status, http.StatusText(status))
+		ok = false
+	}
+	return hashed, ok
+}
+
+// bodyErrorStatus returns the status answering a request whose body could not
+// be read or buffered: 413 for bodies too large to buffer, 400 otherwise.
+func bodyErrorStatus(err error) (status int) {
+	status = http.StatusBadRequest
+	if errors.Is(err, errRequestBodyTooLarge) {
+		status = http.StatusRequestEntityTooLarge
+	}
+	return status
+}
+
+// beginIdempotent handles a request carrying the route's idempotency key. A
+// duplicate of an earlier request is answered with its response, waiting for
+// it if it is still in flight, and replayed is true. The first request with
+// a key gets a recorder to write its response through, which must be
+// finished once the request is done.
+func (p *Proxy) beginIdempotent(w http.ResponseWriter, r *http.Request, route *Route, buffers *requestBuffers) (recorder *idempotencyRecorder, next *http.Request, replayed bool) {
+	next = r
+	if route.idempotency == nil {
+		return recorder, next, replayed
+	}
+
+	idempotencyKey := r.Header.Get(route.idempotency.header)
+	if idempotencyKey == "" {
+		return recorder, next, replayed
+	}
+
+	var body []byte
+	var err error
+	next, body, err = bufferRequestBody(r, buffers)
+	if err != nil {
+		p.logger.Warn("Failed to buffer request body for idempotency key",
+			"route", route.config.Name,
+			"path", r.URL.Path,
+			"method", r.Method,
+			"error", err)
+
+		status := bodyErrorStatus(err)
+		p.writeError(w, route, status, http.StatusText(status))
+		replayed = true
+		return recorder, next, replayed
+	}
+
+	idempotencyKey = route.idempotency.storeKey(next, idempotencyKey)
+	requestHash := hashRequest(body)
+	entry, first := route.idempotency.begin(idempotencyKey, requestHash, time.Now())
+	if !first {
+		if entry.requestHash != requestHash {
+			p.logger.Warn("Idempotency key reused for a different request",
+				"route", route.config.Name,
+				"path", next.URL.Path,
+				"method", next.Method)
+			p.writeError(w, route, http.StatusUnprocessableEntity, "Idempotency key reused for a different request")
+			replayed = true
+			return recorder, next, replayed
+		}
+
+		replayed = p.replayIdempotent(w, next, route, entry)
+		return recorder, next, replayed
+	}
+
+	recorder = &idempotencyRecorder{
+		ResponseWriter: w,
+		store:          route.idempotency,
+		key:            idempotencyKey,
+		entry:          entry,
+	}
+	next = next.WithContext(context.WithValue(next.Context(), idempotencyRecorderKey{}, recorder))
+	return recorder, next, replayed
+}
+
+// redirectRewritingWriter wraps w to rewrite the redirects, authentication
+// challenges, and Link headers of the response to r.
+func (p *Proxy) redirectRewritingWriter(w http.ResponseWriter, r *http.Request, route *Route) (wrapped http.ResponseWriter) {
+	// Determine incoming scheme
+	scheme := "https"
+	if r.TLS == nil {
+		scheme = "http"
+	}
+	if forwardedProto := r.Header.Get("X-Forwarded-Proto"); forwardedProto != "" {
+		scheme = forwardedProto
+	}
+
+	wrapped = &redirectRewritingResponseWriter{
+		ResponseWriter: w,
+		route:          route,
+		routes:         p.routes,
+		incomingHost:   r.Host,
+		incomingScheme: scheme,
+		logger:         p.logger,
+		metrics:        route.metrics,
+		redirects:      p.redirects,
+		maxRedirects:   p.config.MaxRedirectRewrites,
+		client:         redirectClient(r.RemoteAddr),
+		requestTarget:  r.Host + r.URL.RequestURI(),
+	}
+	return wrapped
+}
+
+// replayIdempotent waits for the first request with the same idempotency key
+// as r and writes its response to w, reporting whether it did. A request whose
+// original response was not recorded is forwarded like any other.
+func (p *Proxy) replayIdempotent(w http.ResponseWriter, r *http.Request, route *Route, entry *idempotencyEntry) (replayed bool) {
+	var response *recordedResponse
+	var err error
+	response, err = route.idempotency.await(r.Context(), entry)
+	if err != nil {
+		// The client gave up waiting; the status only reaches logs and metrics
+		w.WriteHeader(StatusClientClosedRequest)
+		replayed = true
+		return replayed
 	}
+	if response == nil {
+		p.logger.Warn("No response recorded for idempotency key; forwarding duplicate request",
+			"route", route.config.Name,
+			"path", r.URL.Path,
+			"method", r.Method)
+		return replayed
+	}
+
+	p.logger.Debug("Replaying response for idempotency key",
+		"route", route.config.Name,
+		"path", r.URL.Path,
+		"method", r.Method,
+		"status", response.status)
+
+	if route.metrics != nil {
+		route.metrics.IdempotentReplaysTotal.WithLabelValues(route.metrics.routeLabels(route.config, route.config.Name)...).Inc()
+	}
+
+	response.replay(w)
+	replayed = true
+	return replayed
 }
 
-// Close gracefully shuts down the proxy, closing all connections.
+// acquireConcurrencySlot reserves one of the route's MaxConcurrent slots,
+// queueing up to QueueTimeout for one to free up unless QueueDepth requests
+// are already waiting. Slots are handed to queued requests in arrival order.
+// The caller must release the slot if one was acquired.
+func (p *Proxy) acquireConcurrencySlot(r *http.Request, route *Route) (acquired bool) {
+	acquired = route.concurrency.TryAcquire(1)
+
+	queueFull := false
+	if !acquired && route.config.QueueTimeout > 0 {
+		queued := route.queued.Add(1)
+		defer route.queued.Add(-1)
+		queueFull = route.config.QueueDepth > 0 && queued > int64(route.config.QueueDepth)
+	}
+
+	if !acquired && route.config.QueueTimeout > 0 && !queueFull {
+		if route.metrics != nil {
+			queueDepth := route.metrics.ConcurrencyQueueDepth.WithLabelValues(route.metrics.routeLabels(route.config, route.config.Name)...)
+			queueDepth.Inc()
+			defer queueDepth.Dec()
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), route.config.QueueTimeout)
+		defer cancel()
+
+		start := time.Now()
+		var err error
+		err = route.concurrency.Acquire(ctx, 1)
+		acquired = err == nil
+
+		if route.metrics != nil {
+			route.metrics.ConcurrencyQueueWait.WithLabelValues(route.metrics.routeLabels(route.config, route.config.Name)...).Observe(time.Since(start).Seconds())
+		}
+	}
+
+	if !acquired {
+		p.logger.Warn("Route concurrency limit reached",
+			"route", route.config.Name,
+			"max_concurrent", route.config.MaxConcurrent,
+			"queue_full", queueFull,
+			"path", r.URL.Path,
+			"method", r.Method)
+
+		if route.metrics != nil {
+			route.metrics.ConcurrencyRejectionsTotal.WithLabelValues(route.metrics.routeLabels(route.config, route.config.Name)...).Inc()
+		}
+	}
+
+	return acquired
+}
+
+// rejectOversizedHeaders responds 431 Request Header Fields Too Large to a
+// request whose header block is over MaxHeaderBytes, reporting whether it did.
+// route is nil for CONNECT requests.
+func (p *Proxy) rejectOversizedHeaders(w http.ResponseWriter, r *http.Request, route *Route) (rejected bool) {
+	if p.config.MaxHeaderBytes <= 0 || headerSize(r.Header) <= p.config.MaxHeaderBytes {
+		return rejected
+	}
+
+	// Routes with DisableMetrics have no metrics
+	routeName := "none"
+	var routeConfig *RouteConfig
+	metrics := p.metrics
+	if route != nil {
+		routeName = route.config.Name
+		routeConfig = route.config
+		metrics = route.metrics
+	}
+
+	p.logger.Warn("Request headers too large",
+		"route", routeName,
+		"max_header_bytes", p.config.MaxHeaderBytes,
+		"path", r.URL.Path,
+		"method", r.Method)
+
+	if metrics != nil {
+		metrics.RequestErrorsTotal.WithLabelValues(metrics.routeLabels(routeConfig, routeName, r.Method)...).Inc()
+	}
+
+	p.writeError(w, route, http.StatusRequestHeaderFieldsTooLarge, http.StatusText(http.StatusRequestHeaderFieldsTooLarge))
+	rejected = true
+	return rejected
+}
+
+// rejectOverRateLimit takes a token from the global rate limit for r,
+// responding 429 and reporting that it did if none is left. route is nil for
+// CONNECT requests.
+func (p *Proxy) rejectOverRateLimit(w http.ResponseWriter, r *http.Request, route *Route) (rejected bool) {
+	if p.rateLimit == nil {
+		return rejected
+	}
+
+	var allowed bool
+	var retryAfter time.Duration
+	allowed, retryAfter = p.rateLimit.take(time.Now())
+	if !allowed {
+		p.rejectRateLimited(w, r, route, retryAfter)
+		rejected = true
+	}
+	return rejected
+}
+
+// rejectRateLimited responds 429 Too Many Requests to a request over the
+// global rate limit, with a Retry-After of whole seconds until it would pass.
+// route is nil for CONNECT requests.
+func (p *Proxy) rejectRateLimited(w http.ResponseWriter, r *http.Request, route *Route, retryAfter time.Duration) {
+	routeName := "none"
+	var routeConfig *RouteConfig
+	metrics := p.metrics
+	if route != nil {
+		routeName = route.config.Name
+		routeConfig = route.config
+		metrics = route.metrics
+	}
+
+	p.logger.Warn("Global rate limit exceeded",
+		"route", routeName,
+		"path", r.URL.Path,
+		"method", r.Method,
+		"retry_after_ms", retryAfter.Milliseconds())
+
+	if metrics != nil {
+		metrics.GlobalRateLimitedTotal.WithLabelValues(metrics.routeLabels(routeConfig, routeName)...).Inc()
+	}
+
+	seconds := max(int(math.Ceil(retryAfter.Seconds())), 1)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	p.writeError(w, route, http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests))
+}
+
+// handlePanic logs a panic recovered from the handler chain, records it as a
+// request error, and returns a 500 to the client if the response hasn't started.
+// route is nil if the panic happened before a route matched.
+func (p *Proxy) handlePanic(w *statusCapturingResponseWriter, r *http.Request, route *Route, recovered interface{}) {
+	// ErrAbortHandler is the sanctioned way to abort a response (ReverseProxy uses it
+	// when the upstream body fails mid-copy), so let net/http handle it silently.
+	recoveredErr, isError := recovered.(error)
+	if isError && errors.Is(recoveredErr, http.ErrAbortHandler) {
+		panic(recovered)
+	}
+
+	routeName := "none"
+	metrics := p.metrics
+	var routeConfig *RouteConfig
+	if route != nil {
+		routeName = route.config.Name
+		metrics = route.metrics
+		routeConfig = route.config
+	}
+
+	p.logger.Error("Recovered from panic while handling request",
+		"route", routeName,
+		"path", r.URL.Path,
+		"method", r.Method,
+		"remote_addr", r.RemoteAddr,
+		"panic", recovered,
+		"stack", string(debug.Stack()))
+
+	if metrics != nil {
+		metrics.RequestErrorsTotal.WithLabelValues(metrics.routeLabels(routeConfig, routeName, r.Method)...).Inc()
+	}
+
+	if !w.wroteHeader {
+		p.writeError(w, route, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+	}
+}
+
+// Close gracefully shuts down the proxy, closing idle connections and
+// stopping background work such as mirror requests and OAuth2 token
+// refreshes. It waits for that work to finish, returning an error if it has
+// not stopped within a few seconds. Calling Close again is safe.
 func (p *Proxy) Close() (err error) {
+	p.cancel()
+	p.stopServing()
+
 	if p.transport != nil {
 		p.transport.CloseIdleConnections()
 	}
+
+	for _, route := range p.routes {
+		if route.transport != nil {
+			route.transport.CloseIdleConnections()
+		}
+		if route.sniTransports != nil {
+			route.sniTransports.closeIdleConnections()
+		}
+	}
+
+	err = p.workers.stop(closeTimeout)
 	return err
 }
 
-// statusCapturingResponseWriter wraps http.ResponseWriter to capture the status code.
+// stopServing drops the proxy from the up metric.
+func (p *Proxy) stopServing() {
+	p.stopped.Do(func() {
+		if p.metrics != nil {
+			p.metrics.stopServing()
+		}
+	})
+}
+
+// statusCapturingResponseWriter wraps http.ResponseWriter to capture the status code
+// and the number of body bytes written.
 type statusCapturingResponseWriter struct {
 	http.ResponseWriter
-	statusCode  int
-	wroteHeader bool
+	statusCode   int
+	wroteHeader  bool
+	bytesWritten int64
+
+	// forwardEarlyHints passes interim responses other than 100 Continue on
+	// to the client, for routes with ForwardEarlyHints
+	forwardEarlyHints bool
 }
 
-// WriteHeader captures the status code.
+// WriteHeader captures the status code. Informational (1xx) responses such as
+// 100 Continue are passed through without being taken as the final status;
+// other interim responses are dropped unless forwardEarlyHints is set.
 func (w *statusCapturingResponseWriter) WriteHeader(statusCode int) {
-	if !w.wroteHeader {
+	if isInformational(statusCode) && statusCode != http.StatusContinue && !w.forwardEarlyHints {
+		return
+	}
+
+	if !w.wroteHeader && !isInformational(statusCode) {
 		w.statusCode = statusCode
 		w.wroteHeader = true
 	}
@@ -242,11 +1299,50 @@ func (w *statusCapturingResponseWriter) Write(data []byte) (n int, err error) {
 		w.WriteHeader(http.StatusOK)
 	}
 	n, err = w.ResponseWriter.Write(data)
+	w.bytesWritten += int64(n)
+	return n, err
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *statusCapturingResponseWriter) Unwrap() (rw http.ResponseWriter) {
+	rw = w.ResponseWriter
+	return rw
+}
+
+// headerSize returns the size of header as sent on the wire in HTTP/1.1:
+// one "Name: value\r\n" line per value.
+func headerSize(header http.Header) (size int) {
+	for key, values := range header {
+		for _, value := range values {
+			size += len(key) + len(value) + len(": \r\n")
+		}
+	}
+	return size
+}
+
+// isInformational reports whether statusCode is an interim 1xx response that is
+// followed by a final one. 101 Switching Protocols is final.
+func isInformational(statusCode int) (informational bool) {
+	informational = statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols
+	return informational
+}
+
+// countingReadCloser wraps an io.ReadCloser to count the bytes read through it.
+// The count is atomic because the transport may read the body from another goroutine.
+type countingReadCloser struct {
+	io.ReadCloser
+	bytesRead atomic.Int64
+}
+
+// Read reads from the wrapped reader and counts the bytes read.
+func (c *countingReadCloser) Read(data []byte) (n int, err error) {
+	n, err = c.ReadCloser.Read(data)
+	c.bytesRead.Add(int64(n))
 	return n, err
 }
 
 // redirectRewritingResponseWriter wraps http.ResponseWriter to intercept
-// and rewrite redirect responses.
+// and rewrite redirect responses, authentication challenges, and Link headers.
 type redirectRewritingResponseWriter struct {
 	http.ResponseWriter
 	route          *Route
@@ -254,8 +1350,15 @@ type redirectRewritingResponseWriter struct {
 	incomingHost   string
 	incomingScheme string
 	logger         Logger
-	metricsEnabled bool
+	metrics        *Metrics
 	wroteHeader    bool
+
+	// redirects tracks the client's chain of rewritten redirects, which may
+	// be at most maxRedirects long; the request is for requestTarget
+	redirects     *redirectChains
+	maxRedirects  int
+	client        string
+	requestTarget string
 }
 
 // WriteHeader intercepts the status code and rewrites Location header for redirects.
@@ -263,15 +1366,27 @@ func (rw *redirectRewritingResponseWriter) WriteHeader(statusCode int) {
 	if rw.wroteHeader {
 		return
 	}
+
+	// Interim responses precede the final one
+	if isInformational(statusCode) {
+		rw.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+
 	rw.wroteHeader = true
 
 	// Handle redirect rewriting if applicable
-	if isRedirect(statusCode) {
+	if rw.route.config.RewriteRedirects && isRedirect(statusCode) {
 		rw.handleRedirectRewrite()
 	}
 
-	// Apply outgoing header manipulations
-	rw.applyHeaderManipulations()
+	if rw.route.config.RewriteAuthChallenge {
+		rw.handleAuthChallengeRewrite()
+	}
+
+	if rw.route.config.RewriteLinkHeader {
+		rw.handleLinkRewrite()
+	}
 
 	rw.ResponseWriter.WriteHeader(statusCode)
 }
@@ -293,6 +1408,21 @@ func (rw *redirectRewritingResponseWriter) handleRedirectRewrite() {
 	)
 
 	if rewritten {
+		// A redirect reached by following rewritten redirects continues
+		// their chain; one too many means the routes' upstreams redirect to
+		// each other
+		now := time.Now()
+		depth := rw.redirects.depth(rw.client, rw.requestTarget, now) + 1
+		if rw.maxRedirects > 0 && depth > rw.maxRedirects {
+			rw.logger.Warn("Redirect rewrite limit reached, possible redirect loop; leaving Location unrewritten",
+				"route", rw.route.config.Name,
+				"location", location,
+				"rewritten", rewrittenLocation,
+				"max_redirect_rewrites", rw.maxRedirects)
+			return
+		}
+		rw.redirects.record(rw.client, redirectTargetKey(rewrittenLocation), depth, now)
+
 		rw.logSuccessfulRewrite(location, rewrittenLocation, rewriteType)
 		rw.Header().Set("Location", rewrittenLocation)
 		return
@@ -303,6 +1433,80 @@ func (rw *redirectRewritingResponseWriter) handleRedirectRewrite() {
 	}
 }
 
+// handleAuthChallengeRewrite rewrites upstream URLs in WWW-Authenticate
+// challenges, keeping each header field separate.
+func (rw *redirectRewritingResponseWriter) handleAuthChallengeRewrite() {
+	challenges := rw.Header().Values("WWW-Authenticate")
+	if len(challenges) == 0 {
+		return
+	}
+
+	configs := routesToConfigs(rw.routes)
+	rewrittenChallenges := make([]string, len(challenges))
+	anyRewritten := false
+	for i, challenge := range challenges {
+		var rewritten bool
+		rewrittenChallenges[i], rewritten = RewriteAuthChallenge(
+			challenge,
+			rw.incomingHost,
+			rw.incomingScheme,
+			configs,
+			rw.route.config,
+		)
+		if rewritten {
+			rw.logger.Info("Rewrote authentication challenge",
+				"route", rw.route.config.Name,
+				"original", challenge,
+				"rewritten", rewrittenChallenges[i])
+			anyRewritten = true
+		}
+	}
+
+	if anyRewritten {
+		rw.Header().Del("WWW-Authenticate")
+		for _, challenge := range rewrittenChallenges {
+			rw.Header().Add("WWW-Authenticate", challenge)
+		}
+	}
+}
+
+// handleLinkRewrite rewrites upstream URLs in Link headers, keeping each
+// header field separate.
+func (rw *redirectRewritingResponseWriter) handleLinkRewrite() {
+	links := rw.Header().Values("Link")
+	if len(links) == 0 {
+		return
+	}
+
+	configs := routesToConfigs(rw.routes)
+	rewrittenLinks := make([]string, len(links))
+	anyRewritten := false
+	for i, link := range links {
+		var rewritten bool
+		rewrittenLinks[i], rewritten = RewriteLinkHeader(
+			link,
+			rw.incomingHost,
+			rw.incomingScheme,
+			configs,
+			rw.route.config,
+		)
+		if rewritten {
+			rw.logger.Info("Rewrote Link header",
+				"route", rw.route.config.Name,
+				"original", link,
+				"rewritten", rewrittenLinks[i])
+			anyRewritten = true
+		}
+	}
+
+	if anyRewritten {
+		rw.Header().Del("Link")
+		for _, link := range rewrittenLinks {
+			rw.Header().Add("Link", link)
+		}
+	}
+}
+
 // logSuccessfulRewrite logs a successful redirect rewrite and updates metrics.
 func (rw *redirectRewritingResponseWriter) logSuccessfulRewrite(
 	original string,
@@ -315,8 +1519,8 @@ func (rw *redirectRewritingResponseWriter) logSuccessfulRewrite(
 		"rewritten", rewritten,
 		"type", rewriteType)
 
-	if rw.metricsEnabled {
-		ProxyRedirectRewritesTotal.WithLabelValues(rw.route.config.Name, rewriteType).Inc()
+	if rw.metrics != nil {
+		rw.metrics.RedirectRewritesTotal.WithLabelValues(rw.metrics.routeLabels(rw.route.config, rw.route.config.Name, rewriteType)...).Inc()
 	}
 }
 
@@ -326,23 +1530,8 @@ func (rw *redirectRewritingResponseWriter) logUnknownExternalRedirect(location s
 		"route", rw.route.config.Name,
 		"location", location)
 
-	if rw.metricsEnabled {
-		ProxyRedirectRewritesTotal.WithLabelValues(rw.route.config.Name, "external_unknown").Inc()
-	}
-}
-
-// applyHeaderManipulations applies outgoing header transformations.
-func (rw *redirectRewritingResponseWriter) applyHeaderManipulations() {
-	processedHeaders := rw.route.headerManipulator.ProcessOutgoing(rw.Header())
-
-	// Clear existing headers and set processed ones
-	for key := range rw.Header() {
-		rw.Header().Del(key)
-	}
-	for key, values := range processedHeaders {
-		for _, value := range values {
-			rw.Header().Add(key, value)
-		}
+	if rw.metrics != nil {
+		rw.metrics.RedirectRewritesTotal.WithLabelValues(rw.metrics.routeLabels(rw.route.config, rw.route.config.Name, "external_unknown")...).Inc()
 	}
 }
 
@@ -355,6 +1544,12 @@ func (rw *redirectRewritingResponseWriter) Write(data []byte) (n int, err error)
 	return n, err
 }
 
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (rw *redirectRewritingResponseWriter) Unwrap() (w http.ResponseWriter) {
+	w = rw.ResponseWriter
+	return w
+}
+
 // isRedirect checks if a status code is a redirect.
 func isRedirect(statusCode int) (redirect bool) {
 	redirect = statusCode == http.StatusMovedPermanently ||
@@ -374,9 +1569,15 @@ func routesToConfigs(routes []*Route) (configs []*RouteConfig) {
 	return configs
 }
 
-// sortRoutesByPrefixLength sorts routes by path prefix length (longest first) for correct matching.
+// sortRoutesByPrefixLength sorts routes into matching order: highest Priority
+// first, then longest path prefix first. Ties keep the order routes were
+// defined in.
 func sortRoutesByPrefixLength(routes []*Route) {
-	sort.Slice(routes, func(i, j int) (less bool) {
+	sort.SliceStable(routes, func(i, j int) (less bool) {
+		if routes[i].config.Priority != routes[j].config.Priority {
+			less = routes[i].config.Priority > routes[j].config.Priority
+			return less
+		}
 		less = len(routes[i].config.PathPrefix) > len(routes[j].config.PathPrefix)
 		return less
 	})
@@ -0,0 +1,57 @@
+package mimicproxy
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a token bucket rate limiter: tokens accrue at rate per second
+// up to burst, and each request spends one.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	tokens  float64
+	updated time.Time
+}
+
+// newTokenBucket creates a full bucket allowing rate requests per second with
+// bursts of up to burst requests. A zero burst allows rate rounded up, at
+// least one.
+func newTokenBucket(rate float64, burst int) (bucket *tokenBucket) {
+	size := float64(burst)
+	if burst == 0 {
+		size = max(math.Ceil(rate), 1)
+	}
+
+	bucket = &tokenBucket{
+		rate:    rate,
+		burst:   size,
+		tokens:  size,
+		updated: time.Now(),
+	}
+	return bucket
+}
+
+// take spends a token for a request at now. If none is available it reports
+// false and how long until one will be.
+func (b *tokenBucket) take(now time.Time) (allowed bool, retryAfter time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if now.After(b.updated) {
+		b.tokens = min(b.tokens+now.Sub(b.updated).Seconds()*b.rate, b.burst)
+		b.updated = now
+	}
+
+	if b.tokens < 1 {
+		retryAfter = time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		return allowed, retryAfter
+	}
+
+	b.tokens--
+	allowed = true
+	return allowed, retryAfter
+}
@@ -0,0 +1,108 @@
+package mimicproxy
+
+import (
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// DefaultMaxRedirectRewrites is the MaxRedirectRewrites used when none is set.
+const DefaultMaxRedirectRewrites = 10
+
+// redirectChainTTL is how long a rewritten redirect is remembered while the
+// client follows it.
+const redirectChainTTL = 30 * time.Second
+
+// maxRedirectChainEntries bounds how many rewritten redirects are remembered
+// at once.
+const maxRedirectChainEntries = 10000
+
+// redirectChains remembers, per client, the proxy URLs it was sent to by
+// rewritten redirects and how many rewrites in a row led there. A redirect
+// from one of those URLs continues the chain, so routes whose upstreams
+// redirect to each other are caught after MaxRedirectRewrites hops rather
+// than bouncing the client between them forever.
+type redirectChains struct {
+	mu      sync.Mutex
+	entries map[redirectTarget]redirectHop
+}
+
+// redirectTarget is a proxy URL a client was redirected to.
+type redirectTarget struct {
+	client string
+	target string
+}
+
+// redirectHop is how many rewritten redirects led to a target.
+type redirectHop struct {
+	depth   int
+	expires time.Time
+}
+
+// newRedirectChains creates an empty redirect chain tracker.
+func newRedirectChains() (chains *redirectChains) {
+	chains = &redirectChains{entries: make(map[redirectTarget]redirectHop)}
+	return chains
+}
+
+// depth returns how many rewritten redirects in a row led client to target,
+// or zero if it did not get there by a rewritten redirect.
+func (c *redirectChains) depth(client string, target string, now time.Time) (depth int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hop, ok := c.entries[redirectTarget{client: client, target: target}]
+	if ok && now.Before(hop.expires) {
+		depth = hop.depth
+	}
+	return depth
+}
+
+// record remembers that client was redirected to target as the depth-th
+// rewrite of its chain. When full, expired entries are dropped first, then
+// an arbitrary one.
+func (c *redirectChains) record(client string, target string, depth int, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= maxRedirectChainEntries {
+		for key, hop := range c.entries {
+			if !now.Before(hop.expires) {
+				delete(c.entries, key)
+			}
+		}
+	}
+	if len(c.entries) >= maxRedirectChainEntries {
+		for key := range c.entries {
+			delete(c.entries, key)
+			break
+		}
+	}
+
+	c.entries[redirectTarget{client: client, target: target}] = redirectHop{depth: depth, expires: now.Add(redirectChainTTL)}
+}
+
+// redirectClient identifies the client of a request by its IP address.
+func redirectClient(remoteAddr string) (client string) {
+	var err error
+	client, _, err = net.SplitHostPort(remoteAddr)
+	if err != nil {
+		client = remoteAddr
+	}
+	return client
+}
+
+// redirectTargetKey returns the host and request URI of a URL, which is how a
+// followed redirect is recognized when it arrives as a request.
+func redirectTargetKey(location string) (key string) {
+	var locationURL *url.URL
+	var err error
+	locationURL, err = url.Parse(location)
+	if err != nil {
+		return key
+	}
+
+	key = locationURL.Host + locationURL.RequestURI()
+	return key
+}
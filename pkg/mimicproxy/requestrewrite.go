@@ -0,0 +1,229 @@
+package mimicproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Request value sources a RequestRewriteRule can reference.
+const (
+	rewriteSourceHeader = "header"
+	rewriteSourceQuery  = "query"
+	rewriteSourcePath   = "path"
+)
+
+// requestValueRef names one value of a request, such as query.token.
+type requestValueRef struct {
+	source string
+	name   string
+	index  int
+}
+
+// templatePart is a literal run of a template or, if ref is set, a reference.
+type templatePart struct {
+	literal string
+	ref     *requestValueRef
+}
+
+// requestRewrite is a compiled RequestRewriteRule.
+type requestRewrite struct {
+	target requestValueRef
+	parts  []templatePart
+	move   bool
+}
+
+// compileRequestRewrite parses a rule's target and value template.
+func compileRequestRewrite(rule RequestRewriteRule) (rewrite *requestRewrite, err error) {
+	rewrite = &requestRewrite{move: rule.Move}
+
+	rewrite.target, err = parseRequestValueRef(rule.Target)
+	if err != nil {
+		err = fmt.Errorf("invalid target: %w", err)
+		return rewrite, err
+	}
+
+	rest := rule.Value
+	for rest != "" {
+		start := strings.Index(rest, "${")
+		if start == -1 {
+			rewrite.parts = append(rewrite.parts, templatePart{literal: rest})
+			break
+		}
+		if start > 0 {
+			rewrite.parts = append(rewrite.parts, templatePart{literal: rest[:start]})
+		}
+
+		end := strings.Index(rest[start:], "}")
+		if end == -1 {
+			err = fmt.Errorf("unclosed reference in value: %s", rule.Value)
+			return rewrite, err
+		}
+		end += start
+
+		var ref requestValueRef
+		ref, err = parseRequestValueRef(rest[start+2 : end])
+		if err != nil {
+			err = fmt.Errorf("invalid value: %w", err)
+			return rewrite, err
+		}
+		rewrite.parts = append(rewrite.parts, templatePart{ref: &ref})
+		rest = rest[end+1:]
+	}
+
+	return rewrite, err
+}
+
+// parseRequestValueRef parses a reference of the form "<source>.<name>".
+func parseRequestValueRef(reference string) (ref requestValueRef, err error) {
+	var found bool
+	ref.source, ref.name, found = strings.Cut(reference, ".")
+	if !found || ref.name == "" {
+		err = fmt.Errorf("reference must be 'header.<name>', 'query.<name>', or 'path.<index>': %s", reference)
+		return ref, err
+	}
+
+	switch ref.source {
+	case rewriteSourceHeader:
+		ref.name = http.CanonicalHeaderKey(ref.name)
+	case rewriteSourceQuery:
+	case rewriteSourcePath:
+		ref.index, err = strconv.Atoi(ref.name)
+		if err != nil || ref.index < 0 {
+			err = fmt.Errorf("path index must be a non-negative integer: %s", reference)
+			return ref, err
+		}
+	default:
+		err = fmt.Errorf("reference source must be 'header', 'query', or 'path': %s", reference)
+		return ref, err
+	}
+
+	return ref, err
+}
+
+// applyRequestRewrites applies rewrites to the outgoing request in order. The
+// query string is re-encoded, in sorted key order, only if a rule changed it.
+func applyRequestRewrites(req *http.Request, rewrites []*requestRewrite) {
+	query := req.URL.Query()
+	queryChanged := false
+
+	for _, rewrite := range rewrites {
+		// Resolve the whole template first; a missing value skips the rule
+		var builder strings.Builder
+		complete := true
+		for _, part := range rewrite.parts {
+			if part.ref == nil {
+				builder.WriteString(part.literal)
+				continue
+			}
+
+			var value string
+			value, complete = lookupRequestValue(req, query, part.ref)
+			if !complete {
+				break
+			}
+			builder.WriteString(value)
+		}
+		if !complete {
+			continue
+		}
+
+		// Moved path segments are removed after the target is set
+		var segments []int
+		if rewrite.move {
+			for _, part := range rewrite.parts {
+				if part.ref == nil || *part.ref == rewrite.target {
+					continue
+				}
+
+				switch part.ref.source {
+				case rewriteSourceHeader:
+					req.Header.Del(part.ref.name)
+				case rewriteSourceQuery:
+					query.Del(part.ref.name)
+					queryChanged = true
+				case rewriteSourcePath:
+					segments = append(segments, part.ref.index)
+				}
+			}
+		}
+
+		value := builder.String()
+		switch rewrite.target.source {
+		case rewriteSourceHeader:
+			req.Header.Set(rewrite.target.name, value)
+		case rewriteSourceQuery:
+			query.Set(rewrite.target.name, value)
+			queryChanged = true
+		case rewriteSourcePath:
+			setPathSegment(req.URL, rewrite.target.index, value)
+		}
+
+		// Removing a segment shifts the ones after it, so go from the end
+		slices.Sort(segments)
+		for _, index := range slices.Backward(slices.Compact(segments)) {
+			removePathSegment(req.URL, index)
+		}
+	}
+
+	if queryChanged {
+		req.URL.RawQuery = query.Encode()
+	}
+}
+
+// lookupRequestValue returns the value ref names in req, using query as the
+// request's current query parameters.
+func lookupRequestValue(req *http.Request, query url.Values, ref *requestValueRef) (value string, found bool) {
+	switch ref.source {
+	case rewriteSourceHeader:
+		values := req.Header.Values(ref.name)
+		if len(values) > 0 {
+			value, found = values[0], true
+		}
+	case rewriteSourceQuery:
+		if query.Has(ref.name) {
+			value, found = query.Get(ref.name), true
+		}
+	case rewriteSourcePath:
+		segments := escapedPathSegments(req.URL)
+		if ref.index < len(segments) {
+			var err error
+			value, err = url.PathUnescape(segments[ref.index])
+			found = err == nil
+		}
+	}
+	return value, found
+}
+
+// escapedPathSegments splits u's escaped path into its segments, so an
+// encoded slash (%2F) stays within its segment.
+func escapedPathSegments(u *url.URL) (segments []string) {
+	segments = strings.Split(strings.TrimPrefix(u.EscapedPath(), "/"), "/")
+	return segments
+}
+
+// setPathSegment replaces segment index of u's path with value. A path without
+// that segment is left unchanged.
+func setPathSegment(u *url.URL, index int, value string) {
+	segments := escapedPathSegments(u)
+	if index >= len(segments) {
+		return
+	}
+
+	segments[index] = url.PathEscape(value)
+	setEscapedPath(u, "/"+strings.Join(segments, "/"))
+}
+
+// removePathSegment removes segment index from u's path.
+func removePathSegment(u *url.URL, index int) {
+	segments := escapedPathSegments(u)
+	if index >= len(segments) {
+		return
+	}
+
+	segments = slices.Delete(segments, index, index+1)
+	setEscapedPath(u, "/"+strings.Join(segments, "/"))
+}
@@ -0,0 +1,47 @@
+package mimicproxy
+
+import (
+	"sync"
+)
+
+// retryBudgetMaxTokens is how many retries a retry budget can bank.
+const retryBudgetMaxTokens = 10
+
+// retryBudget is a token bucket limiting retries to a ratio of original
+// requests. Each original request deposits ratio tokens and each retry spends
+// one, so a widespread upstream failure cannot multiply upstream load.
+type retryBudget struct {
+	ratio float64
+
+	mu      sync.Mutex
+	balance float64
+}
+
+// newRetryBudget creates an empty retry budget allowing ratio retries per
+// original request.
+func newRetryBudget(ratio float64) (budget *retryBudget) {
+	budget = &retryBudget{ratio: ratio}
+	return budget
+}
+
+// deposit credits the budget for an original request.
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.balance = min(b.balance+b.ratio, retryBudgetMaxTokens)
+}
+
+// withdraw spends a token for a retry, reporting false if none is available.
+func (b *retryBudget) withdraw() (allowed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.balance < 1 {
+		return allowed
+	}
+
+	b.balance--
+	allowed = true
+	return allowed
+}
@@ -1,10 +1,27 @@
 package mimicproxy
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/sync/semaphore"
 )
 
 // Route represents a compiled route from client to upstream.
@@ -14,10 +31,140 @@ type Route struct {
 	reverseProxy      *httputil.ReverseProxy
 	headerManipulator *HeaderManipulator
 	logger            Logger
+	metrics           *Metrics
+
+	// redirectBaseHost is the host of RedirectBaseURL, which Referer and
+	// Origin rewriting treats as the proxy's own; empty without one
+	redirectBaseHost string
+
+	// fastPath is set for routes with no header rules, redirect rewriting,
+	// or path rewriting; their headers skip the header manipulator, which
+	// would only copy them
+	fastPath bool
+
+	// outgoingRules is set for routes with response header rules; responses
+	// of other routes skip the header manipulator
+	outgoingRules bool
+
+	// hopByHopExemptions are hop-by-hop header patterns the director keeps
+	hopByHopExemptions []string
+
+	// allowedMethods is the normalized AllowedMethods list; empty allows all
+	allowedMethods []string
+	allowHeader    string
+
+	// concurrency limits in-flight upstream requests; nil when unlimited
+	concurrency *semaphore.Weighted
+
+	// queued counts requests waiting for a concurrency slot
+	queued atomic.Int64
+
+	// staticBody is the StaticResponse body, read from BodyFile if configured
+	staticBody []byte
+
+	// upstreams is the parsed Upstreams pool, chosen among by balancer; both
+	// are nil for single-upstream routes
+	upstreams []*url.URL
+	balancer  Balancer
+
+	// mirror replays sampled requests to MirrorUpstream; nil without one
+	mirror *mirror
+
+	// canary picks the requests sent to the Canary upstream; nil without one
+	canary *canary
+
+	// idempotency deduplicates requests by idempotency key; nil without
+	// Idempotency
+	idempotency *idempotencyStore
+
+	// basicAuth is UpstreamBasicAuth with environment variables expanded;
+	// nil without it
+	basicAuth *BasicAuthConfig
+
+	// oauth2 caches the route's client-credentials token; nil without OAuth2
+	oauth2 *oauth2TokenSource
+
+	// requestSchema is the compiled RequestSchema; nil without one
+	requestSchema *jsonschema.Schema
+
+	// requestRewrites are the compiled RequestRewrite rules
+	requestRewrites []*requestRewrite
+
+	// retryBudget is the proxy-wide retry budget; nil when retries are unlimited
+	retryBudget *retryBudget
+
+	// ctx is the proxy's base context; background work (mirror requests,
+	// token refreshes) derives from it so it stops when the proxy is closed
+	ctx context.Context
+
+	// workers tracks the route's background work; nil outside a Proxy
+	workers *workerGroup
+
+	// trustedProxies are the peers whose forwarded headers are kept in
+	// "standard" ForwardedHeaders mode
+	trustedProxies []netip.Prefix
+
+	// errorTemplate renders error response bodies; nil without an
+	// ErrorResponseTemplate
+	errorTemplate *template.Template
+
+	// transformer is the route's RouteTransformer; nil without one
+	transformer RouteTransformer
+
+	// maintenance is set while the route is in maintenance
+	maintenance atomic.Bool
+
+	// transport is set when the route needs its own transport (Unix socket
+	// upstreams, egress proxy overrides, connection timeouts, header order
+	// recording) rather than the proxy's shared one
+	transport *http.Transport
+
+	// sniTransports presents each request's Host as the TLS server name; nil
+	// unless SNIFromHost is set
+	sniTransports *sniTransports
 }
 
+// errUpstreamHeadersTooLarge reports forwarded headers over the route's
+// MaxUpstreamHeaderBytes. Such requests get a 431.
+var errUpstreamHeadersTooLarge = errors.New("upstream request headers too large")
+
+// preservedHeadersKey is the context key for hop-by-hop headers that must be
+// restored after ReverseProxy performs its own hop-by-hop removal.
+type preservedHeadersKey struct{}
+
 // NewRoute creates a new route from configuration.
 func NewRoute(config *RouteConfig, transport *http.Transport, logger Logger) (route *Route, err error) {
+	transports := routeTransports{
+		shared:       transport,
+		template:     transport,
+		socketDialer: &net.Dialer{},
+	}
+	route, err = newRoute(config, transports, logger)
+	return route, err
+}
+
+// routeTransports are the transports a route sends over or derives its own
+// from.
+type routeTransports struct {
+	// shared is the proxy's transport, used by routes without their own
+	shared *http.Transport
+
+	// template is the unconfigured transport routes copy their own from.
+	// Copying a transport sets up net/http's bundled HTTP/2 on the original,
+	// so shared cannot be copied once configureHTTP2 has configured it.
+	template *http.Transport
+
+	// socketDialer dials the sockets of Unix socket upstreams
+	socketDialer *net.Dialer
+
+	// connMetrics records the connections of Unix socket upstreams; nil
+	// leaves them untracked
+	connMetrics *Metrics
+}
+
+// newRoute creates a route from configuration, sending over transports.shared
+// or over a transport of its own copied from transports.template.
+func newRoute(config *RouteConfig, transports routeTransports, logger Logger) (route *Route, err error) {
 	// Parse upstream URL
 	var upstreamURL *url.URL
 	upstreamURL, err = url.Parse(config.Upstream)
@@ -30,6 +177,55 @@ func NewRoute(config *RouteConfig, transport *http.Transport, logger Logger) (ro
 		upstream:          upstreamURL,
 		headerManipulator: NewHeaderManipulator(&config.Headers, config.Name, logger),
 		logger:            logger,
+		ctx:               context.Background(),
+		fastPath:          isFastPath(config),
+		outgoingRules:     hasOutgoingHeaderRules(&config.Headers),
+
+		hopByHopExemptions: hopByHopExemptions(config),
+	}
+
+	for _, method := range config.AllowedMethods {
+		route.allowedMethods = append(route.allowedMethods, strings.ToUpper(method))
+	}
+	route.allowHeader = strings.Join(route.allowedMethods, ", ")
+
+	err = route.initUpstreams(transports.shared)
+	if err != nil {
+		return route, err
+	}
+
+	err = route.initCredentials(transports.shared)
+	if err != nil {
+		return route, err
+	}
+
+	err = route.deriveTransport(transports)
+	if err != nil {
+		return route, err
+	}
+
+	err = route.initRequestHandling()
+	if err != nil {
+		return route, err
+	}
+
+	// The route sends over a configured copy of its derived transport, which
+	// remains the source of further copies
+	transport := transports.shared
+	template := transports.template
+	if route.transport != nil {
+		template = route.transport
+		route.transport = template.Clone()
+		err = configureHTTP2(route.transport)
+		if err != nil {
+			return route, err
+		}
+		transport = route.transport
+	}
+
+	// Routes sending the preserved Host as SNI need a transport per server name
+	if config.SNIFromHost {
+		route.sniTransports = newSNITransports(transport, template)
 	}
 
 	// Wrap transport to ensure headers are stripped after ReverseProxy processes them
@@ -43,12 +239,250 @@ func NewRoute(config *RouteConfig, transport *http.Transport, logger Logger) (ro
 		Director: func(req *http.Request) {
 			route.director(req)
 		},
-		Transport: wrappedTransport,
+		ModifyResponse: route.modifyResponse,
+		ErrorHandler:   route.errorHandler,
+		Transport:      wrappedTransport,
+	}
+	if config.Streaming {
+		route.reverseProxy.FlushInterval = -1
 	}
 
+	route.warnSuspiciousHeaderRules()
+
 	return route, err
 }
 
+// initUpstreams sets up the route's load-balanced upstreams, canary, and
+// mirror, and the host of its RedirectBaseURL. Mirror requests go through the
+// shared transport, not a Unix socket.
+func (r *Route) initUpstreams(shared *http.Transport) (err error) {
+	for _, upstream := range r.config.Upstreams {
+		var poolURL *url.URL
+		poolURL, err = url.Parse(upstream)
+		if err != nil {
+			return err
+		}
+		r.upstreams = append(r.upstreams, poolURL)
+	}
+
+	if r.config.RedirectBaseURL != "" {
+		var baseURL *url.URL
+		baseURL, err = url.Parse(r.config.RedirectBaseURL)
+		if err != nil {
+			return err
+		}
+		r.redirectBaseHost = baseURL.Host
+	}
+
+	if len(r.upstreams) > 0 {
+		r.balancer, err = NewBalancer(r.config.Balancer)
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.config.Canary != nil {
+		r.canary, err = newCanary(r.config.Canary)
+		if err != nil {
+			return err
+		}
+	}
+
+	if r.config.MirrorUpstream != "" {
+		var mirrorURL *url.URL
+		mirrorURL, err = url.Parse(r.config.MirrorUpstream)
+		if err != nil {
+			return err
+		}
+		r.mirror = newMirror(r, mirrorURL, shared)
+	}
+
+	return err
+}
+
+// initCredentials sets up the credentials the route sends upstream. Token
+// requests go through the shared transport, not a Unix socket.
+func (r *Route) initCredentials(shared *http.Transport) (err error) {
+	// Credentials are resolved once; an unset variable would send them empty
+	if r.config.UpstreamBasicAuth != nil {
+		r.basicAuth = &BasicAuthConfig{
+			Username: expandEnvVars(r.config.UpstreamBasicAuth.Username),
+			Password: expandEnvVars(r.config.UpstreamBasicAuth.Password),
+		}
+		if r.basicAuth.Username == "" || r.basicAuth.Password == "" {
+			err = errors.New("upstream basic auth username and password must not resolve to empty")
+			return err
+		}
+	}
+
+	if r.config.OAuth2 != nil {
+		r.oauth2 = newOAuth2TokenSource(r.config.OAuth2, shared, r.config.Name, r.logger)
+	}
+
+	return err
+}
+
+// deriveTransport sets route.transport to a transport of the route's own,
+// derived from transports.template, for routes whose settings the shared
+// transport can't serve. It is left nil for other routes.
+func (r *Route) deriveTransport(transports routeTransports) (err error) {
+	config := r.config
+	transport := transports.template
+
+	// Unix socket upstreams get a dedicated transport that dials the socket;
+	// requests are addressed to a fixed host
+	if r.upstream.Scheme == SchemeUnix {
+		transport = unixSocketTransport(transport, r.upstream.Path, transports.socketDialer, transports.connMetrics)
+		r.transport = transport
+		r.upstream = &url.URL{Scheme: SchemeHTTP, Host: unixSocketHost}
+	}
+
+	// Routes with their own egress proxy get a dedicated transport
+	if config.EgressProxyURL != "" {
+		var proxyURL *url.URL
+		proxyURL, err = url.Parse(config.EgressProxyURL)
+		if err != nil {
+			err = fmt.Errorf("invalid egress proxy URL: %w", err)
+			return err
+		}
+		transport = egressProxyTransport(transport, proxyURL)
+		r.transport = transport
+	}
+
+	// Routes with their own connection timeouts get a dedicated transport
+	if config.IdleConnTimeout > 0 || config.MaxConnLifetime > 0 {
+		transport = transport.Clone()
+		if config.IdleConnTimeout > 0 {
+			transport.IdleConnTimeout = config.IdleConnTimeout
+		}
+		if config.MaxConnLifetime > 0 {
+			transport.DialContext = limitConnLifetime(transport.DialContext, config.MaxConnLifetime)
+		}
+		r.transport = transport
+	}
+
+	// Routes with transparent encoding never have the transport negotiate or
+	// decode compression on their behalf
+	if config.TransparentEncoding {
+		transport = transport.Clone()
+		transport.DisableCompression = true
+		r.transport = transport
+	}
+
+	// Routes preserving header casing and order record raw upstream responses
+	if config.PreserveHeaderCasingAndOrder {
+		transport = headerRecordingTransport(transport)
+		r.transport = transport
+	}
+
+	return err
+}
+
+// initRequestHandling loads the route's static response body, compiles its
+// request schema and rewrites, and sets up its idempotency store and
+// concurrency limit.
+func (r *Route) initRequestHandling() (err error) {
+	config := r.config
+
+	if config.StaticResponse != nil {
+		r.staticBody = []byte(config.StaticResponse.Body)
+		if config.StaticResponse.BodyFile != "" {
+			r.staticBody, err = os.ReadFile(config.StaticResponse.BodyFile)
+			if err != nil {
+				err = fmt.Errorf("failed to read static response body: %w", err)
+				return err
+			}
+		}
+	}
+
+	if config.RequestSchema != "" {
+		r.requestSchema, err = compileRequestSchema(config.RequestSchema)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, rule := range config.RequestRewrite {
+		var rewrite *requestRewrite
+		rewrite, err = compileRequestRewrite(rule)
+		if err != nil {
+			err = fmt.Errorf("invalid request rewrite %d: %w", i, err)
+			return err
+		}
+		r.requestRewrites = append(r.requestRewrites, rewrite)
+	}
+
+	if config.Idempotency != nil {
+		r.idempotency = newIdempotencyStore(config.Idempotency)
+	}
+
+	if config.MaxConcurrent > 0 {
+		r.concurrency = semaphore.NewWeighted(int64(config.MaxConcurrent))
+	}
+
+	return err
+}
+
+// warnSuspiciousHeaderRules logs header rules that are allowed but probably
+// mistakes. StrictRouteValidation rejects strip patterns matching essential
+// headers; otherwise they are only suspicious.
+func (r *Route) warnSuspiciousHeaderRules() {
+	config := r.config
+
+	strips := []struct {
+		direction string
+		patterns  []string
+	}{
+		{direction: "incoming", patterns: config.Headers.StripIncoming},
+		{direction: "outgoing", patterns: config.Headers.StripOutgoing},
+	}
+	for _, strip := range strips {
+		pattern, header := strippedEssentialHeader(strip.patterns)
+		if pattern != "" {
+			r.logger.Warn("Strip pattern matches an essential header",
+				"route", config.Name,
+				"direction", strip.direction,
+				"pattern", pattern,
+				"header", header)
+		}
+	}
+
+	if config.AddViaHeader && (r.shouldStripHeader("Via") || matchesAnyPattern("Via", config.Headers.StripOutgoing)) {
+		r.logger.Warn("Via is both stripped and added; the proxy's Via entry will be added",
+			"route", config.Name)
+	}
+}
+
+// isFastPath reports whether a route forwards headers and paths as received:
+// it has no header rules and rewrites neither redirects nor paths.
+func isFastPath(config *RouteConfig) (fast bool) {
+	headers := &config.Headers
+	fast = len(headers.StripIncoming) == 0 &&
+		len(headers.StripOutgoing) == 0 &&
+		len(headers.AddUpstream) == 0 &&
+		len(headers.AddDownstream) == 0 &&
+		len(headers.AppendUpstream) == 0 &&
+		len(headers.AppendDownstream) == 0 &&
+		len(headers.ReplaceIncoming) == 0 &&
+		len(headers.ReplaceOutgoing) == 0 &&
+		len(headers.RewriteIncoming) == 0 &&
+		len(headers.RewriteOutgoing) == 0 &&
+		!config.RewriteRedirects &&
+		config.UpstreamPathPrefix == "" &&
+		!config.StripPathPrefix
+	return fast
+}
+
+// hasOutgoingHeaderRules reports whether headers has rules for responses.
+func hasOutgoingHeaderRules(headers *HeaderConfig) (has bool) {
+	has = len(headers.StripOutgoing) > 0 ||
+		len(headers.AddDownstream) > 0 ||
+		len(headers.AppendDownstream) > 0 ||
+		len(headers.ReplaceOutgoing) > 0 ||
+		len(headers.RewriteOutgoing) > 0
+	return has
+}
+
 // headerStrippingTransport wraps http.RoundTripper to ensure headers
 // are properly stripped even after ReverseProxy adds its own headers.
 type headerStrippingTransport struct {
@@ -71,68 +505,1069 @@ func (t *headerStrippingTransport) RoundTrip(req *http.Request) (resp *http.Resp
 		}
 	}
 
-	resp, err = t.base.RoundTrip(req)
+	// Restore hop-by-hop headers the route preserves; ReverseProxy removed them
+	// after the director ran
+	preserved, ok := req.Context().Value(preservedHeadersKey{}).(http.Header)
+	if ok {
+		for key, values := range preserved {
+			if !t.route.shouldStripHeader(key) {
+				req.Header[key] = values
+			}
+		}
+	}
+
+	// The director ran, but the balancer had no upstream to offer
+	selection, ok := req.Context().Value(upstreamSelectionKey{}).(*upstreamSelection)
+	if ok && selection.picked && selection.upstream == nil {
+		err = ErrNoUpstream
+		return resp, err
+	}
+
+	// Hand the request to the embedder's transformer as it is about to be sent
+	err = t.route.transformRequest(req)
+	if err != nil {
+		return resp, err
+	}
+
+	// Enforce the upstream header limit on the headers as they will be sent
+	if t.route.config.MaxUpstreamHeaderBytes > 0 {
+		err = t.route.limitUpstreamHeaders(req)
+		if err != nil {
+			return resp, err
+		}
+	}
+
+	capture, ok := req.Context().Value(headerCaptureKey{}).(*headerCapture)
+	if ok {
+		req = withHeaderCaptureTrace(req, capture)
+	}
+
+	if t.route.config.MaxConnLifetime > 0 {
+		req = withConnLifetimeTrace(req)
+	}
+
+	metrics := t.route.metrics
+	if metrics != nil {
+		req = t.withTTFBTrace(req)
+		req = withConnPoolTrace(req, metrics)
+	}
+
+	if t.route.retryBudget != nil {
+		t.route.retryBudget.deposit()
+	}
+
+	start := time.Now()
+	resp, err = t.transportFor(req).RoundTrip(req)
+
+	// An upstream that sends GOAWAY fails the requests in flight on that
+	// connection. Retry idempotent ones once on a fresh connection.
+	if err != nil && isGoAwayError(err) && isReplayable(req) {
+		resp, err = t.retryAfterGoAway(req, err)
+	}
+
+	// An overloaded upstream may say when to come back; wait that long and
+	// retry once if the route allows the delay
+	if err == nil && t.route.config.MaxRetryAfter > 0 && isRetryAfterStatus(resp.StatusCode) && isReplayable(req) {
+		resp, err = t.retryAfterDelay(req, resp)
+	}
+
+	// Time until the upstream's response headers arrived, including any retry
+	if metrics != nil {
+		metrics.UpstreamDuration.WithLabelValues(metrics.routeLabels(t.route.config, t.route.config.Name, req.Method)...).Observe(time.Since(start).Seconds())
+	}
+
+	return resp, err
+}
+
+// transportFor returns the transport req is sent over: the route's own or, on
+// SNIFromHost routes, the one presenting req's Host as the TLS server name.
+func (t *headerStrippingTransport) transportFor(req *http.Request) (transport http.RoundTripper) {
+	transport = t.base
+	if t.route.sniTransports != nil {
+		transport = t.route.sniTransports.forRequest(req)
+	}
+	return transport
+}
+
+// withTTFBTrace attaches a client trace that observes the upstream's time to
+// first byte, measured from when the request has been fully written.
+func (t *headerStrippingTransport) withTTFBTrace(req *http.Request) (traced *http.Request) {
+	// The transport may call these hooks from different goroutines
+	var wroteRequest atomic.Pointer[time.Time]
+	trace := &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			now := time.Now()
+			wroteRequest.Store(&now)
+		},
+		GotFirstResponseByte: func() {
+			sent := wroteRequest.Load()
+			if sent != nil {
+				t.route.metrics.UpstreamTTFB.WithLabelValues(t.route.metrics.routeLabels(t.route.config, t.route.config.Name)...).Observe(time.Since(*sent).Seconds())
+			}
+		},
+	}
+
+	traced = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	return traced
+}
+
+// withConnPoolTrace attaches a client trace that records whether the request
+// reused a pooled connection and when the connection returns to the pool.
+func withConnPoolTrace(req *http.Request, metrics *Metrics) (traced *http.Request) {
+	upstream := upstreamAddr(req.URL)
+
+	// The transport may call these hooks from different goroutines
+	var conn atomic.Pointer[trackedConn]
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				metrics.TransportReusedConnsTotal.WithLabelValues(upstream).Inc()
+			} else {
+				metrics.TransportNewConnsTotal.WithLabelValues(upstream).Inc()
+			}
+
+			tracked, ok := asTrackedConn(info.Conn)
+			if ok {
+				tracked.setIdle(false)
+				conn.Store(tracked)
+			}
+		},
+		PutIdleConn: func(err error) {
+			tracked := conn.Load()
+			if err == nil && tracked != nil {
+				tracked.setIdle(true)
+			}
+		},
+	}
+
+	traced = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	return traced
+}
+
+// withConnLifetimeTrace attaches a client trace that marks the request's
+// connection in use while it is sent, so an expired connection is closed when
+// it returns to the pool instead of being reused.
+func withConnLifetimeTrace(req *http.Request) (traced *http.Request) {
+	// The transport may call these hooks from different goroutines
+	var conn atomic.Pointer[lifetimeConn]
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			limited, ok := unwrapConn[*lifetimeConn](info.Conn)
+			if ok {
+				limited.acquire()
+				conn.Store(limited)
+			}
+		},
+		PutIdleConn: func(err error) {
+			limited := conn.Load()
+			if err == nil && limited != nil {
+				limited.release()
+			}
+		},
+	}
+
+	traced = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	return traced
+}
+
+// retryAfterGoAway resends a request that failed because the upstream sent
+// GOAWAY. The original error is returned if the request cannot be resent or
+// the retry budget is exhausted.
+func (t *headerStrippingTransport) retryAfterGoAway(req *http.Request, goAwayErr error) (resp *http.Response, err error) {
+	if t.route.retryBudget != nil && !t.route.retryBudget.withdraw() {
+		t.route.logger.Warn("Retry budget exhausted, not retrying request after GOAWAY",
+			"route", t.route.config.Name,
+			"method", req.Method,
+			"path", req.URL.Path,
+			"error", goAwayErr)
+
+		if t.route.metrics != nil {
+			t.route.metrics.RetryBudgetExhaustedTotal.WithLabelValues(t.route.metrics.routeLabels(t.route.config, t.route.config.Name)...).Inc()
+		}
+
+		err = goAwayErr
+		return resp, err
+	}
+
+	t.route.logger.Debug("Upstream sent GOAWAY, retrying request on a new connection",
+		"route", t.route.config.Name,
+		"method", req.Method,
+		"path", req.URL.Path,
+		"error", goAwayErr)
+
+	if t.route.metrics != nil {
+		t.route.metrics.UpstreamGoAwayRetriesTotal.WithLabelValues(t.route.metrics.routeLabels(t.route.config, t.route.config.Name, req.Method)...).Inc()
+	}
+
+	var retryReq *http.Request
+	retryReq, err = rewindRequest(req)
+	if err != nil {
+		err = goAwayErr
+		return resp, err
+	}
+
+	timer := time.NewTimer(goAwayRetryDelay)
+	defer timer.Stop()
+
+	select {
+	case <-req.Context().Done():
+		err = goAwayErr
+		return resp, err
+	case <-timer.C:
+	}
+
+	resp, err = t.transportFor(retryReq).RoundTrip(retryReq)
+	return resp, err
+}
+
+// isRetryAfterStatus reports whether statusCode is one whose Retry-After
+// MaxRetryAfter honors.
+func isRetryAfterStatus(statusCode int) (retryable bool) {
+	retryable = statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable
+	return retryable
+}
+
+// retryAfterDelay resends a request the upstream answered with a Retry-After
+// within the route's MaxRetryAfter, once that delay has passed. The upstream's
+// response is returned unchanged if it has no usable Retry-After, the delay is
+// too long, the request cannot be resent, the retry budget is exhausted, or
+// the request is cancelled while waiting.
+func (t *headerStrippingTransport) retryAfterDelay(req *http.Request, upstreamResp *http.Response) (resp *http.Response, err error) {
+	resp = upstreamResp
+
+	delay, ok := parseRetryAfter(upstreamResp.Header.Get("Retry-After"), time.Now())
+	if !ok {
+		return resp, err
+	}
+
+	if delay > t.route.config.MaxRetryAfter {
+		t.route.logger.Debug("Upstream Retry-After exceeds max_retry_after, not retrying",
+			"route", t.route.config.Name,
+			"method", req.Method,
+			"path", req.URL.Path,
+			"status", upstreamResp.StatusCode,
+			"retry_after", delay,
+			"max_retry_after", t.route.config.MaxRetryAfter)
+		return resp, err
+	}
+
+	if t.route.retryBudget != nil && !t.route.retryBudget.withdraw() {
+		t.route.logger.Warn("Retry budget exhausted, not retrying request after Retry-After",
+			"route", t.route.config.Name,
+			"method", req.Method,
+			"path", req.URL.Path,
+			"status", upstreamResp.StatusCode)
+
+		if t.route.metrics != nil {
+			t.route.metrics.RetryBudgetExhaustedTotal.WithLabelValues(t.route.metrics.routeLabels(t.route.config, t.route.config.Name)...).Inc()
+		}
+		return resp, err
+	}
+
+	var retryReq *http.Request
+	retryReq, err = rewindRequest(req)
+	if err != nil {
+		err = nil
+		return resp, err
+	}
+
+	t.route.logger.Debug("Upstream sent Retry-After, retrying request after the delay",
+		"route", t.route.config.Name,
+		"method", req.Method,
+		"path", req.URL.Path,
+		"status", upstreamResp.StatusCode,
+		"retry_after", delay)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-req.Context().Done():
+		if retryReq.Body != nil {
+			_ = retryReq.Body.Close()
+		}
+		return resp, err
+	case <-timer.C:
+	}
+
+	// Drain what is left of a small body so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(upstreamResp.Body, retryAfterDrainBytes))
+	_ = upstreamResp.Body.Close()
+
+	if t.route.metrics != nil {
+		t.route.metrics.UpstreamRetryAfterRetriesTotal.WithLabelValues(t.route.metrics.routeLabels(t.route.config, t.route.config.Name, req.Method)...).Inc()
+	}
+
+	resp, err = t.transportFor(retryReq).RoundTrip(retryReq)
 	return resp, err
 }
 
+// setBackground sets the context the route's background work derives from
+// and the group that tracks it.
+func (r *Route) setBackground(ctx context.Context, workers *workerGroup) {
+	r.ctx = ctx
+	r.workers = workers
+	if r.oauth2 != nil {
+		r.oauth2.ctx = ctx
+		r.oauth2.workers = workers
+	}
+}
+
 // Match returns true if this route should handle the given request.
 func (r *Route) Match(req *http.Request) (matched bool) {
-	matched = strings.HasPrefix(req.URL.Path, r.config.PathPrefix)
+	path := req.URL.Path
+	if r.config.CollapseSlashes {
+		collapsed := *req.URL
+		collapseURLSlashes(&collapsed)
+		path = collapsed.Path
+	}
+
+	matched = hasPathPrefix(path, r.config.PathPrefix, r.config.CaseInsensitivePath)
 	return matched
 }
 
+// serveStatic writes the route's static response.
+func (r *Route) serveStatic(w http.ResponseWriter) {
+	for key, value := range r.config.StaticResponse.Headers {
+		w.Header().Set(key, value)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(r.staticBody)))
+	w.WriteHeader(r.config.StaticResponse.StatusCode)
+	_, _ = w.Write(r.staticBody)
+}
+
+// methodAllowed reports whether the route accepts the given request method.
+func (r *Route) methodAllowed(method string) (allowed bool) {
+	allowed = len(r.allowedMethods) == 0 || slices.Contains(r.allowedMethods, method)
+	return allowed
+}
+
 // director modifies the request before forwarding to upstream.
 func (r *Route) director(req *http.Request) {
-	// Apply header manipulations FIRST (before ReverseProxy adds its own headers)
-	req.Header = r.headerManipulator.ProcessIncoming(req.Header)
+	// Resolve the client and pick the canary while the client's headers are
+	// untouched
+	clientIP, toCanary := r.chooseCanary(req)
 
-	// Set upstream target
-	req.URL.Scheme = r.upstream.Scheme
-	req.URL.Host = r.upstream.Host
+	r.applyRequestHeaders(req)
 
-	// Rewrite path if upstream path prefix is configured
-	if r.config.UpstreamPathPrefix != "" {
-		// Remove route path prefix and add upstream path prefix
-		path := strings.TrimPrefix(req.URL.Path, r.config.PathPrefix)
-		req.URL.Path = r.config.UpstreamPathPrefix + path
-
-		// Clean up double slashes (e.g., "//health" -> "/health")
-		if strings.HasPrefix(req.URL.Path, "//") {
-			req.URL.Path = req.URL.Path[1:]
+	// Set upstream target, letting the balancer choose for multi-upstream
+	// routes unless the request goes to the canary
+	upstream := r.upstream
+	switch {
+	case toCanary:
+		upstream = r.canary.upstream
+	case r.balancer != nil:
+		upstream = r.pickUpstream(req, clientIP)
+		if upstream == nil {
+			// The transport rejects the request with ErrNoUpstream
+			return
 		}
 	}
+	req.URL.Scheme = upstream.Scheme
+	req.URL.Host = upstream.Host
+
+	// Rewrite Referer/Origin into the chosen upstream's space (req.Host is
+	// still the incoming host)
+	if r.config.RewriteReferer {
+		r.rewriteRefererHeaders(req, upstream)
+	}
+
+	r.rewriteUpstreamURL(req, upstream)
+
+	// Strip or extend the forwarded headers while req.Host is still the
+	// client's; ReverseProxy handles X-Forwarded-For after this function
+	if r.config.ForwardedHeaders == ForwardedHeadersStandard {
+		setForwardedHeaders(req, r.trustedProxies)
+	} else {
+		stripForwardedHeaders(req.Header)
+	}
 
 	// Set Host header
 	if !r.config.PreserveHost {
-		req.Host = r.upstream.Host
+		req.Host = upstream.Host
 	}
 
 	// Remove hop-by-hop headers
-	removeHopByHopHeaders(req.Header)
+	removeHopByHopHeaders(req.Header, r.hopByHopExemptions)
 
-	// ReverseProxy will add X-Forwarded-For after this function returns
-	// We need to remove it if it's in our strip list
-	// This is handled by setting X-Forwarded-For to empty if needed
-	if r.shouldStripHeader("X-Forwarded-For") {
-		// Clear X-Forwarded-For to prevent ReverseProxy from adding it
-		req.Header.Del("X-Forwarded-For")
+	// Sign the request as the upstream will see it
+	if r.config.SignRequests != nil {
+		signRequest(req, r.config.SignRequests)
 	}
 }
 
-// shouldStripHeader checks if a header should be stripped based on strip patterns.
-func (r *Route) shouldStripHeader(headerName string) (should bool) {
-	for _, pattern := range r.config.Headers.StripIncoming {
-		if matchesPattern(headerName, pattern) {
-			should = true
-			return should
+// chooseCanary resolves the client of req, for routes with a canary or a
+// balancer, and decides whether req goes to the canary, counting the
+// decision.
+func (r *Route) chooseCanary(req *http.Request) (clientIP string, toCanary bool) {
+	if r.canary != nil || r.balancer != nil {
+		clientIP = resolveClientIP(req, r.trustedProxies)
+	}
+	toCanary = r.canary != nil && r.canary.selects(req, clientIP)
+	if r.canary != nil && r.metrics != nil {
+		variant := CanaryVariantStable
+		if toCanary {
+			variant = CanaryVariantCanary
+		}
+		r.metrics.CanaryRequestsTotal.WithLabelValues(r.metrics.routeLabels(r.config, r.config.Name, variant)...).Inc()
+	}
+	return clientIP, toCanary
+}
+
+// applyRequestHeaders applies the route's header rules to req, then restores
+// the client headers the route preserves and sets its User-Agent,
+// Authorization, and Via.
+func (r *Route) applyRequestHeaders(req *http.Request) {
+	// Keep the client's Accept-Encoding for routes forwarding it verbatim
+	var acceptEncoding []string
+	if r.config.TransparentEncoding {
+		acceptEncoding = slices.Clone(req.Header.Values("Accept-Encoding"))
+	}
+
+	// Decide on the client's Authorization before header rules touch it
+	preserveAuth := r.preservesClientAuth(req)
+	var authorization []string
+	if preserveAuth {
+		authorization = slices.Clone(req.Header.Values("Authorization"))
+	}
+
+	// Keep the client's User-Agent for routes preserving it
+	var userAgent []string
+	if r.config.UpstreamUserAgent == UserAgentPreserve {
+		userAgent = slices.Clone(req.Header.Values("User-Agent"))
+	}
+
+	// Apply header manipulations FIRST (before ReverseProxy adds its own headers)
+	if !r.fastPath {
+		req.Header = r.headerManipulator.ProcessIncoming(req.Header)
+	}
+
+	// Force or preserve the User-Agent. A missing one is sent as none, never
+	// as Go's default, because ReverseProxy blanks it.
+	switch r.config.UpstreamUserAgent {
+	case "":
+	case UserAgentPreserve:
+		restoreHeader(req.Header, "User-Agent", userAgent)
+	default:
+		req.Header.Set("User-Agent", expandEnvVars(r.config.UpstreamUserAgent))
+	}
+
+	if r.config.TransparentEncoding {
+		restoreHeader(req.Header, "Accept-Encoding", acceptEncoding)
+	}
+
+	// Forward the client's Authorization as received, or inject upstream credentials
+	if preserveAuth {
+		restoreHeader(req.Header, "Authorization", authorization)
+	} else {
+		r.injectAuthorization(req)
+	}
+
+	// Announce the proxy if configured (after stripping, so adding wins)
+	if r.config.AddViaHeader {
+		appendVia(req.Header, req.ProtoMajor, req.ProtoMinor, r.config.ViaPseudonym)
+	}
+}
+
+// rewriteUpstreamURL maps the path and query of req onto upstream.
+func (r *Route) rewriteUpstreamURL(req *http.Request, upstream *url.URL) {
+	// Collapse slash runs the same way Match did
+	if r.config.CollapseSlashes {
+		collapseURLSlashes(req.URL)
+	}
+
+	// Rewrite path if upstream path prefix is configured or the prefix is stripped
+	if r.config.UpstreamPathPrefix != "" || r.config.StripPathPrefix {
+		r.rewritePath(req.URL)
+	}
+
+	// Prefix the base path of the upstream URL, if it has one
+	prependBasePath(req.URL, upstream)
+
+	// Normalize the trailing slash of the final upstream path
+	normalizeTrailingSlash(req.URL, r.config.TrailingSlash)
+
+	// Relocate request values; path references see the upstream path
+	if len(r.requestRewrites) > 0 {
+		applyRequestRewrites(req, r.requestRewrites)
+	}
+}
+
+// upstreamSelectionKey is the context key for the upstreamSelection of a
+// request on a multi-upstream route.
+type upstreamSelectionKey struct{}
+
+// upstreamSelection records the upstream the balancer picked for a request,
+// so the transport can reject an empty pick and handleRoute can report
+// completion to a TrackingBalancer. clientIP is the request's client as
+// resolved through the trusted proxies, for balancers that hash on it.
+type upstreamSelection struct {
+	picked   bool
+	upstream *url.URL
+	clientIP string
+}
+
+// pickUpstream asks the balancer for the request's upstream and records the
+// choice on the request's upstreamSelection.
+func (r *Route) pickUpstream(req *http.Request, clientIP string) (upstream *url.URL) {
+	selection, ok := req.Context().Value(upstreamSelectionKey{}).(*upstreamSelection)
+	if ok {
+		selection.clientIP = clientIP
+	}
+
+	upstream = r.balancer.Pick(req, r.upstreams)
+
+	if ok {
+		selection.picked = true
+		selection.upstream = upstream
+	}
+	return upstream
+}
+
+// preservesClientAuth reports whether the client's Authorization header is
+// forwarded as-is instead of the route's upstream credentials.
+func (r *Route) preservesClientAuth(req *http.Request) (preserves bool) {
+	switch {
+	case r.config.AuthStrategy == AuthStrategyPassthrough:
+		preserves = true
+	case r.config.AuthStrategy == AuthStrategyInjectIfAbsent || r.config.PreserveClientAuth:
+		preserves = req.Header.Get("Authorization") != ""
+	}
+	return preserves
+}
+
+// restoreHeader sets key to values exactly, removing it when values is empty.
+func restoreHeader(header http.Header, key string, values []string) {
+	header.Del(key)
+	if len(values) > 0 {
+		header[key] = values
+	}
+}
+
+// injectAuthorization sets the route's upstream credentials. The OAuth2 token
+// is obtained by handleRoute and carried on the request context.
+func (r *Route) injectAuthorization(req *http.Request) {
+	if r.basicAuth != nil {
+		req.SetBasicAuth(r.basicAuth.Username, r.basicAuth.Password)
+	}
+
+	if token, ok := req.Context().Value(oauth2TokenKey{}).(string); ok {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// modifyResponse applies outgoing header manipulations to the upstream response
+// before ReverseProxy copies it to the client.
+func (r *Route) modifyResponse(resp *http.Response) (err error) {
+	// A response that fails here is replaced by an error from errorHandler
+	defer func() {
+		if err == nil {
+			markUpstreamResponse(resp)
+		}
+	}()
+
+	// The embedder's transformer sees the response as the upstream sent it
+	err = r.transformResponse(resp)
+	if err != nil {
+		return err
+	}
+
+	// Applied first so body transforms are bounded too
+	if r.config.BodyReadTimeout > 0 && !r.config.Streaming && responseHasBody(resp) {
+		req := resp.Request
+		resp.Body = newStallTimeoutBody(resp.Body, r.config.BodyReadTimeout, func() {
+			r.logger.Warn("Upstream response body read timed out",
+				"route", r.config.Name,
+				"upstream_host", r.upstream.Host,
+				"path", req.URL.Path,
+				"method", req.Method,
+				"timeout", r.config.BodyReadTimeout)
+		})
+	}
+
+	if r.config.ResponseBodyTransform != nil && responseHasBody(resp) {
+		var transformed bool
+		transformed, err = transformResponseBody(resp, r.config.ResponseBodyTransform)
+		if err != nil {
+			return err
+		}
+
+		if !transformed {
+			r.logger.Debug("Skipping response body transform for unsupported encoding",
+				"route", r.config.Name,
+				"content_encoding", resp.Header.Get("Content-Encoding"))
+		}
+	}
+
+	if r.config.CompressResponses && shouldCompressResponse(resp, r.config.CompressContentTypes) {
+		var compressed bool
+		compressed, err = compressResponseBody(resp, r.config.CompressMinSize)
+		if err != nil {
+			return err
+		}
+
+		if compressed {
+			r.logger.Debug("Compressed response body",
+				"route", r.config.Name,
+				"content_type", resp.Header.Get("Content-Type"))
+		}
+	}
+
+	if r.outgoingRules {
+		resp.Header = r.headerManipulator.ProcessOutgoing(resp.Header)
+	}
+
+	// Announce the proxy if configured (after stripping, so adding wins)
+	if r.config.AddViaHeader {
+		appendVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor, r.config.ViaPseudonym)
+	}
+
+	// ReverseProxy has removed the upstream's Connection header; the transport
+	// records whether the upstream closed the connection. The server closes
+	// the client connection after a response carrying Connection: close.
+	if r.config.MirrorConnectionClose && resp.Close {
+		resp.Header.Set("Connection", "close")
+	}
+
+	// Remap the status last, so everything above sees the upstream's
+	if mapped, ok := r.config.StatusCodeMap[resp.StatusCode]; ok {
+		resp.StatusCode = mapped
+		resp.Status = fmt.Sprintf("%d %s", mapped, http.StatusText(mapped))
+	}
+
+	return err
+}
+
+// requestTimeout returns the RequestTimeout bounding req's upstream exchange,
+// or zero for none. Streaming, WebSocket, and gRPC routes and upgraded
+// connections are long-lived and never bounded.
+func (r *Route) requestTimeout(req *http.Request) (timeout time.Duration) {
+	if r.config.Streaming || r.config.Protocol == ProtocolWebSocket || r.config.Protocol == ProtocolGRPC {
+		return timeout
+	}
+	if httpguts.HeaderValuesContainsToken(req.Header["Connection"], "Upgrade") {
+		return timeout
+	}
+
+	timeout = r.config.RequestTimeout
+	return timeout
+}
+
+// withDeadline bounds req by the route's request timeout, if it has one. The
+// returned cancel must be called once the request is done.
+func (r *Route) withDeadline(req *http.Request) (bounded *http.Request, cancel context.CancelFunc) {
+	bounded = req
+	cancel = func() {}
+
+	timeout := r.requestTimeout(req)
+	if timeout > 0 {
+		var ctx context.Context
+		ctx, cancel = context.WithTimeout(req.Context(), timeout)
+		bounded = req.WithContext(ctx)
+	}
+	return bounded, cancel
+}
+
+// trackUpstreamSelection records which upstream the balancer picks for req,
+// so balancers that track requests in flight can be told when it is done. The
+// returned done must be called once the request is done.
+func (r *Route) trackUpstreamSelection(req *http.Request) (tracked *http.Request, done func()) {
+	tracked = req
+	done = func() {}
+	if r.balancer == nil {
+		return tracked, done
+	}
+
+	selection := &upstreamSelection{}
+	tracked = req.WithContext(context.WithValue(req.Context(), upstreamSelectionKey{}, selection))
+
+	tracking, ok := r.balancer.(TrackingBalancer)
+	if ok {
+		done = func() {
+			if selection.upstream != nil {
+				tracking.Done(selection.upstream)
+			}
+		}
+	}
+	return tracked, done
+}
+
+// StatusClientClosedRequest is the status recorded for a request the client
+// abandoned before the upstream responded, following nginx's 499.
+const StatusClientClosedRequest = 499
+
+// errorHandler responds with 502 Bad Gateway when the upstream cannot be reached,
+// distinguishing TLS verification failures from other errors in logs and metrics.
+// A route timeout is 504 Gateway Timeout and a client cancellation 499.
+func (r *Route) errorHandler(w http.ResponseWriter, req *http.Request, err error) {
+	class := errorClass(err)
+	reason := errorReason(req, err)
+	if r.metrics != nil {
+		r.metrics.UpstreamErrorsTotal.WithLabelValues(r.metrics.routeLabels(r.config, r.config.Name, req.Method, class, reason)...).Inc()
+	}
+
+	// The client is gone, so the status only reaches logs and metrics, where
+	// it must not read as an upstream failure
+	if reason == ErrorReasonClientCancel {
+		r.logger.Debug("Client cancelled request",
+			"route", r.config.Name,
+			"path", req.URL.Path,
+			"method", req.Method)
+
+		w.WriteHeader(StatusClientClosedRequest)
+		return
+	}
+
+	if errors.Is(err, ErrNoUpstream) {
+		r.logger.Warn("No upstream available",
+			"route", r.config.Name,
+			"path", req.URL.Path,
+			"method", req.Method)
+
+		r.writeError(w, http.StatusServiceUnavailable)
+		return
+	}
+
+	if errors.Is(err, errUpstreamHeadersTooLarge) {
+		r.logger.Warn("Upstream request headers too large",
+			"route", r.config.Name,
+			"path", req.URL.Path,
+			"method", req.Method,
+			"error", err)
+
+		r.writeError(w, http.StatusRequestHeaderFieldsTooLarge)
+		return
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		r.logger.Warn("Upstream request timed out",
+			"route", r.config.Name,
+			"upstream_host", r.upstream.Host,
+			"path", req.URL.Path,
+			"method", req.Method,
+			"timeout", r.config.RequestTimeout,
+			"error_class", class)
+
+		r.writeError(w, http.StatusGatewayTimeout)
+		return
+	}
+
+	if isTLSVerificationError(err) {
+		r.logger.Warn("Upstream TLS certificate verification failed",
+			"route", r.config.Name,
+			"upstream_host", r.upstream.Host,
+			"error_class", class,
+			"error", err)
+
+		if r.metrics != nil {
+			r.metrics.UpstreamTLSErrorsTotal.WithLabelValues(r.metrics.routeLabels(r.config, r.config.Name)...).Inc()
+		}
+	} else {
+		r.logger.Error("Upstream request failed",
+			"route", r.config.Name,
+			"upstream_host", r.upstream.Host,
+			"path", req.URL.Path,
+			"method", req.Method,
+			"error_class", class,
+			"error", err)
+	}
+
+	r.writeError(w, http.StatusBadGateway)
+}
+
+// limitUpstreamHeaders applies the route's upstream header limit to req,
+// trimming headers if the policy allows. It returns errUpstreamHeadersTooLarge
+// if the headers still exceed the limit.
+func (r *Route) limitUpstreamHeaders(req *http.Request) (err error) {
+	limit := r.config.MaxUpstreamHeaderBytes
+	size := headerSize(req.Header)
+	if size <= limit {
+		return err
+	}
+
+	if r.config.UpstreamHeaderLimitPolicy == HeaderLimitTrim {
+		var dropped []string
+		dropped = trimHeaders(req.Header, r.config.UpstreamHeaderTrimOrder, limit)
+		if len(dropped) > 0 {
+			r.logger.Info("Trimmed upstream request headers",
+				"route", r.config.Name,
+				"max_upstream_header_bytes", limit,
+				"dropped", dropped)
+		}
+
+		size = headerSize(req.Header)
+		if size <= limit {
+			return err
+		}
+	}
+
+	err = fmt.Errorf("%w: %d bytes exceeds %d", errUpstreamHeadersTooLarge, size, limit)
+	return err
+}
+
+// trimHeaders deletes the headers matching patterns, in pattern order, until
+// header fits in limit bytes, and returns the names it deleted. Headers that
+// match the same pattern are deleted in sorted order.
+func trimHeaders(header http.Header, patterns []string, limit int) (dropped []string) {
+	for _, pattern := range patterns {
+		var keys []string
+		for key := range header {
+			if matchesPattern(key, pattern) {
+				keys = append(keys, key)
+			}
+		}
+		slices.Sort(keys)
+
+		for _, key := range keys {
+			if headerSize(header) <= limit {
+				return dropped
+			}
+			header.Del(key)
+			dropped = append(dropped, key)
+		}
+	}
+	return dropped
+}
+
+// rewriteRefererHeaders rewrites Referer and Origin headers that point at the
+// proxy into the space of upstream, the one chosen for the request, so the
+// upstream only ever sees its own host and path space.
+func (r *Route) rewriteRefererHeaders(req *http.Request, upstream *url.URL) {
+	proxyHosts := []string{req.Host}
+	if r.redirectBaseHost != "" {
+		proxyHosts = append(proxyHosts, r.redirectBaseHost)
+	}
+
+	referer := req.Header.Get("Referer")
+	if referer != "" {
+		rewritten, ok := RewriteReferer(referer, proxyHosts, r.config, upstream)
+		if ok {
+			r.logger.Debug("Rewrote Referer",
+				"route", r.config.Name,
+				"original", referer,
+				"rewritten", rewritten)
+			req.Header.Set("Referer", rewritten)
+		}
+	}
+
+	origin := req.Header.Get("Origin")
+	if origin != "" {
+		var originURL *url.URL
+		var err error
+		originURL, err = url.Parse(origin)
+		if err == nil && isProxyHost(originURL.Host, proxyHosts) {
+			req.Header.Set("Origin", upstream.Scheme+"://"+upstream.Host)
+		}
+	}
+}
+
+// rewritePath replaces the route path prefix with the upstream path prefix.
+// Only the path is modified; the query string (RawQuery and ForceQuery) is
+// left untouched so it survives the rewrite even when the incoming path
+// equals the prefix exactly. Path and RawPath are rewritten together so
+// encoded characters such as %2F reach the upstream intact.
+func (r *Route) rewritePath(u *url.URL) {
+	rawPath := u.RawPath
+
+	// Remove route path prefix and add upstream path prefix
+	path := trimPathPrefix(u.Path, r.config.PathPrefix, r.config.CaseInsensitivePath)
+	u.Path = rootedPath(trimDoubleSlash(r.config.UpstreamPathPrefix + path))
+
+	// Apply the same rewrite to the encoded form. If the client encoded the
+	// prefix itself in a non-canonical way, fall back to the decoded path.
+	u.RawPath = ""
+	if rawPath != "" {
+		escapedPrefix := escapePath(r.config.PathPrefix)
+		if hasPathPrefix(rawPath, escapedPrefix, r.config.CaseInsensitivePath) {
+			rawRest := trimPathPrefix(rawPath, escapedPrefix, r.config.CaseInsensitivePath)
+			u.RawPath = rootedPath(trimDoubleSlash(escapePath(r.config.UpstreamPathPrefix) + rawRest))
+		}
+	}
+}
+
+// prependBasePath prefixes u's path with the path of an http or https upstream
+// URL, so Upstream "https://host/base" receives "/v1/x" as "/base/v1/x". The
+// path of a unix upstream is its socket, not a base path.
+func prependBasePath(u *url.URL, upstream *url.URL) {
+	if upstream.Scheme == SchemeUnix {
+		return
+	}
+
+	basePath := strings.TrimSuffix(upstream.EscapedPath(), "/")
+	if basePath == "" {
+		return
+	}
+	setEscapedPath(u, basePath+rootedPath(u.EscapedPath()))
+}
+
+// normalizeTrailingSlash strips or adds a trailing slash on both Path and
+// RawPath according to mode. The root path is left alone.
+func normalizeTrailingSlash(u *url.URL, mode string) {
+	switch mode {
+	case TrailingSlashStrip:
+		if len(u.Path) > 1 {
+			u.Path = strings.TrimSuffix(u.Path, "/")
+		}
+		if len(u.RawPath) > 1 {
+			u.RawPath = strings.TrimSuffix(u.RawPath, "/")
+		}
+	case TrailingSlashAdd:
+		if !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
 		}
+		if u.RawPath != "" && !strings.HasSuffix(u.RawPath, "/") {
+			u.RawPath += "/"
+		}
+	}
+}
+
+// hasPathPrefix reports whether path starts with prefix, optionally ignoring case.
+func hasPathPrefix(path string, prefix string, caseInsensitive bool) (matched bool) {
+	if !caseInsensitive {
+		matched = strings.HasPrefix(path, prefix)
+		return matched
+	}
+
+	matched = len(path) >= len(prefix) && strings.EqualFold(path[:len(prefix)], prefix)
+	return matched
+}
+
+// trimPathPrefix removes prefix from path if present, optionally ignoring case.
+// The remainder keeps its original casing.
+func trimPathPrefix(path string, prefix string, caseInsensitive bool) (rest string) {
+	rest = path
+	if hasPathPrefix(path, prefix, caseInsensitive) {
+		rest = path[len(prefix):]
+	}
+	return rest
+}
+
+// trimDoubleSlash cleans up a leading double slash (e.g., "//health" -> "/health").
+func trimDoubleSlash(path string) (cleaned string) {
+	cleaned = path
+	if strings.HasPrefix(cleaned, "//") {
+		cleaned = cleaned[1:]
+	}
+	return cleaned
+}
+
+// collapseSlashes replaces each run of slashes in path with a single slash.
+func collapseSlashes(path string) (collapsed string) {
+	if !strings.Contains(path, "//") {
+		collapsed = path
+		return collapsed
+	}
+
+	var builder strings.Builder
+	builder.Grow(len(path))
+	for i := range len(path) {
+		if path[i] == '/' && i > 0 && path[i-1] == '/' {
+			continue
+		}
+		builder.WriteByte(path[i])
+	}
+
+	collapsed = builder.String()
+	return collapsed
+}
+
+// collapseURLSlashes collapses slash runs in u's path. It works on the escaped
+// form, where an encoded slash (%2F) is not a separator, and updates Path and
+// RawPath together so encoded characters reach the upstream intact.
+func collapseURLSlashes(u *url.URL) {
+	escaped := u.EscapedPath()
+	collapsed := collapseSlashes(escaped)
+	if collapsed != escaped {
+		setEscapedPath(u, collapsed)
+	}
+}
+
+// rootedPath ensures a path starts with a slash, turning an empty path into "/".
+func rootedPath(path string) (rooted string) {
+	rooted = path
+	if !strings.HasPrefix(rooted, "/") {
+		rooted = "/" + rooted
+	}
+	return rooted
+}
+
+// escapePath returns the canonical escaped form of a decoded path.
+func escapePath(path string) (escaped string) {
+	escaped = (&url.URL{Path: path}).EscapedPath()
+	return escaped
+}
+
+// setEscapedPath sets Path and RawPath from an escaped path.
+func setEscapedPath(u *url.URL, escaped string) {
+	var path string
+	var err error
+	path, err = url.PathUnescape(escaped)
+	if err != nil {
+		return
+	}
+
+	u.Path = path
+	u.RawPath = ""
+	if escapePath(path) != escaped {
+		u.RawPath = escaped
 	}
+}
+
+// withPreservedHeaders snapshots the incoming headers matching PreserveHopByHop
+// into the request context so the transport wrapper can restore them.
+func (r *Route) withPreservedHeaders(req *http.Request) (out *http.Request) {
+	out = req
+	if len(r.config.PreserveHopByHop) == 0 {
+		return out
+	}
+
+	preserved := make(http.Header)
+	for key, values := range req.Header {
+		if matchesAnyPattern(key, r.config.PreserveHopByHop) {
+			preserved[key] = values
+		}
+	}
+
+	if len(preserved) > 0 {
+		out = req.WithContext(context.WithValue(req.Context(), preservedHeadersKey{}, preserved))
+	}
+
+	return out
+}
+
+// shouldStripHeader checks if a header should be stripped based on strip patterns.
+func (r *Route) shouldStripHeader(headerName string) (should bool) {
+	should = matchesAnyPattern(headerName, r.config.Headers.StripIncoming)
 	return should
 }
 
+// appendVia appends an RFC 7230 Via entry ("1.1 pseudonym") to the header,
+// keeping any entries added by earlier hops.
+func appendVia(header http.Header, protoMajor int, protoMinor int, pseudonym string) {
+	entries := header.Values("Via")
+	entries = append(entries, fmt.Sprintf("%d.%d %s", protoMajor, protoMinor, pseudonym))
+	header.Set("Via", strings.Join(entries, ", "))
+}
+
+// hopByHopExemptions returns the hop-by-hop header patterns a route keeps,
+// combining protocol requirements with the PreserveHopByHop escape hatch.
+func hopByHopExemptions(config *RouteConfig) (exemptions []string) {
+	switch config.Protocol {
+	case ProtocolWebSocket:
+		// ReverseProxy needs both to detect and forward the upgrade
+		exemptions = append(exemptions, "Connection", "Upgrade")
+	case ProtocolGRPC:
+		exemptions = append(exemptions, "Connection", "Upgrade", "Te")
+	}
+
+	exemptions = append(exemptions, config.PreserveHopByHop...)
+	return exemptions
+}
+
 // removeHopByHopHeaders removes hop-by-hop headers from request.
 // These headers are connection-specific and should not be forwarded.
-func removeHopByHopHeaders(header http.Header) {
+// Headers matching any of the exemption patterns are kept.
+func removeHopByHopHeaders(header http.Header, exemptions []string) {
 	// Standard hop-by-hop headers defined in RFC 2616
 	hopByHopHeaders := []string{
 		"Connection",
@@ -145,14 +1580,19 @@ func removeHopByHopHeaders(header http.Header) {
 		"Upgrade",
 	}
 
-	for _, h := range hopByHopHeaders {
-		header.Del(h)
+	// Also remove headers listed in Connection header. These must be collected
+	// before Connection itself is removed.
+	for _, connections := range header.Values("Connection") {
+		for _, connection := range strings.Split(connections, ",") {
+			if name := strings.TrimSpace(connection); name != "" {
+				hopByHopHeaders = append(hopByHopHeaders, name)
+			}
+		}
 	}
 
-	// Also remove headers listed in Connection header
-	if connections := header.Get("Connection"); connections != "" {
-		for _, connection := range strings.Split(connections, ",") {
-			header.Del(strings.TrimSpace(connection))
+	for _, h := range hopByHopHeaders {
+		if !matchesAnyPattern(h, exemptions) {
+			header.Del(h)
 		}
 	}
 }
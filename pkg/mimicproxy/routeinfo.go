@@ -0,0 +1,159 @@
+package mimicproxy
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+)
+
+// routeDescription is the RoutesHandler view of a route. It carries no
+// credentials: URLs lose their user info and query, and header rules that set
+// values list only the header names.
+type routeDescription struct {
+	Name                 string            `json:"name"`
+	PathPrefix           string            `json:"path_prefix"`
+	Priority             int               `json:"priority"`
+	Upstream             string            `json:"upstream"`
+	Upstreams            []string          `json:"upstreams,omitempty"`
+	Balancer             string            `json:"balancer,omitempty"`
+	MirrorUpstream       string            `json:"mirror_upstream,omitempty"`
+	CanaryUpstream       string            `json:"canary_upstream,omitempty"`
+	CanaryPercentage     float64           `json:"canary_percentage,omitempty"`
+	UpstreamPathPrefix   string            `json:"upstream_path_prefix,omitempty"`
+	Protocol             string            `json:"protocol"`
+	TLSMode              string            `json:"tls_mode"`
+	AllowedMethods       []string          `json:"allowed_methods,omitempty"`
+	Auth                 string            `json:"auth,omitempty"`
+	AuthStrategy         string            `json:"auth_strategy"`
+	RequestTimeout       string            `json:"request_timeout"`
+	StripPathPrefix      bool              `json:"strip_path_prefix"`
+	PreserveHost         bool              `json:"preserve_host"`
+	SNIFromHost          bool              `json:"sni_from_host"`
+	RewriteRedirects     bool              `json:"rewrite_redirects"`
+	RewriteAuthChallenge bool              `json:"rewrite_auth_challenge"`
+	RewriteLinkHeader    bool              `json:"rewrite_link_header"`
+	RewriteReferer       bool              `json:"rewrite_referer"`
+	Streaming            bool              `json:"streaming"`
+	StaticResponse       bool              `json:"static_response"`
+	Headers              headerDescription `json:"headers"`
+}
+
+// headerDescription lists a route's header rules without their values.
+type headerDescription struct {
+	StripIncoming    []string `json:"strip_incoming,omitempty"`
+	StripOutgoing    []string `json:"strip_outgoing,omitempty"`
+	AddUpstream      []string `json:"add_upstream,omitempty"`
+	AddDownstream    []string `json:"add_downstream,omitempty"`
+	AppendUpstream   []string `json:"append_upstream,omitempty"`
+	AppendDownstream []string `json:"append_downstream,omitempty"`
+	ReplaceIncoming  []string `json:"replace_incoming,omitempty"`
+	ReplaceOutgoing  []string `json:"replace_outgoing,omitempty"`
+	RewriteIncoming  []string `json:"rewrite_incoming,omitempty"`
+	RewriteOutgoing  []string `json:"rewrite_outgoing,omitempty"`
+}
+
+// RoutesHandler returns a handler describing the configured routes as JSON,
+// in the order requests are matched against them, for debugging. Secrets are
+// never included: upstream URLs are shown without user info or query, header
+// rules without their values, and credentials only by their kind.
+func (p *Proxy) RoutesHandler() (handler http.Handler) {
+	handler = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		descriptions := make([]routeDescription, 0, len(p.routes))
+		for _, route := range p.routes {
+			descriptions = append(descriptions, describeRoute(route.config))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(map[string][]routeDescription{"routes": descriptions})
+	})
+	return handler
+}
+
+// describeRoute builds the redacted description of a route.
+func describeRoute(config *RouteConfig) (description routeDescription) {
+	description = routeDescription{
+		Name:                 config.Name,
+		PathPrefix:           config.PathPrefix,
+		Priority:             config.Priority,
+		Upstream:             redactURL(config.Upstream),
+		Balancer:             config.Balancer,
+		MirrorUpstream:       redactURL(config.MirrorUpstream),
+		UpstreamPathPrefix:   config.UpstreamPathPrefix,
+		Protocol:             config.Protocol,
+		TLSMode:              config.TLSMode,
+		AllowedMethods:       config.AllowedMethods,
+		AuthStrategy:         config.AuthStrategy,
+		RequestTimeout:       config.RequestTimeout.String(),
+		StripPathPrefix:      config.StripPathPrefix,
+		PreserveHost:         config.PreserveHost,
+		SNIFromHost:          config.SNIFromHost,
+		RewriteRedirects:     config.RewriteRedirects,
+		RewriteAuthChallenge: config.RewriteAuthChallenge,
+		RewriteLinkHeader:    config.RewriteLinkHeader,
+		RewriteReferer:       config.RewriteReferer,
+		Streaming:            config.Streaming,
+		StaticResponse:       config.StaticResponse != nil,
+		Headers: headerDescription{
+			StripIncoming:    config.Headers.StripIncoming,
+			StripOutgoing:    config.Headers.StripOutgoing,
+			AddUpstream:      headerNames(config.Headers.AddUpstream),
+			AddDownstream:    headerNames(config.Headers.AddDownstream),
+			AppendUpstream:   headerNames(config.Headers.AppendUpstream),
+			AppendDownstream: headerNames(config.Headers.AppendDownstream),
+			ReplaceIncoming:  headerNames(config.Headers.ReplaceIncoming),
+			ReplaceOutgoing:  headerNames(config.Headers.ReplaceOutgoing),
+			RewriteIncoming:  slices.Sorted(maps.Keys(config.Headers.RewriteIncoming)),
+			RewriteOutgoing:  slices.Sorted(maps.Keys(config.Headers.RewriteOutgoing)),
+		},
+	}
+
+	for _, upstream := range config.Upstreams {
+		description.Upstreams = append(description.Upstreams, redactURL(upstream))
+	}
+
+	if config.Canary != nil {
+		description.CanaryUpstream = redactURL(config.Canary.Upstream)
+		description.CanaryPercentage = config.Canary.Percentage
+	}
+
+	switch {
+	case config.UpstreamBasicAuth != nil:
+		description.Auth = "basic"
+	case config.OAuth2 != nil:
+		description.Auth = "oauth2"
+	}
+
+	return description
+}
+
+// redactURL returns rawURL without user info, query, or fragment, or an
+// empty string if it is empty or unparseable.
+func redactURL(rawURL string) (redacted string) {
+	var parsed *url.URL
+	var err error
+	parsed, err = url.Parse(rawURL)
+	if rawURL == "" || err != nil {
+		return redacted
+	}
+
+	parsed.User = nil
+	parsed.RawQuery = ""
+	parsed.Fragment = ""
+	redacted = parsed.String()
+	return redacted
+}
+
+// headerNames returns the sorted names of a header rule map.
+func headerNames(rules map[string]string) (names []string) {
+	for name := range rules {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
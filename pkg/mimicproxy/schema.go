@@ -0,0 +1,91 @@
+package mimicproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// schemaViolationError is returned for a request body that does not match
+// the route's RequestSchema. Its message lists each violation on its own line.
+type schemaViolationError struct {
+	violations []string
+}
+
+// Error implements error.
+func (e *schemaViolationError) Error() (message string) {
+	message = "request body does not match schema:\n- " + strings.Join(e.violations, "\n- ")
+	return message
+}
+
+// compileRequestSchema loads and compiles the JSON Schema at path.
+func compileRequestSchema(path string) (schema *jsonschema.Schema, err error) {
+	schema, err = jsonschema.NewCompiler().Compile(path)
+	if err != nil {
+		err = fmt.Errorf("failed to compile request schema: %w", err)
+		return schema, err
+	}
+	return schema, err
+}
+
+// validateRequestBody buffers a JSON request body into one of buffers and
+// validates it against schema, returning a copy of req that replays the
+// buffered body unchanged. Encoded bodies are decoded for validation only.
+// Non-JSON bodies and bodiless requests return req unchanged. A body that does not match the schema, is not
+// valid JSON, or cannot be decoded yields a *schemaViolationError.
+func validateRequestBody(req *http.Request, schema *jsonschema.Schema, buffers *requestBuffers) (out *http.Request, err error) {
+	out = req
+	if req.Body == nil || req.Body == http.NoBody || !isJSONContentType(req.Header.Get("Content-Type")) {
+		return out, err
+	}
+
+	var buffered *http.Request
+	var raw []byte
+	buffered, raw, err = bufferRequestBody(req, buffers)
+	if err != nil {
+		return out, err
+	}
+
+	var reader io.Reader
+	var supported bool
+	reader, supported, err = decodingReader(bytes.NewReader(raw), req.Header.Get("Content-Encoding"))
+	if err == nil && !supported {
+		err = fmt.Errorf("unsupported content encoding %q", req.Header.Get("Content-Encoding"))
+	}
+	if err != nil {
+		err = &schemaViolationError{violations: []string{err.Error()}}
+		return out, err
+	}
+
+	var document any
+	document, err = jsonschema.UnmarshalJSON(reader)
+	if err != nil {
+		err = &schemaViolationError{violations: []string{"invalid JSON: " + err.Error()}}
+		return out, err
+	}
+
+	err = schema.Validate(document)
+	if err != nil {
+		var validationErr *jsonschema.ValidationError
+		if !errors.As(err, &validationErr) {
+			return out, err
+		}
+
+		violation := &schemaViolationError{}
+		for _, unit := range validationErr.BasicOutput().Errors {
+			if unit.Error != nil {
+				violation.violations = append(violation.violations, fmt.Sprintf("at '%s': %s", unit.InstanceLocation, unit.Error))
+			}
+		}
+		err = violation
+		return out, err
+	}
+
+	out = buffered
+	return out, err
+}
@@ -0,0 +1,323 @@
+package mimicproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// serverReadHeaderTimeout bounds how long servers built by Server wait for a
+// client's request headers, guarding against slowloris-style clients.
+const serverReadHeaderTimeout = 30 * time.Second
+
+// Server returns an http.Server that serves the proxy on addr, with the
+// server limits from the proxy's configuration applied.
+func (p *Proxy) Server(addr string) (server *http.Server) {
+	server = &http.Server{
+		Addr:              addr,
+		Handler:           p,
+		MaxHeaderBytes:    p.config.MaxHeaderBytes,
+		ReadHeaderTimeout: serverReadHeaderTimeout,
+	}
+	return server
+}
+
+// ServerTLS returns a Server whose TLSConfig carries the downstream settings
+// from the proxy's TLS configuration: certificate, minimum version, and client
+// certificate verification. The certificate is loaded from TLS.CertFile and
+// TLS.KeyFile and can be replaced with ReloadTLSCertificate; serve with empty
+// file arguments to ServeTLS or ListenAndServeTLS so it is used.
+func (p *Proxy) ServerTLS(addr string) (server *http.Server, err error) {
+	var tlsConfig *tls.Config
+	tlsConfig, err = downstreamTLSConfig(&p.config.TLS)
+	if err != nil {
+		return server, err
+	}
+
+	if p.config.TLS.CertFile != "" && p.config.TLS.KeyFile != "" {
+		if p.certificate.certificate.Load() == nil {
+			err = p.ReloadTLSCertificate()
+			if err != nil {
+				return server, err
+			}
+		}
+		tlsConfig.GetCertificate = p.getCertificate
+	}
+
+	server = p.Server(addr)
+	server.TLSConfig = tlsConfig
+	return server, err
+}
+
+// ListenAndServe serves the proxy on addr until the server fails. Use Server
+// instead when the server must be shut down gracefully.
+func (p *Proxy) ListenAndServe(addr string) (err error) {
+	err = p.Server(addr).ListenAndServe()
+	return err
+}
+
+// ListenAndServeTLS serves the proxy over TLS on addr using TLS.CertFile and
+// TLS.KeyFile until the server fails. Renewed files are picked up every
+// TLS.CertReloadInterval, and client certificates are verified as
+// TLS.ClientAuth directs. Use ServerTLS instead when the server must be shut
+// down gracefully.
+func (p *Proxy) ListenAndServeTLS(addr string) (err error) {
+	if p.config.TLS.CertFile == "" || p.config.TLS.KeyFile == "" {
+		err = errors.New("TLS cert_file and key_file are required")
+		return err
+	}
+
+	var server *http.Server
+	server, err = p.ServerTLS(addr)
+	if err != nil {
+		return err
+	}
+
+	err = server.ListenAndServeTLS("", "")
+	return err
+}
+
+// ListenerConfig is one address served by Serve.
+type ListenerConfig struct {
+	// Address is the TCP address to listen on (e.g., ":8443")
+	Address string
+
+	// TLS serves HTTPS on this listener, verifying client certificates and
+	// enforcing the minimum version as the proxy's TLS configuration directs
+	TLS bool
+
+	// CertFile and KeyFile are this listener's certificate and key, loaded
+	// when Serve starts. Empty uses the proxy's TLS.CertFile and TLS.KeyFile,
+	// kept current by ReloadTLSCertificate and TLS.CertReloadInterval
+	CertFile string
+	KeyFile  string
+}
+
+// Serve serves the proxy on every listener at once until Shutdown is called or
+// one of them fails, in which case the others are closed and its error is
+// returned. All addresses are bound before any is served, so an address that
+// is in use fails Serve before anything is served. After Shutdown, Serve
+// returns http.ErrServerClosed.
+func (p *Proxy) Serve(listeners ...ListenerConfig) (err error) {
+	if len(listeners) == 0 {
+		err = errors.New("at least one listener is required")
+		return err
+	}
+
+	servers := make([]*http.Server, 0, len(listeners))
+	for _, listener := range listeners {
+		var server *http.Server
+		server, err = p.listenerServer(listener)
+		if err != nil {
+			err = fmt.Errorf("listener %s: %w", listener.Address, err)
+			return err
+		}
+		servers = append(servers, server)
+	}
+
+	var bound []net.Listener
+	bound, err = bindListeners(servers)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, ln := range bound {
+			_ = ln.Close()
+		}
+	}()
+
+	p.serversMu.Lock()
+	if p.shutDown {
+		p.serversMu.Unlock()
+		err = http.ErrServerClosed
+		return err
+	}
+	p.servers = append(p.servers, servers...)
+	p.serversMu.Unlock()
+
+	defer func() {
+		p.serversMu.Lock()
+		p.servers = slices.DeleteFunc(p.servers, func(server *http.Server) (started bool) {
+			started = slices.Contains(servers, server)
+			return started
+		})
+		p.serversMu.Unlock()
+	}()
+
+	results := make(chan error, len(servers))
+	for i, server := range servers {
+		go func() {
+			if listeners[i].TLS {
+				results <- server.ServeTLS(bound[i], "", "")
+				return
+			}
+			results <- server.Serve(bound[i])
+		}()
+	}
+
+	for range servers {
+		result := <-results
+		if err != nil {
+			continue
+		}
+
+		err = result
+		if !errors.Is(err, http.ErrServerClosed) {
+			for _, server := range servers {
+				_ = server.Close()
+			}
+		}
+	}
+	return err
+}
+
+// bindListeners binds the addresses of servers, closing those already bound
+// if any fails.
+func bindListeners(servers []*http.Server) (bound []net.Listener, err error) {
+	bound = make([]net.Listener, 0, len(servers))
+	for _, server := range servers {
+		var ln net.Listener
+		ln, err = net.Listen("tcp", server.Addr)
+		if err != nil {
+			for _, open := range bound {
+				_ = open.Close()
+			}
+			bound = nil
+			err = fmt.Errorf("listener %s: %w", server.Addr, err)
+			return bound, err
+		}
+		bound = append(bound, ln)
+	}
+	return bound, err
+}
+
+// Shutdown gracefully stops the servers running under Serve: their listeners
+// close at once and in-flight requests finish, up to ctx's deadline. Serve
+// cannot be called again afterwards. Shutdown leaves the proxy's upstream
+// connections and background work alone; call Close once it returns. The up
+// metric drops to 0 as soon as Shutdown is called, unless another proxy
+// sharing the registry is still serving.
+func (p *Proxy) Shutdown(ctx context.Context) (err error) {
+	p.serversMu.Lock()
+	p.shutDown = true
+	servers := slices.Clone(p.servers)
+	p.serversMu.Unlock()
+
+	p.stopServing()
+
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = server.Shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+
+	err = errors.Join(errs...)
+	return err
+}
+
+// listenerServer builds the server for one of Serve's listeners.
+func (p *Proxy) listenerServer(listener ListenerConfig) (server *http.Server, err error) {
+	if !listener.TLS {
+		server = p.Server(listener.Address)
+		return server, err
+	}
+
+	if listener.CertFile == "" && listener.KeyFile == "" {
+		if p.config.TLS.CertFile == "" || p.config.TLS.KeyFile == "" {
+			err = errors.New("TLS cert_file and key_file are required")
+			return server, err
+		}
+
+		server, err = p.ServerTLS(listener.Address)
+		return server, err
+	}
+
+	if listener.CertFile == "" || listener.KeyFile == "" {
+		err = errors.New("cert_file and key_file must be set together")
+		return server, err
+	}
+
+	var tlsConfig *tls.Config
+	tlsConfig, err = downstreamTLSConfig(&p.config.TLS)
+	if err != nil {
+		return server, err
+	}
+
+	var certificate tls.Certificate
+	certificate, err = tls.LoadX509KeyPair(listener.CertFile, listener.KeyFile)
+	if err != nil {
+		err = fmt.Errorf("failed to load TLS certificate: %w", err)
+		return server, err
+	}
+	tlsConfig.Certificates = []tls.Certificate{certificate}
+
+	server = p.Server(listener.Address)
+	server.TLSConfig = tlsConfig
+	return server, err
+}
+
+// downstreamTLSConfig builds the tls.Config for client-facing connections.
+func downstreamTLSConfig(config *TLSConfig) (tlsConfig *tls.Config, err error) {
+	tlsConfig = &tls.Config{
+		MinVersion: tlsVersion(config.MinVersion),
+	}
+
+	if config.ClientCAFile != "" {
+		var pem []byte
+		pem, err = os.ReadFile(config.ClientCAFile)
+		if err != nil {
+			err = fmt.Errorf("failed to read client CA file: %w", err)
+			return tlsConfig, err
+		}
+
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			err = fmt.Errorf("no certificates found in client CA file: %s", config.ClientCAFile)
+			return tlsConfig, err
+		}
+	}
+
+	switch config.ClientAuth {
+	case ClientAuthVerifyIfGiven:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequireAndVerify:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	case ClientAuthNone:
+		tlsConfig.ClientAuth = tls.NoClientCert
+	default:
+		if config.ClientCAFile != "" {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return tlsConfig, err
+}
+
+// tlsVersion returns the tls package constant for a validated version string,
+// or TLS 1.2 when none is configured.
+func tlsVersion(version string) (number uint16) {
+	switch version {
+	case "1.0":
+		number = tls.VersionTLS10
+	case "1.1":
+		number = tls.VersionTLS11
+	case "1.3":
+		number = tls.VersionTLS13
+	default:
+		number = tls.VersionTLS12
+	}
+	return number
+}
@@ -0,0 +1,97 @@
+package mimicproxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// maxSNITransports caps the transports an SNIFromHost route keeps, one per
+// server name, so client-chosen Hosts cannot grow them without bound.
+const maxSNITransports = 64
+
+// sniTransports hands out copies of a route's transport whose TLS server name
+// is a request's Host. Connections are pooled by address alone, so each
+// server name needs its own transport to keep a connection negotiated for one
+// Host from carrying requests for another.
+type sniTransports struct {
+	base *http.Transport
+
+	// template is the unconfigured transport base was copied from; each
+	// server name's transport is copied from it
+	template *http.Transport
+
+	mu         sync.Mutex
+	transports map[string]*http.Transport
+}
+
+// newSNITransports creates per-server-name copies of template, the
+// unconfigured source of base, on demand.
+func newSNITransports(base *http.Transport, template *http.Transport) (s *sniTransports) {
+	s = &sniTransports{
+		base:       base,
+		template:   template,
+		transports: make(map[string]*http.Transport),
+	}
+	return s
+}
+
+// forRequest returns the transport for req's Host, or the base transport when
+// req has no Host or is not sent over TLS.
+func (s *sniTransports) forRequest(req *http.Request) (transport *http.Transport) {
+	serverName := req.Host
+	var host string
+	var err error
+	host, _, err = net.SplitHostPort(serverName)
+	if err == nil {
+		serverName = host
+	}
+
+	if serverName == "" || req.URL.Scheme != SchemeHTTPS {
+		transport = s.base
+		return transport
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ok bool
+	transport, ok = s.transports[serverName]
+	if ok {
+		return transport
+	}
+
+	// Make room by dropping any other server name's transport
+	if len(s.transports) >= maxSNITransports {
+		for name, evicted := range s.transports {
+			evicted.CloseIdleConnections()
+			delete(s.transports, name)
+			break
+		}
+	}
+
+	config := &tls.Config{}
+	if s.template.TLSClientConfig != nil {
+		config = s.template.TLSClientConfig.Clone()
+	}
+	config.ServerName = serverName
+
+	transport = s.template.Clone()
+	transport.TLSClientConfig = config
+	// Only a copied transport's first configuration can fail
+	_ = configureHTTP2(transport)
+	s.transports[serverName] = transport
+	return transport
+}
+
+// closeIdleConnections closes the idle connections of every server name's
+// transport.
+func (s *sniTransports) closeIdleConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, transport := range s.transports {
+		transport.CloseIdleConnections()
+	}
+}
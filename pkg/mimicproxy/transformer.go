@@ -0,0 +1,61 @@
+package mimicproxy
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// RouteTransformer transforms a route's upstream requests and responses with
+// logic compiled into the embedding program, such as translating to and from
+// a custom protocol. Register one per route with WithRouteTransformer.
+// Implementations must be safe for concurrent use.
+type RouteTransformer interface {
+	// TransformRequest modifies the request as it is about to be sent to the
+	// upstream, after the route's path, header, and authentication rules and
+	// any request signing.
+	TransformRequest(req *http.Request) (err error)
+
+	// TransformResponse modifies the upstream's response as it arrives, before
+	// the route's body transforms, compression, header rules, and status
+	// mapping.
+	TransformResponse(resp *http.Response) (err error)
+}
+
+// WithRouteTransformer registers transformer for the route named route. An
+// error from either of its methods fails the request with 502 Bad Gateway.
+// New fails if no route has that name.
+func WithRouteTransformer(route string, transformer RouteTransformer) (option Option) {
+	option = func(options *proxyOptions) {
+		if options.transformers == nil {
+			options.transformers = make(map[string]RouteTransformer)
+		}
+		options.transformers[route] = transformer
+	}
+	return option
+}
+
+// transformRequest applies the route's RouteTransformer, if any, to req.
+func (r *Route) transformRequest(req *http.Request) (err error) {
+	if r.transformer == nil {
+		return err
+	}
+
+	err = r.transformer.TransformRequest(req)
+	if err != nil {
+		err = fmt.Errorf("request transform failed: %w", err)
+	}
+	return err
+}
+
+// transformResponse applies the route's RouteTransformer, if any, to resp.
+func (r *Route) transformResponse(resp *http.Response) (err error) {
+	if r.transformer == nil {
+		return err
+	}
+
+	err = r.transformer.TransformResponse(resp)
+	if err != nil {
+		err = fmt.Errorf("response transform failed: %w", err)
+	}
+	return err
+}
@@ -1,17 +1,47 @@
 package mimicproxy
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"golang.org/x/net/http2"
 )
 
+// DefaultTLSSessionCacheSize is the number of upstream TLS sessions cached
+// when TransportConfig.TLSSessionCacheSize is zero.
+const DefaultTLSSessionCacheSize = 256
+
 // NewTransport creates a customized http.Transport with connection pooling
 // and timeouts configured for optimal proxy performance.
 func NewTransport(config *TransportConfig, tlsConfig *tls.Config) (transport *http.Transport, err error) {
+	proxy := http.ProxyFromEnvironment
+	if config.UpstreamProxyURL != "" {
+		var proxyURL *url.URL
+		proxyURL, err = url.Parse(config.UpstreamProxyURL)
+		if err != nil {
+			err = fmt.Errorf("invalid upstream proxy URL: %w", err)
+			return transport, err
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
 	transport = &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
+		Proxy: proxy,
 		DialContext: (&net.Dialer{
 			Timeout:   config.DialTimeout,
 			KeepAlive: 30 * time.Second,
@@ -25,8 +55,415 @@ func NewTransport(config *TransportConfig, tlsConfig *tls.Config) (transport *ht
 		ExpectContinueTimeout: config.ExpectContinueTimeout,
 		DisableKeepAlives:     config.DisableKeepAlives,
 		DisableCompression:    config.DisableCompression,
-		TLSClientConfig:       tlsConfig,
+		TLSClientConfig:       withSessionCache(tlsConfig, config.TLSSessionCacheSize),
 	}
 
 	return transport, err
 }
+
+// configureHTTP2 has transport speak HTTP/2 through golang.org/x/net/http2
+// rather than net/http's bundled copy, so its errors, such as
+// http2.GoAwayError, can be matched. A transport with a non-nil TLSNextProto
+// has HTTP/2 disabled or already set up and is left alone. A configured
+// transport must not be cloned: the clone would share its HTTP/2 connections.
+func configureHTTP2(transport *http.Transport) (err error) {
+	if transport.TLSNextProto != nil {
+		return err
+	}
+
+	_, err = http2.ConfigureTransports(transport)
+	return err
+}
+
+// withSessionCache returns a copy of tlsConfig with an LRU client session
+// cache of size sessions, so repeated connections to an upstream resume their
+// TLS sessions instead of redoing full handshakes. A zero size uses
+// DefaultTLSSessionCacheSize; a negative size, or a tlsConfig that already has
+// a cache, leaves tlsConfig unchanged.
+func withSessionCache(tlsConfig *tls.Config, size int) (configured *tls.Config) {
+	configured = tlsConfig
+	if size < 0 || (tlsConfig != nil && tlsConfig.ClientSessionCache != nil) {
+		return configured
+	}
+
+	if size == 0 {
+		size = DefaultTLSSessionCacheSize
+	}
+
+	configured = &tls.Config{}
+	if tlsConfig != nil {
+		configured = tlsConfig.Clone()
+	}
+	configured.ClientSessionCache = tls.NewLRUClientSessionCache(size)
+	return configured
+}
+
+// egressProxyTransport returns a copy of transport that sends every request
+// through the forward proxy at proxyURL.
+func egressProxyTransport(transport *http.Transport, proxyURL *url.URL) (egressTransport *http.Transport) {
+	egressTransport = transport.Clone()
+	egressTransport.Proxy = http.ProxyURL(proxyURL)
+	return egressTransport
+}
+
+// unixSocketHost is the Host sent to Unix domain socket upstreams.
+const unixSocketHost = "localhost"
+
+// unixSocketTransport returns a copy of transport that sends every request over
+// the Unix domain socket at socketPath, regardless of the request's host. The
+// socket is dialed with dialer, and its connections are tracked in metrics
+// unless metrics is nil.
+func unixSocketTransport(transport *http.Transport, socketPath string, dialer *net.Dialer, metrics *Metrics) (unixTransport *http.Transport) {
+	unixTransport = transport.Clone()
+	unixTransport.Proxy = nil
+	unixTransport.DialContext = func(ctx context.Context, _ string, _ string) (conn net.Conn, err error) {
+		conn, err = dialer.DialContext(ctx, "unix", socketPath)
+		return conn, err
+	}
+	if metrics != nil {
+		unixTransport.DialContext = trackConnections(unixTransport.DialContext, metrics)
+	}
+
+	return unixTransport
+}
+
+// dialFunc is the signature of http.Transport.DialContext.
+type dialFunc func(ctx context.Context, network string, addr string) (conn net.Conn, err error)
+
+// withDialTimeout wraps dial so that each dial fails after timeout with the
+// same i/o timeout error net.Dialer's Timeout gives, rather than the context
+// error a request timeout gives. A zero timeout leaves dial unbounded.
+func withDialTimeout(dial dialFunc, timeout time.Duration) (bounded dialFunc) {
+	bounded = dial
+	if timeout <= 0 {
+		return bounded
+	}
+
+	bounded = func(ctx context.Context, network string, addr string) (conn net.Conn, err error) {
+		dialCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		conn, err = dial(dialCtx, network, addr)
+		if err != nil && errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			err = &net.OpError{Op: "dial", Net: network, Err: os.ErrDeadlineExceeded}
+		}
+		return conn, err
+	}
+	return bounded
+}
+
+// trackConnections wraps dial so that each upstream connection records whether
+// it is idle in the pool, keeping the idle connections gauge accurate when the
+// transport closes idle connections.
+func trackConnections(dial dialFunc, metrics *Metrics) (tracked dialFunc) {
+	tracked = func(ctx context.Context, network string, addr string) (conn net.Conn, err error) {
+		conn, err = dial(ctx, network, addr)
+		if err != nil {
+			return conn, err
+		}
+
+		conn = &trackedConn{Conn: conn, upstream: addr, metrics: metrics}
+		return conn, err
+	}
+	return tracked
+}
+
+// trackedConn is an upstream connection that knows whether it is idle.
+type trackedConn struct {
+	net.Conn
+	upstream string
+	metrics  *Metrics
+	idle     atomic.Bool
+}
+
+// setIdle marks the connection idle or in use, adjusting the idle gauge.
+func (c *trackedConn) setIdle(idle bool) {
+	if c.idle.Swap(idle) == idle {
+		return
+	}
+
+	if idle {
+		c.metrics.TransportIdleConns.WithLabelValues(c.upstream).Inc()
+	} else {
+		c.metrics.TransportIdleConns.WithLabelValues(c.upstream).Dec()
+	}
+}
+
+// Close closes the connection, removing it from the idle count.
+func (c *trackedConn) Close() (err error) {
+	c.setIdle(false)
+	err = c.Conn.Close()
+	return err
+}
+
+// upstreamAddr returns the host:port the transport dials for u, matching the
+// address trackedConn records.
+func upstreamAddr(u *url.URL) (addr string) {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == SchemeHTTPS {
+			port = "443"
+		}
+	}
+
+	addr = net.JoinHostPort(u.Hostname(), port)
+	return addr
+}
+
+// asTrackedConn returns the trackedConn underlying conn.
+func asTrackedConn(conn net.Conn) (tracked *trackedConn, ok bool) {
+	tracked, ok = unwrapConn[*trackedConn](conn)
+	return tracked, ok
+}
+
+// unwrapConn returns the connection of type T underlying conn, unwrapping TLS
+// and the proxy's own connection wrappers.
+func unwrapConn[T net.Conn](conn net.Conn) (found T, ok bool) {
+	for conn != nil {
+		found, ok = conn.(T)
+		if ok {
+			return found, ok
+		}
+
+		wrapper, isWrapper := conn.(interface{ NetConn() net.Conn })
+		if !isWrapper {
+			return found, ok
+		}
+		conn = wrapper.NetConn()
+	}
+	return found, ok
+}
+
+// limitConnLifetime wraps dial so that each upstream connection is closed
+// once it is older than lifetime: immediately if it is idle in the pool, or
+// when its request finishes if it is in use.
+func limitConnLifetime(dial dialFunc, lifetime time.Duration) (limited dialFunc) {
+	limited = func(ctx context.Context, network string, addr string) (conn net.Conn, err error) {
+		conn, err = dial(ctx, network, addr)
+		if err != nil {
+			return conn, err
+		}
+
+		lc := &lifetimeConn{Conn: conn}
+		lc.expiry = time.AfterFunc(lifetime, lc.expire)
+		conn = lc
+		return conn, err
+	}
+	return limited
+}
+
+// lifetimeConn is an upstream connection with a maximum age. Connections
+// start out in use: the transport dials on behalf of a request.
+type lifetimeConn struct {
+	net.Conn
+	expiry *time.Timer
+
+	mu      sync.Mutex
+	idle    bool
+	expired bool
+}
+
+// NetConn returns the wrapped connection.
+func (c *lifetimeConn) NetConn() (conn net.Conn) {
+	conn = c.Conn
+	return conn
+}
+
+// expire marks the connection as past its lifetime, closing it if idle.
+func (c *lifetimeConn) expire() {
+	c.mu.Lock()
+	c.expired = true
+	idle := c.idle
+	c.mu.Unlock()
+
+	if idle {
+		_ = c.Close()
+	}
+}
+
+// acquire marks the connection in use by a request.
+func (c *lifetimeConn) acquire() {
+	c.mu.Lock()
+	c.idle = false
+	c.mu.Unlock()
+}
+
+// release marks the connection idle in the pool, closing it if it expired
+// while in use.
+func (c *lifetimeConn) release() {
+	c.mu.Lock()
+	c.idle = true
+	expired := c.expired
+	c.mu.Unlock()
+
+	if expired {
+		_ = c.Close()
+	}
+}
+
+// Close stops the lifetime timer and closes the connection.
+func (c *lifetimeConn) Close() (err error) {
+	c.expiry.Stop()
+	err = c.Conn.Close()
+	return err
+}
+
+// Upstream error classes, the error_class of upstream error metrics and logs.
+const (
+	// ErrorClassTimeout is a request, dial, or handshake that timed out.
+	ErrorClassTimeout = "timeout"
+	// ErrorClassDNS is a failure to resolve the upstream's host name.
+	ErrorClassDNS = "dns"
+	// ErrorClassRefused is a connection refused by the upstream.
+	ErrorClassRefused = "refused"
+	// ErrorClassTLS is a failed TLS handshake or certificate verification.
+	ErrorClassTLS = "tls"
+	// ErrorClassEOF is a connection the upstream closed mid-exchange.
+	ErrorClassEOF = "eof"
+	// ErrorClassOther is any other failure.
+	ErrorClassOther = "other"
+)
+
+// Reasons an upstream request failed, the reason of upstream error metrics.
+const (
+	// ErrorReasonClientCancel is a request the client abandoned before the
+	// upstream responded.
+	ErrorReasonClientCancel = "client_cancel"
+	// ErrorReasonUpstreamTimeout is a request that ran past the route's
+	// RequestTimeout or a transport timeout.
+	ErrorReasonUpstreamTimeout = "upstream_timeout"
+	// ErrorReasonUpstreamError is any other failure.
+	ErrorReasonUpstreamError = "upstream_error"
+)
+
+// errorReason reports why req's upstream exchange failed with err: a context
+// the client cancelled is ErrorReasonClientCancel, even if the transport
+// returned some other error on seeing it, while an expired route deadline or
+// a transport timeout is ErrorReasonUpstreamTimeout.
+func errorReason(req *http.Request, err error) (reason string) {
+	ctxErr := req.Context().Err()
+
+	switch {
+	case errors.Is(ctxErr, context.Canceled):
+		reason = ErrorReasonClientCancel
+	case errors.Is(ctxErr, context.DeadlineExceeded) || errorClass(err) == ErrorClassTimeout:
+		reason = ErrorReasonUpstreamTimeout
+	case ctxErr == nil && errors.Is(err, context.Canceled):
+		reason = ErrorReasonClientCancel
+	default:
+		reason = ErrorReasonUpstreamError
+	}
+	return reason
+}
+
+// errorClass classifies an upstream request error as one of the ErrorClass
+// constants, for metrics and logs. A DNS lookup that timed out is "dns".
+func errorClass(err error) (class string) {
+	var dnsErr *net.DNSError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var netErr net.Error
+
+	switch {
+	case errors.As(err, &dnsErr):
+		class = ErrorClassDNS
+	case isTLSVerificationError(err) || errors.As(err, &recordErr) || errors.As(err, &alertErr):
+		class = ErrorClassTLS
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		class = ErrorClassTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		class = ErrorClassRefused
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		class = ErrorClassEOF
+	default:
+		class = ErrorClassOther
+	}
+	return class
+}
+
+// isTLSVerificationError reports whether err was caused by the upstream's
+// certificate failing verification (unknown authority, expired, wrong host, ...).
+func isTLSVerificationError(err error) (verification bool) {
+	var verificationErr *tls.CertificateVerificationError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var certificateInvalidErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+
+	verification = errors.As(err, &verificationErr) ||
+		errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &certificateInvalidErr) ||
+		errors.As(err, &hostnameErr)
+	return verification
+}
+
+// goAwayRetryDelay is how long to wait before retrying a request that failed
+// because the upstream sent GOAWAY, giving the transport time to dial a new
+// connection instead of racing the one being torn down.
+const goAwayRetryDelay = 10 * time.Millisecond
+
+// retryAfterDrainBytes is how much of a response being retried after its
+// Retry-After is read before closing it, to keep the connection reusable.
+const retryAfterDrainBytes = 4 << 10
+
+// isGoAwayError reports whether err was caused by the upstream sending an
+// HTTP/2 GOAWAY frame. Only transports set up by configureHTTP2 report it;
+// net/http's bundled HTTP/2 implementation keeps its error types unexported.
+func isGoAwayError(err error) (goAway bool) {
+	var goAwayErr http2.GoAwayError
+	goAway = errors.As(err, &goAwayErr)
+	return goAway
+}
+
+// isReplayable reports whether a request can safely be sent again: its method
+// is idempotent and its body is empty or can be re-obtained.
+func isReplayable(req *http.Request) (replayable bool) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return replayable
+	}
+
+	replayable = req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	return replayable
+}
+
+// parseRetryAfter parses a Retry-After value, either delay seconds or an HTTP
+// date, into the delay from now. A date in the past is no delay.
+func parseRetryAfter(value string, now time.Time) (delay time.Duration, ok bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return delay, ok
+	}
+
+	var seconds int64
+	var err error
+	seconds, err = strconv.ParseInt(value, 10, 64)
+	if err == nil {
+		if seconds < 0 || seconds > int64(math.MaxInt64/time.Second) {
+			return delay, ok
+		}
+		delay, ok = time.Duration(seconds)*time.Second, true
+		return delay, ok
+	}
+
+	var date time.Time
+	date, err = http.ParseTime(value)
+	if err != nil {
+		return delay, ok
+	}
+
+	delay, ok = max(date.Sub(now), 0), true
+	return delay, ok
+}
+
+// rewindRequest returns a copy of req with a fresh body, ready to be sent again.
+func rewindRequest(req *http.Request) (rewound *http.Request, err error) {
+	rewound = req.Clone(req.Context())
+	if req.Body == nil || req.Body == http.NoBody {
+		return rewound, err
+	}
+
+	rewound.Body, err = req.GetBody()
+	return rewound, err
+}
@@ -0,0 +1,93 @@
+package mimicproxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ValidationError is one problem found in a configuration. Its Error method
+// returns the problem as Validate reports it, prefixed with the sections that
+// enclose the field, e.g. "route 1 (kyc): headers: header X-Api-Key: ...".
+type ValidationError struct {
+	// Field is the path of the offending setting, e.g.
+	// "routes[1].headers.add_upstream.X-Api-Key"
+	Field string
+
+	// Message describes the problem without the enclosing sections
+	Message string
+
+	// err is the problem with the context of its enclosing sections
+	err error
+}
+
+// Error implements error.
+func (e ValidationError) Error() (message string) {
+	switch {
+	case e.err != nil:
+		message = e.err.Error()
+	case e.Field != "":
+		message = e.Field + ": " + e.Message
+	default:
+		message = e.Message
+	}
+	return message
+}
+
+// Unwrap returns the underlying error, if any.
+func (e ValidationError) Unwrap() (err error) {
+	err = e.err
+	return err
+}
+
+// validationErrors collects the problems found while validating a
+// configuration, in the order they are found.
+type validationErrors []ValidationError
+
+// add records err as a problem with field.
+func (v *validationErrors) add(field string, err error) {
+	*v = append(*v, ValidationError{Field: field, Message: err.Error(), err: err})
+}
+
+// addNested records the problems of a nested section: their fields are
+// prefixed with field, and their errors with "context: " unless context is
+// empty.
+func (v *validationErrors) addNested(field string, context string, nested validationErrors) {
+	for _, problem := range nested {
+		problem.Field = joinFieldPath(field, problem.Field)
+		if context != "" {
+			problem.err = fmt.Errorf("%s: %w", context, problem.err)
+		}
+		*v = append(*v, problem)
+	}
+}
+
+// err joins the problems into one error, or returns nil if there are none. A
+// single problem is returned unjoined.
+func (v validationErrors) err() (err error) {
+	switch len(v) {
+	case 0:
+	case 1:
+		err = v[0]
+	default:
+		errs := make([]error, 0, len(v))
+		for _, problem := range v {
+			errs = append(errs, problem)
+		}
+		err = errors.Join(errs...)
+	}
+	return err
+}
+
+// joinFieldPath appends child to the field path parent.
+func joinFieldPath(parent string, child string) (path string) {
+	switch {
+	case child == "":
+		path = parent
+	case parent == "", strings.HasPrefix(child, "["):
+		path = parent + child
+	default:
+		path = parent + "." + child
+	}
+	return path
+}
@@ -0,0 +1,68 @@
+package mimicproxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// closeTimeout bounds how long Close waits for background work to stop.
+const closeTimeout = 5 * time.Second
+
+// workerGroup tracks a proxy's background goroutines, such as mirror requests
+// and OAuth2 token refreshes, so Close can wait for them. A nil group runs
+// work untracked.
+type workerGroup struct {
+	mu      sync.Mutex
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// start runs work in a new goroutine unless the group has been stopped.
+func (g *workerGroup) start(work func()) (started bool) {
+	if g == nil {
+		go work()
+		started = true
+		return started
+	}
+
+	g.mu.Lock()
+	if g.stopped {
+		g.mu.Unlock()
+		return started
+	}
+	g.wg.Add(1)
+	g.mu.Unlock()
+
+	go func() {
+		defer g.wg.Done()
+		work()
+	}()
+
+	started = true
+	return started
+}
+
+// stop prevents new work from starting and waits up to timeout for running
+// work to finish. The caller is expected to have signalled the work to stop.
+func (g *workerGroup) stop(timeout time.Duration) (err error) {
+	g.mu.Lock()
+	g.stopped = true
+	g.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+	case <-timer.C:
+		err = fmt.Errorf("background work did not stop within %s", timeout)
+	}
+	return err
+}